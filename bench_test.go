@@ -6,8 +6,11 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -85,6 +88,18 @@ func BenchmarkMap(b *testing.B) {
 	benchMarshalOpts(b, "jettison-nosort", m, UnsortedMap())
 }
 
+func BenchmarkLargeMap(b *testing.B) {
+	if testing.Short() {
+		b.SkipNow()
+	}
+	m := make(map[string]int, 1e5)
+	for i := 0; i < 1e5; i++ {
+		m[strconv.Itoa(i)] = i
+	}
+	benchMarshalOpts(b, "sorted", m)
+	benchMarshalOpts(b, "parallel", m, ParallelThreshold(1e4))
+}
+
 func BenchmarkSyncMap(b *testing.B) {
 	if testing.Short() {
 		b.SkipNow()
@@ -120,11 +135,28 @@ func BenchmarkDurationFormat(b *testing.B) {
 		DurationMicroseconds,
 		DurationMilliseconds,
 		DurationNanoseconds,
+		DurationISO8601,
 	} {
 		benchMarshalOpts(b, f.String(), d, DurationFormat(f))
 	}
 }
 
+func BenchmarkBigIntSlice(b *testing.B) {
+	if testing.Short() {
+		b.SkipNow()
+	}
+	// Mix of integers that fit in an int64,
+	// and larger ones.
+	s := make([]*big.Int, 10000)
+	for i := range s {
+		s[i] = big.NewInt(int64(i) * math.MaxInt32)
+		if i%2 != 0 {
+			s[i].Lsh(s[i], 128)
+		}
+	}
+	benchMarshal(b, s)
+}
+
 func BenchmarkTime(b *testing.B) {
 	if testing.Short() {
 		b.SkipNow()
@@ -184,6 +216,56 @@ func BenchmarkMarshaler(b *testing.B) {
 	}
 }
 
+func BenchmarkMarshalerSlice(b *testing.B) {
+	if testing.Short() {
+		b.SkipNow()
+	}
+	var (
+		s1 = make([]jetibm, 1024)
+		s2 = make([]AppendMarshaler, len(s1))
+	)
+	for i := range s2 {
+		s2[i] = s1[i]
+	}
+	// The elements of the slice of interfaces
+	// are asserted one at a time, whereas the
+	// concrete type is resolved once.
+	benchMarshalOpts(b, "concrete", s1)
+	benchMarshalOpts(b, "interface", s2)
+}
+
+func BenchmarkEncodeToBuilder(b *testing.B) {
+	if testing.Short() {
+		b.SkipNow()
+	}
+	x := codeInit(b)
+
+	b.Run("marshal", func(b *testing.B) {
+		var sb strings.Builder
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sb.Reset()
+			bts, err := Marshal(x)
+			if err != nil {
+				b.Fatal(err)
+			}
+			sb.Write(bts)
+			b.SetBytes(int64(len(bts)))
+		}
+	})
+	b.Run("builder", func(b *testing.B) {
+		var sb strings.Builder
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sb.Reset()
+			if err := EncodeToBuilder(x, &sb); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(sb.Len()))
+		}
+	})
+}
+
 func codeInit(b *testing.B) *codeResponse {
 	f, err := os.Open("testdata/code.json.gz")
 	if err != nil {
@@ -0,0 +1,444 @@
+package jettison
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// appendCanonical appends to dst the JSON text b without
+// insignificant whitespace, with its strings and its
+// numbers serialized as defined by section 3.2.2 of the
+// RFC 8785, the JSON Canonicalization Scheme, and the
+// members of its objects sorted as defined by section
+// 3.2.3, which includes the output of marshalers.
+func appendCanonical(dst, b []byte) ([]byte, error) {
+	dst, n, err := appendCanonicalValue(dst, b)
+	if err != nil {
+		return dst, err
+	}
+	if skipSpaces(b, n) != len(b) {
+		return dst, errInvalidCanonical
+	}
+	return dst, nil
+}
+
+var errInvalidCanonical = &SyntaxError{msg: "json: invalid output for canonicalization"}
+
+// appendCanonicalValue is similar to appendCanonical, but
+// for the JSON value at the beginning of b, and returns
+// the length of its representation in b.
+func appendCanonicalValue(dst, b []byte) ([]byte, int, error) {
+	i := skipSpaces(b, 0)
+	if i == len(b) {
+		return dst, i, errInvalidCanonical
+	}
+	switch c := b[i]; {
+	case c == '{':
+		return appendCanonicalObject(dst, b, i)
+	case c == '[':
+		dst = append(dst, '[')
+		if i = skipSpaces(b, i+1); i < len(b) && b[i] == ']' {
+			return append(dst, ']'), i + 1, nil
+		}
+		for {
+			var (
+				n   int
+				err error
+			)
+			if dst, n, err = appendCanonicalValue(dst, b[i:]); err != nil {
+				return dst, i, err
+			}
+			if i = skipSpaces(b, i+n); i == len(b) {
+				return dst, i, errInvalidCanonical
+			}
+			switch b[i] {
+			case ']':
+				return append(dst, ']'), i + 1, nil
+			case ',':
+				dst = append(dst, ',')
+				i++
+			default:
+				return dst, i, errInvalidCanonical
+			}
+		}
+	case c == '"':
+		s, n, err := unquoteJSON(b[i:])
+		if err != nil {
+			return dst, i, err
+		}
+		return appendCanonicalString(dst, s), i + n, nil
+	case c == '-' || c >= '0' && c <= '9':
+		j := i + 1
+		for j < len(b) && isNumberByte(b[j]) {
+			j++
+		}
+		num := string(b[i:j])
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			// The numbers must be representable
+			// as IEEE 754 double precision values.
+			return dst, i, &UnsupportedValueError{reflect.ValueOf(num), num}
+		}
+		if f == 0 {
+			// Negative zero is serialized as 0.
+			dst = append(dst, '0')
+		} else if dst, err = appendFloat(dst, f, 64); err != nil {
+			return dst, i, err
+		}
+		return dst, j, nil
+	default:
+		// The literals true, false and null.
+		j := i
+		for j < len(b) && b[j] >= 'a' && b[j] <= 'z' {
+			j++
+		}
+		if j == i {
+			return dst, i, errInvalidCanonical
+		}
+		return append(dst, b[i:j]...), j, nil
+	}
+}
+
+// canonicalMember represents the bounds of the
+// canonical form of an object's member, and of
+// its name, without quotes.
+type canonicalMember struct {
+	start, nameEnd, end int
+}
+
+// appendCanonicalObject is similar to appendCanonicalValue,
+// for the JSON object that starts at the offset i of b,
+// whose members are sorted by the UTF-16 code units of
+// their names.
+func appendCanonicalObject(dst, b []byte, i int) ([]byte, int, error) {
+	var (
+		buf     []byte
+		members []canonicalMember
+	)
+	if i = skipSpaces(b, i+1); i < len(b) && b[i] == '}' {
+		return append(dst, "{}"...), i + 1, nil
+	}
+	for {
+		if i == len(b) || b[i] != '"' {
+			return dst, i, errInvalidCanonical
+		}
+		s, n, err := unquoteJSON(b[i:])
+		if err != nil {
+			return dst, i, err
+		}
+		m := canonicalMember{start: len(buf)}
+		buf = appendCanonicalString(buf, s)
+		m.nameEnd = len(buf) - 1
+
+		if i = skipSpaces(b, i+n); i == len(b) || b[i] != ':' {
+			return dst, i, errInvalidCanonical
+		}
+		buf = append(buf, ':')
+		if buf, n, err = appendCanonicalValue(buf, b[i+1:]); err != nil {
+			return dst, i, err
+		}
+		m.end = len(buf)
+		members = append(members, m)
+
+		if i = skipSpaces(b, i+1+n); i == len(b) {
+			return dst, i, errInvalidCanonical
+		}
+		if b[i] == '}' {
+			break
+		}
+		if b[i] != ',' {
+			return dst, i, errInvalidCanonical
+		}
+		i = skipSpaces(b, i+1)
+	}
+	sort.SliceStable(members, func(x, y int) bool {
+		mx, my := members[x], members[y]
+		return compareUTF16(buf[mx.start+1:mx.nameEnd], buf[my.start+1:my.nameEnd]) < 0
+	})
+	dst = append(dst, '{')
+	for k, m := range members {
+		if k != 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, buf[m.start:m.end]...)
+	}
+	return append(dst, '}'), i + 1, nil
+}
+
+// hasMember returns whether the JSON object b, which
+// must be valid, has a member whose unescaped name is
+// the given name.
+func hasMember(b, name []byte) bool {
+	i := skipSpaces(b, 0) + 1
+	for {
+		if i = skipSpaces(b, i); i == len(b) || b[i] != '"' {
+			return false
+		}
+		s, n, err := unquoteJSON(b[i:])
+		if err != nil {
+			return false
+		}
+		if bytes.Equal(s, name) {
+			return true
+		}
+		i = skipSpaces(b, i+n) + 1 // colon
+		i = skipSpaces(b, skipValue(b, skipSpaces(b, i)))
+		if i == len(b) || b[i] != ',' {
+			return false
+		}
+		i++
+	}
+}
+
+// skipValue returns the offset that follows the
+// valid JSON value that starts at the offset i of b.
+func skipValue(b []byte, i int) int {
+	depth := 0
+	for ; i < len(b); i++ {
+		switch c := b[i]; c {
+		case '"':
+			for i++; i < len(b) && b[i] != '"'; i++ {
+				if b[i] == '\\' {
+					i++
+				}
+			}
+		case '{', '[':
+			depth++
+			continue
+		case '}', ']':
+			depth--
+		default:
+			if depth != 0 {
+				continue
+			}
+			// The numbers and literals end
+			// with the first delimiter.
+			for i < len(b) && !isDelim(b[i]) {
+				i++
+			}
+			return i
+		}
+		if depth == 0 {
+			return i + 1
+		}
+	}
+	return i
+}
+
+func isDelim(c byte) bool {
+	return c == ',' || c == '}' || c == ']' || c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// skipSpaces returns the offset of the first
+// byte of b, from i, that isn't a whitespace.
+func skipSpaces(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\n' || b[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+func isNumberByte(c byte) bool {
+	return c >= '0' && c <= '9' || c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-'
+}
+
+// appendCanonicalString appends s to dst as a JSON string
+// in which only the double quote and backslash characters,
+// and the control characters, are escaped, with the short
+// sequences when they exist. The invalid UTF-8 bytes are
+// replaced with the Unicode replacement character.
+func appendCanonicalString(dst, s []byte) []byte {
+	dst = append(dst, '"')
+	at := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRune(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				dst = append(dst, s[at:i]...)
+				dst = append(dst, "\uFFFD"...)
+				i++
+				at = i
+				continue
+			}
+			i += size
+			continue
+		}
+		if c >= ' ' && c != '"' && c != '\\' {
+			i++
+			continue
+		}
+		dst = append(dst, s[at:i]...)
+		switch c {
+		case '"', '\\':
+			dst = append(dst, '\\', c)
+		case '\b':
+			dst = append(dst, '\\', 'b')
+		case '\f':
+			dst = append(dst, '\\', 'f')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\t':
+			dst = append(dst, '\\', 't')
+		default:
+			dst = append(dst, `\u00`...)
+			dst = append(dst, hex[c>>4], hex[c&0xF])
+		}
+		i++
+		at = i
+	}
+	dst = append(dst, s[at:]...)
+
+	return append(dst, '"')
+}
+
+// unquoteJSON returns the unescaped content of the JSON
+// string at the beginning of b, and the length of its
+// representation, including the quotes.
+func unquoteJSON(b []byte) ([]byte, int, error) {
+	i := 1
+	for i < len(b) && b[i] != '"' && b[i] != '\\' {
+		i++
+	}
+	if i < len(b) && b[i] == '"' {
+		// Fast path for the strings
+		// without escape sequences.
+		return b[1:i], i + 1, nil
+	}
+	s := append([]byte(nil), b[1:i]...)
+	for i < len(b) {
+		switch b[i] {
+		case '"':
+			return s, i + 1, nil
+		case '\\':
+			var rb [utf8.UTFMax]byte
+			r, n := decodeEscape(b[i:])
+			s = append(s, rb[:utf8.EncodeRune(rb[:], r)]...)
+			i += n
+		default:
+			s = append(s, b[i])
+			i++
+		}
+	}
+	return nil, 0, &SyntaxError{msg: "json: unterminated string"}
+}
+
+// decodeEscape decodes the escape sequence at the
+// beginning of b, and returns the rune it represents
+// and its length. The surrogate pairs are combined,
+// and the invalid sequences are decoded as the
+// Unicode replacement character.
+func decodeEscape(b []byte) (rune, int) {
+	if len(b) < 2 {
+		return utf8.RuneError, len(b)
+	}
+	switch b[1] {
+	case '"', '\\', '/':
+		return rune(b[1]), 2
+	case 'b':
+		return '\b', 2
+	case 'f':
+		return '\f', 2
+	case 'n':
+		return '\n', 2
+	case 'r':
+		return '\r', 2
+	case 't':
+		return '\t', 2
+	case 'u':
+		r := hex4(b[2:])
+		if r < 0 {
+			return utf8.RuneError, 2
+		}
+		if !utf16.IsSurrogate(r) {
+			return r, 6
+		}
+		if len(b) >= 12 && b[6] == '\\' && b[7] == 'u' {
+			if r = utf16.DecodeRune(r, hex4(b[8:])); r != utf8.RuneError {
+				return r, 12
+			}
+		}
+		return utf8.RuneError, 6
+	}
+	return utf8.RuneError, 2
+}
+
+// hex4 returns the value of the four hexadecimal
+// digits at the beginning of b, or -1.
+func hex4(b []byte) rune {
+	if len(b) < 4 {
+		return -1
+	}
+	var r rune
+	for _, c := range b[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c -= 'a' - 10
+		case c >= 'A' && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return -1
+		}
+		r = r<<4 | rune(c)
+	}
+	return r
+}
+
+// compareUTF16 compares the escaped JSON strings a and
+// b, without quotes, by the UTF-16 code units of their
+// characters, as required to sort the properties of the
+// objects by section 3.2.3 of the RFC 8785.
+func compareUTF16(a, b []byte) int {
+	for len(a) != 0 && len(b) != 0 {
+		ra, na := nextRune(a)
+		rb, nb := nextRune(b)
+		if ra != rb {
+			// Only the first code unit of the characters
+			// beyond the Basic Multilingual Plane differ
+			// from the code point order.
+			ua, ub := ra, rb
+			if ra > 0xFFFF {
+				ua, _ = utf16.EncodeRune(ra)
+			}
+			if rb > 0xFFFF {
+				ub, _ = utf16.EncodeRune(rb)
+			}
+			if ua == ub {
+				ua, ub = ra, rb
+			}
+			if ua < ub {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[na:], b[nb:]
+	}
+	return len(a) - len(b)
+}
+
+func nextRune(b []byte) (rune, int) {
+	if b[0] == '\\' {
+		return decodeEscape(b)
+	}
+	return utf8.DecodeRune(b)
+}
+
+// canonicalMapElems orders the map elements by key,
+// as defined by the JSON Canonicalization Scheme.
+type canonicalMapElems struct{ mapElems }
+
+func (m canonicalMapElems) Less(i, j int) bool {
+	a, b := m.s[i].key, m.s[j].key
+	if c := compareUTF16(a, b); c != 0 {
+		return c < 0
+	}
+	return bytes.Compare(a, b) < 0
+}
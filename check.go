@@ -0,0 +1,151 @@
+package jettison
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// CanEncode returns an error if some values of the type
+// t can't be encoded with the given options, because t
+// is, or contains, a type that isn't supported, such as
+// a channel, a function, or a map whose keys aren't
+// supported. It walks the graph of the types reachable
+// from t without generating their instructions, and
+// returns an UnsupportedTypeError for the first such
+// type, wrapped in an error that indicates the path of
+// its field if it is reached from a struct.
+// The values of interface types, whose dynamic types
+// are only known at runtime, are assumed to be supported.
+func CanEncode(t reflect.Type, opts ...Option) error {
+	if t == nil {
+		return nil
+	}
+	eo, err := applyEncOpts(opts)
+	if err != nil {
+		return err
+	}
+	c := typeChecker{
+		opts: eo,
+		seen: make(map[checkKey]struct{}),
+	}
+	// Like for the instructions, only a pointer
+	// makes the top-level value addressable.
+	return c.check(t, t.Kind() == reflect.Ptr, nil)
+}
+
+// typeChecker walks a graph of types for CanEncode.
+type typeChecker struct {
+	opts encOpts
+	seen map[checkKey]struct{}
+}
+
+// checkKey identifies a type checked by a typeChecker,
+// since the methods with a pointer receiver of a type
+// are only used if its values are addressable.
+type checkKey struct {
+	typ     reflect.Type
+	canAddr bool
+}
+
+// check returns an error if the type t, reached by
+// following the given path of struct fields, or one
+// of the types it contains, isn't supported. canAddr
+// indicates if the values of type t are addressable.
+func (c *typeChecker) check(t reflect.Type, canAddr bool, path []string) error {
+	key := checkKey{t, canAddr}
+	if _, ok := c.seen[key]; ok {
+		// Either the type is being checked,
+		// for recursive types, or it is known
+		// to be supported.
+		return nil
+	}
+	c.seen[key] = struct{}{}
+
+	if c.hasEncoder(t, canAddr) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Chan, reflect.UnsafePointer:
+		return unsupportedTypeAt(t, path)
+	case reflect.Func:
+		if ok, _ := isFuncValue(t); !ok || !c.opts.flags.has(resolveFuncValues) {
+			return unsupportedTypeAt(t, path)
+		}
+	case reflect.Complex64, reflect.Complex128:
+		if !c.opts.flags.has(complexAsObject) {
+			return unsupportedTypeAt(t, path)
+		}
+	case reflect.Ptr, reflect.Slice:
+		return c.check(t.Elem(), true, path)
+	case reflect.Array:
+		return c.check(t.Elem(), canAddr, path)
+	case reflect.Map:
+		kt := t.Key()
+		if !isString(kt) && !isInteger(kt) && !kt.Implements(textMarshalerType) {
+			return unsupportedTypeAt(t, path)
+		}
+		return c.check(t.Elem(), false, path)
+	case reflect.Struct:
+		for _, f := range cachedFields(t, c.opts.tagKey(), c.opts.keyNamer()) {
+			names, ft := goFieldPath(t, f.index)
+			if err := c.check(ft, canAddr, append(path[:len(path):len(path)], names...)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasEncoder returns whether the values of type t
+// are encoded by a registered function, a special
+// instruction, or one of their methods, instead of
+// according to their kind. The methods with a pointer
+// receiver are considered only if canAddr is true.
+func (c *typeChecker) hasEncoder(t reflect.Type, canAddr bool) bool {
+	if registeredTypeEncoder(t) != nil || isRegisteredType(t) {
+		return true
+	}
+	if newGoTypeInstr(t, canAddr) != nil {
+		return true
+	}
+	implements := func(it reflect.Type) bool {
+		return t.Implements(it) || canAddr && reflect.PtrTo(t).Implements(it)
+	}
+	flags := c.opts.flags
+	for _, it := range []reflect.Type{
+		appendMarshalerCtxType,
+		appendMarshalerType,
+		jsonMarshalerType,
+		textMarshalerType,
+	} {
+		if implements(it) {
+			return true
+		}
+	}
+	for _, opt := range []struct {
+		typ  reflect.Type
+		flag bitmask
+	}{
+		{errorType, errorAsString},
+		{binaryMarshalerType, binaryMarshalerBase64},
+		{sqlValuerType, sqlValuer},
+		{stringReaderType, streamStringReaders},
+	} {
+		if flags.has(opt.flag) && implements(opt.typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsupportedTypeAt returns an UnsupportedTypeError
+// for the type t, wrapped in an error that indicates
+// the path of the field of type t, if any.
+func unsupportedTypeAt(t reflect.Type, path []string) error {
+	err := &UnsupportedTypeError{t}
+	if len(path) == 0 {
+		return err
+	}
+	return fmt.Errorf("json: field %s: %w", strings.Join(path, "."), err)
+}
@@ -2,26 +2,68 @@ package jettison
 
 import (
 	"bytes"
+	"database/sql/driver"
 	"encoding"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
+	"math/big"
 	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
 	"sync"
 	"time"
+	"unicode/utf16"
 	"unicode/utf8"
 	"unsafe"
 )
 
 const hex = "0123456789abcdef"
 
+// The indexes of the safe sets, combined from the
+// escaping flags that change which ASCII characters
+// can be used in a JSON string without escaping.
+const (
+	safeNoHTML = 1 << iota
+	safeNoDEL
+	safeNoSlash
+)
+
+// safeSets holds, for each combination of the safe
+// set indexes, whether an ASCII character can be used
+// in a JSON string without escaping. Like the safeSet
+// and htmlSafeSet tables of the encoding/json package,
+// it avoids to test the flags for each character.
+var safeSets = newSafeSets()
+
+func newSafeSets() (sets [1 << 3][utf8.RuneSelf]bool) {
+	for i := range sets {
+		for c := byte(' '); c < utf8.RuneSelf; c++ {
+			switch {
+			case c == '\\' || c == '"':
+			case (c == '<' || c == '>' || c == '&') && i&safeNoHTML == 0:
+			case c == 0x7f && i&safeNoDEL != 0:
+			case c == '/' && i&safeNoSlash != 0:
+			default:
+				sets[i][c] = true
+			}
+		}
+	}
+	return sets
+}
+
 //nolint:unparam
-func encodeBool(p unsafe.Pointer, dst []byte, _ encOpts) ([]byte, error) {
+func encodeBool(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+	if opts.flags.has(boolAsInt) {
+		if *(*bool)(p) {
+			return append(dst, '1'), nil
+		}
+		return append(dst, '0'), nil
+	}
 	if *(*bool)(p) {
 		return append(dst, "true"...), nil
 	}
@@ -34,6 +76,15 @@ func encodeBool(p unsafe.Pointer, dst []byte, _ encOpts) ([]byte, error) {
 // end of the JSON string.
 // nolint:unparam
 func encodeString(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+	if opts.flags.has(truncateStrings) {
+		return appendTruncatedString(dst, sp2b(p), opts), nil
+	}
+	return encodeKeyString(p, dst, opts)
+}
+
+// encodeKeyString is similar to encodeString, but the
+// string is never truncated, as required for map keys.
+func encodeKeyString(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
 	dst = append(dst, '"')
 	dst = appendEscapedBytes(dst, sp2b(p), opts)
 	dst = append(dst, '"')
@@ -52,23 +103,126 @@ func encodeQuotedString(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, err
 
 // encodeFloat32 appends the textual representation of
 // the 32-bits floating point number pointed by p to dst.
-func encodeFloat32(p unsafe.Pointer, dst []byte, _ encOpts) ([]byte, error) {
-	return appendFloat(dst, float64(*(*float32)(p)), 32)
+func encodeFloat32(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+	f := float64(*(*float32)(p))
+	if opts.flags.has(narrowIntegralFloats) && isIntegral(f) {
+		return strconv.AppendInt(dst, int64(f), 10), nil
+	}
+	var err error
+	off := len(dst)
+	if opts.flags.has(fixedFloatPrecision) {
+		dst, err = appendFixedFloat(dst, f, opts.x.floatFmt, opts.x.floatPrec, 32)
+	} else {
+		dst, err = appendFloat(dst, f, 32)
+	}
+	if err == nil && opts.flags.has(decimalSeparator) {
+		dst = replaceRadixPoint(dst, off, opts.x.radixPoint)
+	}
+	return dst, err
 }
 
 // encodeFloat64 appends the textual representation of
 // the 64-bits floating point number pointed by p to dst.
-func encodeFloat64(p unsafe.Pointer, dst []byte, _ encOpts) ([]byte, error) {
-	return appendFloat(dst, *(*float64)(p), 64)
+func encodeFloat64(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+	f := *(*float64)(p)
+	if opts.flags.has(narrowIntegralFloats) && isIntegral(f) {
+		return strconv.AppendInt(dst, int64(f), 10), nil
+	}
+	var err error
+	off := len(dst)
+	if opts.flags.has(fixedFloatPrecision) {
+		dst, err = appendFixedFloat(dst, f, opts.x.floatFmt, opts.x.floatPrec, 64)
+	} else {
+		dst, err = appendFloat(dst, f, 64)
+	}
+	if err == nil && opts.flags.has(decimalSeparator) {
+		dst = replaceRadixPoint(dst, off, opts.x.radixPoint)
+	}
+	return dst, err
+}
+
+// replaceRadixPoint replaces the decimal point of the
+// number written at dst[off:] with the rune r.
+func replaceRadixPoint(dst []byte, off int, r rune) []byte {
+	i := bytes.IndexByte(dst[off:], '.')
+	if i < 0 {
+		return dst
+	}
+	i += off
+	if r < utf8.RuneSelf {
+		dst[i] = byte(r)
+		return dst
+	}
+	var rb [utf8.UTFMax]byte
+
+	tail := append([]byte(nil), dst[i+1:]...)
+	dst = append(dst[:i], rb[:utf8.EncodeRune(rb[:], r)]...)
+
+	return append(dst, tail...)
 }
 
+// isIntegral returns whether f has no fractional
+// part and is within the range of an int64.
+func isIntegral(f float64) bool {
+	return f >= math.MinInt64 && f < math.MaxInt64 && f == math.Trunc(f)
+}
+
+const truncatedValue = `"<truncated>"`
+
 func encodeInterface(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
 	v := *(*interface{})(p)
 	if v == nil {
-		return append(dst, "null"...), nil
+		return appendNull(dst, opts), nil
+	}
+	if opts.flags.has(limitIfaceDepth) {
+		if opts.ifaceDepth >= opts.x.maxIfaceDepth {
+			return append(dst, truncatedValue...), nil
+		}
+		opts.ifaceDepth++
 	}
 	typ := reflect.TypeOf(v)
-	ins := cachedInstr(typ)
+	ins := typeInstr(typ, opts)
+
+	return ins(unpackEface(v).word, dst, opts)
+}
+
+// encodeFuncValue calls the function pointed to by
+// p, which has one of the signatures accepted by the
+// ResolveFuncValues option, and encodes its result.
+func encodeFuncValue(
+	p unsafe.Pointer, dst []byte, opts encOpts, t reflect.Type, withErr bool,
+) ([]byte, error) {
+	if *(*unsafe.Pointer)(p) == nil {
+		return appendNull(dst, opts), nil
+	}
+	var v interface{}
+	if withErr {
+		var err error
+		if v, err = (*(*func() (interface{}, error))(p))(); err != nil {
+			return dst, &MarshalerError{Type: t, Err: err, funcName: funcValueCall}
+		}
+	} else {
+		v = (*(*func() interface{})(p))()
+	}
+	return encodeInterface(unsafe.Pointer(&v), dst, opts)
+}
+
+// encodeMethodInterface is similar to encodeInterface,
+// but for interfaces with methods, which have a layout
+// that differs from the one of the empty interface.
+func encodeMethodInterface(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+	v := interface{}(*(*interface{ M() })(p))
+	if v == nil {
+		return appendNull(dst, opts), nil
+	}
+	if opts.flags.has(limitIfaceDepth) {
+		if opts.ifaceDepth >= opts.x.maxIfaceDepth {
+			return append(dst, truncatedValue...), nil
+		}
+		opts.ifaceDepth++
+	}
+	typ := reflect.TypeOf(v)
+	ins := typeInstr(typ, opts)
 
 	return ins(unpackEface(v).word, dst, opts)
 }
@@ -88,13 +242,128 @@ func encodeNumber(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
 	if !opts.flags.has(noNumberValidation) && !isValidNumber(num) {
 		return dst, fmt.Errorf("json: invalid number literal %q", num)
 	}
+	if opts.flags.has(numberAsString) {
+		// The literal is escaped, since it
+		// may not have been validated.
+		return encodeKeyString(unsafe.Pointer(&num), dst, opts)
+	}
 	return append(dst, num...), nil
 }
 
+// encodeCleanNumber appends the string pointed by p
+// to dst as a number literal, after the removal of its
+// underscores and white spaces, such as in "1_000 000".
+// The result is always validated.
+// nolint:unparam
+func encodeCleanNumber(p unsafe.Pointer, dst []byte, _ encOpts) ([]byte, error) {
+	s := *(*string)(p)
+	off := len(dst)
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '_', ' ', '\t', '\n', '\r':
+		default:
+			dst = append(dst, c)
+		}
+	}
+	if !isValidNumber(string(dst[off:])) {
+		return dst[:off], fmt.Errorf("json: invalid number literal %q", s)
+	}
+	return dst, nil
+}
+
+// encodeBigInt appends the base 10 representation
+// of the big.Int pointed by p to dst. This bypasses
+// the MarshalJSON method, to avoid the allocation of
+// its result.
+// nolint:unparam
+func encodeBigInt(p unsafe.Pointer, dst []byte, _ encOpts) ([]byte, error) {
+	return appendBigInt(dst, (*big.Int)(p)), nil
+}
+
+// encodeBigIntPtr is similar to encodeBigInt, but
+// p points to a *big.Int, which may be nil.
+func encodeBigIntPtr(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+	bi := *(**big.Int)(p)
+	if bi == nil {
+		return appendNull(dst, opts), nil
+	}
+	return appendBigInt(dst, bi), nil
+}
+
+func appendBigInt(dst []byte, bi *big.Int) []byte {
+	if bi.IsInt64() {
+		return strconv.AppendInt(dst, bi.Int64(), 10)
+	}
+	return bi.Append(dst, 10)
+}
+
+// encodeBigRat appends the big.Rat pointed by p to
+// dst, as a JSON number if it has a finite decimal
+// representation, or as a JSON string of the form
+// "a/b" otherwise.
+// nolint:unparam
+func encodeBigRat(p unsafe.Pointer, dst []byte, _ encOpts) ([]byte, error) {
+	return appendBigRat(dst, (*big.Rat)(p)), nil
+}
+
+// encodeBigRatPtr is similar to encodeBigRat, but
+// p points to a *big.Rat, which may be nil.
+func encodeBigRatPtr(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+	r := *(**big.Rat)(p)
+	if r == nil {
+		return appendNull(dst, opts), nil
+	}
+	return appendBigRat(dst, r), nil
+}
+
+func appendBigRat(dst []byte, r *big.Rat) []byte {
+	if r.IsInt() {
+		return appendBigInt(dst, r.Num())
+	}
+	if n, ok := decimalPlaces(r.Denom()); ok {
+		return append(dst, r.FloatString(n)...)
+	}
+	dst = append(dst, '"')
+	dst = append(dst, r.RatString()...)
+	return append(dst, '"')
+}
+
+// decimalPlaces returns the number of decimal places
+// of the fractions whose denominator is d, in lowest
+// terms, and whether it is finite, which is the case
+// if d has no other prime factors than 2 and 5.
+func decimalPlaces(d *big.Int) (int, bool) {
+	x := new(big.Int).Set(d)
+
+	twos := int(x.TrailingZeroBits())
+	x.Rsh(x, uint(twos))
+
+	var (
+		fives int
+		five  = big.NewInt(5)
+		q, m  = new(big.Int), new(big.Int)
+	)
+	for {
+		if q.QuoRem(x, five, m); m.Sign() != 0 {
+			break
+		}
+		x, q = q, x
+		fives++
+	}
+	if !x.IsInt64() || x.Int64() != 1 {
+		return 0, false
+	}
+	if twos > fives {
+		return twos, true
+	}
+	return fives, true
+}
+
 func encodeRawMessage(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
 	v := *(*json.RawMessage)(p)
 	if v == nil {
-		return append(dst, "null"...), nil
+		return appendNull(dst, opts), nil
 	}
 	if opts.flags.has(noCompact) {
 		return append(dst, v...), nil
@@ -106,20 +375,28 @@ func encodeRawMessage(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error
 // p to dst based on the format configured in opts.
 func encodeTime(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
 	t := *(*time.Time)(p)
-	y := t.Year()
 
-	if y < 0 || y >= 10000 {
+	// The timestamps are integers, and don't
+	// have the range of the formatted years.
+	if opts.flags.has(unixTimeFlags) {
+		return appendUnixTime(dst, t, opts.flags)
+	}
+	if opts.flags.has(timeInLocation) && hasZoneElem(opts.timeLayout) {
+		t = t.In(opts.x.timeLoc)
+	}
+	if y := t.Year(); y < 0 || y >= 10000 {
 		// See comment golang.org/issue/4556#c15.
 		return dst, errors.New("time: year outside of range [0,9999]")
 	}
-	if opts.flags.has(unixTime) {
-		return strconv.AppendInt(dst, t.Unix(), 10), nil
-	}
 	switch opts.timeLayout {
 	case time.RFC3339:
-		return appendRFC3339Time(t, dst, false), nil
+		return appendRFC3339Time(t, dst, false, true), nil
 	case time.RFC3339Nano:
-		return appendRFC3339Time(t, dst, true), nil
+		return appendRFC3339Time(t, dst, true, true), nil
+	case rfc3339Offset:
+		return appendRFC3339Time(t, dst, false, false), nil
+	case rfc3339NanoOffset:
+		return appendRFC3339Time(t, dst, true, false), nil
 	default:
 		dst = append(dst, '"')
 		dst = t.AppendFormat(dst, opts.timeLayout)
@@ -128,6 +405,34 @@ func encodeTime(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
 	}
 }
 
+// Bounds of the time values that can be
+// represented in Unix nanoseconds.
+var (
+	minUnixNanoTime = time.Unix(0, math.MinInt64)
+	maxUnixNanoTime = time.Unix(0, math.MaxInt64)
+)
+
+// appendUnixTime appends the Unix timestamp of t
+// to dst, in the unit of the option set in flags.
+func appendUnixTime(dst []byte, t time.Time, flags bitmask) ([]byte, error) {
+	switch {
+	case flags.has(unixMilliTime):
+		return strconv.AppendInt(dst, t.UnixMilli(), 10), nil
+	case flags.has(unixMicroTime):
+		return strconv.AppendInt(dst, t.UnixMicro(), 10), nil
+	case flags.has(unixNanoTime):
+		if t.Before(minUnixNanoTime) || t.After(maxUnixNanoTime) {
+			return dst, &UnsupportedValueError{
+				reflect.ValueOf(t),
+				"time outside of the range of Unix nanoseconds",
+			}
+		}
+		return strconv.AppendInt(dst, t.UnixNano(), 10), nil
+	default:
+		return strconv.AppendInt(dst, t.Unix(), 10), nil
+	}
+}
+
 // encodeDuration appends the time.Duration value pointed
 // by p to dst based on the format configured in opts.
 func encodeDuration(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
@@ -149,9 +454,47 @@ func encodeDuration(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error)
 		dst = appendDuration(dst, d)
 		dst = append(dst, '"')
 		return dst, nil
+	case DurationISO8601:
+		dst = append(dst, '"')
+		dst = appendISO8601Duration(dst, d)
+		dst = append(dst, '"')
+		return dst, nil
 	}
 }
 
+// appendNull appends to dst the literal of the nil
+// values, which is null unless the NullLiteral option
+// is used.
+func appendNull(dst []byte, opts encOpts) []byte {
+	if opts.x != nil && opts.x.nullLit != nil {
+		return append(dst, opts.x.nullLit...)
+	}
+	return append(dst, "null"...)
+}
+
+// appendFloatSpecial appends the representation of
+// the NaN or infinite value f to dst, in format ff.
+func appendFloatSpecial(dst []byte, f float64, ff floatSpecialFmt) []byte {
+	if ff == floatSpecialNull {
+		return append(dst, "null"...)
+	}
+	dst = append(dst, '"')
+	dst = strconv.AppendFloat(dst, f, 'g', -1, 64)
+	return append(dst, '"')
+}
+
+// appendFixedFloat appends the representation of f
+// to dst, in the given format with the precision prec.
+func appendFixedFloat(dst []byte, f float64, format byte, prec, bs int) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return dst, &UnsupportedValueError{
+			reflect.ValueOf(f),
+			strconv.FormatFloat(f, 'g', -1, bs),
+		}
+	}
+	return strconv.AppendFloat(dst, f, format, prec, bs), nil
+}
+
 func appendFloat(dst []byte, f float64, bs int) ([]byte, error) {
 	if math.IsInf(f, 0) || math.IsNaN(f) {
 		return dst, &UnsupportedValueError{
@@ -182,11 +525,72 @@ func appendFloat(dst []byte, f float64, bs int) ([]byte, error) {
 	return dst, nil
 }
 
-func encodePointer(p unsafe.Pointer, dst []byte, opts encOpts, ins instruction) ([]byte, error) {
+// encodePointer encodes the value pointed to by p
+// with ins, or null if p is nil. If the zeroNilPointers
+// flag is set, the zero-value pointed to by zero, if
+// not nil, is encoded in place of a nil pointer.
+func encodePointer(
+	p unsafe.Pointer, dst []byte, opts encOpts, t reflect.Type, ins instruction, zero unsafe.Pointer,
+) ([]byte, error) {
 	if p = *(*unsafe.Pointer)(p); p != nil {
+		if opts.flags.has(detectCycles) {
+			k := visitKey{typ: t, ptr: p}
+			if err := opts.x.visit(k); err != nil {
+				return dst, err
+			}
+			dst, err := ins(p, dst, opts)
+			opts.x.leave(k)
+
+			return dst, err
+		}
 		return ins(p, dst, opts)
 	}
-	return append(dst, "null"...), nil
+	if zero != nil && opts.flags.has(zeroNilPointers) {
+		opts.flags.unset(zeroNilPointers)
+		return ins(zero, dst, opts)
+	}
+	return appendNull(dst, opts), nil
+}
+
+// selectMapKey returns whether the entry of a map
+// whose unquoted key is given must be encoded, and
+// the path selected for its value, if any.
+func selectMapKey(key []byte, keys stringSet, sel *fieldPath) (*fieldPath, bool) {
+	if keys == nil && sel == nil {
+		return nil, true
+	}
+	key = unescapeKey(key)
+
+	if !keys.hasKey(key) {
+		return nil, false
+	}
+	if sel == nil {
+		return nil, true
+	}
+	return sel.lookup(string(key))
+}
+
+// unescapeKey returns the text of the unquoted
+// JSON representation of a map key. The key is
+// returned as is if it has no escape sequences.
+func unescapeKey(key []byte) []byte {
+	i := bytes.IndexByte(key, '\\')
+	if i < 0 {
+		return key
+	}
+	s := append(make([]byte, 0, len(key)), key[:i]...)
+	for i < len(key) {
+		if key[i] != '\\' {
+			s = append(s, key[i])
+			i++
+			continue
+		}
+		var rb [utf8.UTFMax]byte
+		r, n := decodeEscape(key[i:])
+		s = append(s, rb[:utf8.EncodeRune(rb[:], r)]...)
+		i += n
+	}
+	return s
 }
 
 func encodeStruct(
@@ -195,15 +599,42 @@ func encodeStruct(
 	var (
 		nxt = byte('{')
 		key []byte // key of the field
+		sel = opts.path
 	)
 	noHTMLEscape := opts.flags.has(noHTMLEscaping)
+	explicit := opts.flags.has(explicitDefaults)
+	omitStructs := opts.flags.has(omitEmptyStructs)
+	puny := opts.flags.has(punycodeKeys)
+	reEscape := opts.flags.has(escapeNonASCII|escapeSlash) && !opts.flags.has(noStringEscaping)
+
+	pfx := opts.fieldKeyPrefix()
+	report := opts.fieldSizeReport()
+	version, versioned := opts.apiVersion()
+	roles := opts.callerRoles()
+	filter := opts.fieldFilter()
+	redacted := opts.redactedFields()
+	opts.depth++
+	if opts.depthExceeded() {
+		return dst, ErrMaxDepthExceeded
+	}
 
 fieldLoop:
 	for i := 0; i < len(flds); i++ {
 		f := &flds[i] // get pointer to prevent copy
-		if opts.isDeniedField(f.name) {
+
+		if versioned && !f.inVersion(version) {
+			continue
+		}
+		if f.roles != nil && !roles.hasAny(f.roles) {
+			continue
+		}
+		name := f.name
+		if opts.isDeniedField(name, sel) {
 			continue
 		}
+		if sel != nil {
+			opts.path, _ = sel.lookup(name)
+		}
 		fp := p
 
 		// Find the nested struct field by following
@@ -223,34 +654,80 @@ fieldLoop:
 		}
 		// Ignore the field if it is a nil pointer and has
 		// the omitnil option in his tag.
-		if f.omitNil && *(*unsafe.Pointer)(fp) == nil {
+		if f.omitNil && !explicit && *(*unsafe.Pointer)(fp) == nil {
 			continue
 		}
 		// Ignore the field if it represents the zero-value
 		// of its type and has the omitempty option in his tag.
 		// Empty func is non-nil only if the field has the
 		// omitempty option in its tag.
-		if f.omitEmpty && f.empty(fp) {
+		if f.omitEmpty && !explicit && f.empty(fp) {
 			continue
 		}
+		// Ignore the struct field if it represents the zero
+		// value of its type, with the OmitEmptyStructs option.
+		if omitStructs && f.zero != nil && !explicit && f.zero(fp) {
+			continue
+		}
+		var path string
+		if filter != nil {
+			if path = name; opts.x.filterPath != "" {
+				path = opts.x.filterPath + "." + name
+			}
+			if !filter(path, reflect.NewAt(f.typ, fp).Elem()) {
+				continue
+			}
+		}
 		key = f.keyEscHTML
 		if noHTMLEscape {
 			key = f.keyNonEsc
 		}
+		if puny && f.punyKey != nil {
+			key = f.punyKey.keyEscHTML
+			if noHTMLEscape {
+				key = f.punyKey.keyNonEsc
+			}
+		}
 		lastKeyOffset := len(dst)
 		dst = append(dst, nxt)
 		if nxt == '{' {
 			lastKeyOffset++
 		}
 		nxt = ','
-		dst = append(dst, key...)
+		start := len(dst)
+		if pfx != nil {
+			dst = append(dst, '"')
+			dst = appendEscapedBytes(dst, pfx, opts)
+			key = key[1:]
+		}
+		if reEscape {
+			dst = appendKeyEscapes(dst, key, opts)
+		} else {
+			dst = append(dst, key...)
+		}
 
 		var err error
-		if dst, err = f.instr(fp, dst, opts); err != nil {
-			return dst, err
+		if redacted.hasField(name) {
+			dst = redacted.appendReplacement(dst, opts)
+		} else if filter != nil {
+			// The path of the fields nested
+			// in the value of this field.
+			parent := opts.x.filterPath
+			opts.x.filterPath = path
+			dst, err = f.instr(fp, dst, opts)
+			opts.x.filterPath = parent
+		} else {
+			dst, err = f.instr(fp, dst, opts)
+		}
+		if err != nil {
+			return dst, prependErrorPath(err, name)
 		}
-		if f.omitNullMarshaler && len(dst) > 4 && bytes.Compare(dst[len(dst)-4:], []byte("null")) == 0 {
+		if f.omitNullMarshaler && !explicit && len(dst) > 4 && bytes.Compare(dst[len(dst)-4:], []byte("null")) == 0 {
 			dst = dst[:lastKeyOffset]
+			continue
+		}
+		if report != nil {
+			report(name, len(dst)-start)
 		}
 	}
 	if nxt == '{' {
@@ -260,65 +737,131 @@ fieldLoop:
 }
 
 func encodeSlice(
-	p unsafe.Pointer, dst []byte, opts encOpts, ins instruction, es uintptr,
+	p unsafe.Pointer, dst []byte, opts encOpts, t reflect.Type, ins instruction, es uintptr, empty, zero emptyFunc,
 ) ([]byte, error) {
 	shdr := (*sliceHeader)(p)
 	if shdr.Data == nil {
 		if opts.flags.has(nilSliceEmpty) {
 			return append(dst, "[]"...), nil
 		}
-		return append(dst, "null"...), nil
+		return appendNull(dst, opts), nil
 	}
 	if shdr.Len == 0 {
 		return append(dst, "[]"...), nil
 	}
-	return encodeArray(shdr.Data, dst, opts, ins, es, shdr.Len, false)
+	if opts.flags.has(detectCycles) {
+		// The length is part of the key, because
+		// a slice may be re-sliced to a shorter
+		// one with the same underlying array.
+		k := visitKey{typ: t, ptr: shdr.Data, len: shdr.Len}
+		if err := opts.x.visit(k); err != nil {
+			return dst, err
+		}
+		dst, err := encodeArray(shdr.Data, dst, opts, ins, es, shdr.Len, false, empty, zero)
+		opts.x.leave(k)
+
+		return dst, err
+	}
+	return encodeArray(shdr.Data, dst, opts, ins, es, shdr.Len, false, empty, zero)
 }
 
 // encodeByteSlice appends a byte slice to dst as
 // a JSON string. If the options flag rawByteSlice
 // is set, the escaped bytes are appended to the
-// buffer directly, otherwise in base64 form.
+// buffer directly, if the flag hexByteSlice is set,
+// in hexadecimal form, otherwise in base64 form.
 // nolint:unparam
 func encodeByteSlice(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+	bf := byteSliceBase64
+	if opts.flags.has(rawByteSlice) {
+		bf = byteSliceRaw
+	} else if opts.flags.has(hexByteSlice) {
+		bf = byteSliceHex
+	}
+	return encodeByteSliceFmt(p, dst, opts, bf)
+}
+
+// encodeByteSliceFmt appends a byte slice to dst as
+// a JSON string, in the format represented by bf.
+func encodeByteSliceFmt(p unsafe.Pointer, dst []byte, opts encOpts, bf byteSliceFmt) ([]byte, error) {
 	b := *(*[]byte)(p)
 	if b == nil {
-		return append(dst, "null"...), nil
+		return appendNull(dst, opts), nil
 	}
 	dst = append(dst, '"')
 
-	if opts.flags.has(rawByteSlice) {
-		dst = appendEscapedBytes(dst, b, opts)
-	} else {
-		n := base64.StdEncoding.EncodedLen(len(b))
-		if a := cap(dst) - len(dst); a < n {
-			new := make([]byte, cap(dst)+(n-a))
-			copy(new, dst)
-			dst = new[:len(dst)]
+	switch bf {
+	case byteSliceRaw:
+		if opts.flags.has(truncateStrings) {
+			return appendTruncatedString(dst[:len(dst)-1], b, opts), nil
 		}
-		end := len(dst) + n
-		base64.StdEncoding.Encode(dst[len(dst):end], b)
-
-		dst = dst[:end]
+		dst = appendEscapedBytes(dst, b, opts)
+	case byteSliceHex:
+		dst = appendHexBytes(dst, b)
+	default:
+		dst = appendBase64(dst, b, opts.base64Encoding())
 	}
 	return append(dst, '"'), nil
 }
 
+// appendBase64 appends the bytes of b encoded
+// with enc to dst, and grows it only once if its
+// capacity is insufficient.
+func appendBase64(dst, b []byte, enc *base64.Encoding) []byte {
+	n := enc.EncodedLen(len(b))
+	if a := cap(dst) - len(dst); a < n {
+		new := make([]byte, cap(dst)+(n-a))
+		copy(new, dst)
+		dst = new[:len(dst)]
+	}
+	end := len(dst) + n
+	enc.Encode(dst[len(dst):end], b)
+
+	return dst[:end]
+}
+
+// appendHexBytes appends the lowercase
+// hexadecimal encoding of b to dst.
+func appendHexBytes(dst, b []byte) []byte {
+	for _, c := range b {
+		dst = append(dst, hex[c>>4], hex[c&0xF])
+	}
+	return dst
+}
+
+// encodeArray appends the len elements of size es
+// of the array pointed by p to dst, as a JSON array.
+// The empty func reports whether an element is empty,
+// for the OmitEmptyElements option, and the zero func,
+// if non-nil, whether a struct element is a zero value,
+// for the OmitEmptyStructs option.
 func encodeArray(
-	p unsafe.Pointer, dst []byte, opts encOpts, ins instruction, es uintptr, len int, isByteArray bool,
+	p unsafe.Pointer, dst []byte, opts encOpts, ins instruction, es uintptr, len int, isByteArray bool, empty, zero emptyFunc,
 ) ([]byte, error) {
 	if isByteArray && opts.flags.has(byteArrayAsString) {
 		return encodeByteArrayAsString(p, dst, opts, len), nil
 	}
 	var err error
 	nxt := byte('[')
+	omit := opts.flags.has(omitEmptyElements)
+	omitStructs := omit && zero != nil && opts.flags.has(omitEmptyStructs)
+	opts.depth++
+	if opts.depthExceeded() {
+		return dst, ErrMaxDepthExceeded
+	}
+	if err := opts.deadlineExceeded(); err != nil {
+		return dst, err
+	}
 
 	for i := 0; i < len; i++ {
+		v := unsafe.Pointer(uintptr(p) + (uintptr(i) * es))
+		if omit && (empty(v) || omitStructs && zero(v)) {
+			continue
+		}
 		dst = append(dst, nxt)
 		nxt = ','
-		v := unsafe.Pointer(uintptr(p) + (uintptr(i) * es))
 		if dst, err = ins(v, dst, opts); err != nil {
-			return dst, err
+			return dst, prependErrorPath(err, "["+strconv.Itoa(i)+"]")
 		}
 	}
 	if nxt == '[' {
@@ -327,6 +870,83 @@ func encodeArray(
 	return append(dst, ']'), nil
 }
 
+// encodeBitFlags appends the names of the flags of
+// bf that are set in v to dst, as a JSON array.
+func encodeBitFlags(v uint64, dst []byte, opts encOpts, bf bitFlags) []byte {
+	nxt := byte('[')
+	rem := v
+	for _, f := range bf {
+		if v&f.value != f.value {
+			continue
+		}
+		dst = append(dst, nxt, '"')
+		dst = appendEscapedBytes(dst, f.name, opts)
+		dst = append(dst, '"')
+		nxt = ','
+		rem &^= f.value
+	}
+	if opts.flags.has(keepUnknownBitFlags) {
+		// Append the remaining bits,
+		// from the lowest to the highest.
+		for rem != 0 {
+			b := rem & -rem
+			dst = append(dst, nxt)
+			dst = strconv.AppendUint(dst, b, 10)
+			nxt = ','
+			rem &^= b
+		}
+	}
+	if nxt == '[' {
+		return append(dst, "[]"...)
+	}
+	return append(dst, ']')
+}
+
+// encodeEnum appends the name of the value v of an
+// enum type to dst, or its fallback representation if
+// it has none. If unsigned is true, v holds the bits
+// of an unsigned integer.
+func encodeEnum(v int64, unsigned bool, dst []byte, opts encOpts, en *enumNames) ([]byte, error) {
+	if name, ok := en.names[v]; ok {
+		dst = append(dst, '"')
+		dst = appendEscapedBytes(dst, name, opts)
+		return append(dst, '"'), nil
+	}
+	switch en.fallback {
+	case EnumError:
+		return dst, &UnsupportedValueError{
+			Str: "unknown enum value " + string(appendEnumValue(nil, v, unsigned)),
+		}
+	case EnumUnknown:
+		dst = append(dst, `"UNKNOWN(`...)
+		dst = appendEnumValue(dst, v, unsigned)
+		return append(dst, `)"`...), nil
+	default:
+		return appendEnumValue(dst, v, unsigned), nil
+	}
+}
+
+func appendEnumValue(dst []byte, v int64, unsigned bool) []byte {
+	if unsigned {
+		return strconv.AppendUint(dst, uint64(v), 10)
+	}
+	return strconv.AppendInt(dst, v, 10)
+}
+
+// appendUUID appends the canonical representation
+// of the UUID u to dst, as a string of lowercase
+// hexadecimal characters in groups of 8-4-4-4-12.
+func appendUUID(dst []byte, u *[16]byte) []byte {
+	dst = append(dst, '"')
+	for i, c := range u {
+		if i == 4 || i == 6 || i == 8 || i == 10 {
+			dst = append(dst, '-')
+		}
+		dst = append(dst, hex[c>>4], hex[c&0xF])
+	}
+	return append(dst, '"')
+}
+
 // encodeByteArrayAsString appends the escaped
 // bytes of the byte array pointed by p to dst
 // as a JSON string.
@@ -339,6 +959,9 @@ func encodeByteArrayAsString(p unsafe.Pointer, dst []byte, opts encOpts, len int
 		Len:  len,
 		Cap:  len,
 	}))
+	if opts.flags.has(truncateStrings) {
+		return appendTruncatedString(dst, b, opts)
+	}
 	dst = append(dst, '"')
 	dst = appendEscapedBytes(dst, b, opts)
 	dst = append(dst, '"')
@@ -346,6 +969,38 @@ func encodeByteArrayAsString(p unsafe.Pointer, dst []byte, opts encOpts, len int
 	return dst
 }
 
+// appendTruncatedString appends b to dst as a JSON
+// string. If b is longer than the maximum number of
+// runes of the TruncateStrings option, only those
+// are appended, followed by the suffix.
+func appendTruncatedString(dst, b []byte, opts encOpts) []byte {
+	dst = append(dst, '"')
+
+	// A string cannot have more
+	// runes than it has bytes.
+	i, max := 0, opts.x.truncMax
+	if len(b) > max {
+		for n := 0; i < len(b) && n < max; n++ {
+			_, size := utf8.DecodeRune(b[i:])
+			i += size
+		}
+	} else {
+		i = len(b)
+	}
+	dst = appendEscapedBytes(dst, b[:i], opts)
+
+	if i < len(b) {
+		sfx := opts.x.truncSuffix
+		if j := bytes.Index(sfx, truncCountVerb); j >= 0 {
+			dst = appendEscapedBytes(dst, sfx[:j], opts)
+			dst = strconv.AppendInt(dst, int64(len(b)-i), 10)
+			sfx = sfx[j+len(truncCountVerb):]
+		}
+		dst = appendEscapedBytes(dst, sfx, opts)
+	}
+	return append(dst, '"')
+}
+
 func encodeMap(
 	p unsafe.Pointer, dst []byte, opts encOpts, t reflect.Type, ki, vi instruction,
 ) ([]byte, error) {
@@ -354,22 +1009,29 @@ func encodeMap(
 		if opts.flags.has(nilMapEmpty) {
 			return append(dst, "{}"...), nil
 		}
-		return append(dst, "null"...), nil
+		return appendNull(dst, opts), nil
 	}
 	ml := maplen(m)
 	if ml == 0 {
 		return append(dst, "{}"...), nil
 	}
+	if opts.flags.has(detectCycles) {
+		k := visitKey{typ: t, ptr: m}
+		if err := opts.x.visit(k); err != nil {
+			return dst, err
+		}
+		defer opts.x.leave(k)
+	}
 	dst = append(dst, '{')
 
 	rt := unpackEface(t).word
 	it := newHiter(rt, m)
 
 	var err error
-	if opts.flags.has(unsortedMap) {
+	if !opts.sortedMap() {
 		dst, err = encodeUnsortedMap(it, dst, opts, ki, vi)
 	} else {
-		dst, err = encodeSortedMap(it, dst, opts, ki, vi, ml)
+		dst, err = encodeSortedMap(it, dst, opts, t, ki, vi, ml)
 	}
 	hiterPool.Put(it)
 
@@ -386,93 +1048,374 @@ func encodeUnsortedMap(
 	it *hiter, dst []byte, opts encOpts, ki, vi instruction,
 ) ([]byte, error) {
 	var (
-		n   int
-		err error
+		n    int
+		err  error
+		ok   bool
+		keys = opts.allowedMapKeys()
+		sel  = opts.path
+		mask = opts.mapMask()
+		pfx  = opts.mapKeyPrefix()
+		puny = opts.flags.has(punycodeKeys)
 	)
+	opts.depth++
+	if opts.depthExceeded() {
+		return dst, ErrMaxDepthExceeded
+	}
+	if err := opts.deadlineExceeded(); err != nil {
+		return dst, err
+	}
+
 	for ; it.key != nil; mapiternext(it) {
+		off := len(dst)
 		if n != 0 {
 			dst = append(dst, ',')
 		}
 		// Encode entry's key.
+		ko := len(dst)
 		if dst, err = ki(it.key, dst, opts); err != nil {
 			return dst, err
 		}
+		if err = checkMapKey(dst[ko+1:len(dst)-1], opts); err != nil {
+			return dst, err
+		}
+		if opts.path, ok = selectMapKey(dst[ko+1:len(dst)-1], keys, sel); !ok {
+			dst = dst[:off]
+			continue
+		}
+		masked := mask.hasKey(dst[ko+1 : len(dst)-1])
+		if puny {
+			dst = punycodeKey(dst, ko)
+		}
+		if pfx != nil {
+			dst = insertKeyPrefix(dst, ko, pfx, opts)
+		}
+		mk := dst[ko+1 : len(dst)-1]
 		dst = append(dst, ':')
 
 		// Encode entry's value.
-		if dst, err = vi(it.val, dst, opts); err != nil {
-			return dst, err
+		if masked {
+			dst = mask.appendReplacement(dst, opts)
+		} else if dst, err = vi(it.val, dst, opts); err != nil {
+			return dst, prependErrorPath(err, string(mk))
 		}
 		n++
 	}
 	return dst, nil
 }
 
-// encodeUnsortedMap appends the elements of the map
+// encodeSortedMap appends the elements of the map
 // pointed by p as comma-separated k/v pairs to dst,
 // sorted by key in lexicographical order.
 func encodeSortedMap(
-	it *hiter, dst []byte, opts encOpts, ki, vi instruction, ml int,
+	it *hiter, dst []byte, opts encOpts, t reflect.Type, ki, vi instruction, ml int,
+) ([]byte, error) {
+	pfx := opts.mapKeyPrefix()
+	opts.depth++
+	if opts.depthExceeded() {
+		return dst, ErrMaxDepthExceeded
+	}
+	if err := opts.deadlineExceeded(); err != nil {
+		return dst, err
+	}
+	if opts.parallelMap(ml) && runtime.GOMAXPROCS(0) > 1 {
+		return encodeParallelMap(it, dst, opts, t, ki, vi, ml, pfx)
+	}
+	buf := cachedBuffer()
+	mel := cachedMapElems(ml)
+
+	err := appendMapElems(it, buf, mel, opts, t.Elem(), ki, vi, pfx)
+	if err == nil {
+		// Sort map entries by key in
+		// lexicographical order.
+		sort.Sort(mel.byKey(opts, t.Key(), pfx))
+		dst = appendSortedMapElems(dst, mel, opts)
+	}
+	// The map elements must be released before
+	// the buffer, because each k/v pair holds
+	// two sublices that points to the buffer's
+	// backing array.
+	releaseMapElems(mel)
+	bufferPool.Put(buf)
+
+	return dst, err
+}
+
+// maxMapShards is the maximum number of goroutines
+// that encode the elements of a map in parallel.
+const maxMapShards = 8
+
+// encodeParallelMap is the variant of encodeSortedMap
+// used for the maps larger than the threshold set with
+// the ParallelThreshold option. The elements are split
+// in shards, that are encoded and sorted by key in
+// separate goroutines, and merged afterwards.
+func encodeParallelMap(
+	it *hiter, dst []byte, opts encOpts, t reflect.Type, ki, vi instruction, ml int, pfx []byte,
 ) ([]byte, error) {
+	// The iterator isn't safe for concurrent use,
+	// the pointers to the keys and values of the
+	// map are collected beforehand.
+	ents := make([]mapEntry, 0, ml)
+	for ; it.key != nil; mapiternext(it) {
+		ents = append(ents, mapEntry{key: it.key, val: it.val})
+	}
+	n := runtime.GOMAXPROCS(0)
+	if n > maxMapShards {
+		n = maxMapShards
+	}
+	if n > len(ents) {
+		n = len(ents)
+	}
 	var (
-		off int
-		err error
-		buf = cachedBuffer()
-		mel *mapElems
+		wg     sync.WaitGroup
+		shards = make([]mapShard, n)
 	)
-	if v := mapElemsPool.Get(); v != nil {
-		mel = v.(*mapElems)
-	} else {
-		mel = &mapElems{s: make([]kv, 0, ml)}
+	for i := range shards {
+		sh := &shards[i]
+		sh.ents = ents[i*len(ents)/n : (i+1)*len(ents)/n]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sh.encode(opts, t, ki, vi, pfx)
+		}()
 	}
-	for ; it.key != nil; mapiternext(it) {
-		kv := kv{}
+	wg.Wait()
 
-		// Encode the key and store the buffer
-		// portion to use during sort.
-		if buf.B, err = ki(it.key, buf.B, opts); err != nil {
-			break
+	var (
+		err  error
+		size int
+		ends = make([]int, 0, n)
+	)
+	for i := range shards {
+		// The first error in the order of
+		// iteration is that of the serial
+		// encoding.
+		if err == nil {
+			err = shards[i].err
 		}
-		// Omit quotes of keys.
-		kv.key = buf.B[off+1 : len(buf.B)-1]
+		size += len(shards[i].mel.s)
+		ends = append(ends, size)
+	}
+	mel := cachedMapElems(size)
 
-		// Add separator after key.
-		buf.B = append(buf.B, ':')
+	if err == nil {
+		for i := range shards {
+			mel.s = append(mel.s, shards[i].mel.s...)
+		}
+		mel.mergeRuns(ends, mel.byKey(opts, t.Key(), pfx))
+		dst = appendSortedMapElems(dst, mel, opts)
+	}
+	releaseMapElems(mel)
+	for i := range shards {
+		shards[i].release()
+	}
+	return dst, err
+}
 
-		// Encode the value and store the buffer
-		// portion corresponding to the semicolon
-		// delimited key/value pair.
-		if buf.B, err = vi(it.val, buf.B, opts); err != nil {
-			break
+// encodeMergedMaps appends the elements of the n maps
+// of type t pointed by p, which are contiguous like the
+// elements of a slice, as comma-separated k/v pairs to
+// dst, sorted by key. The elements of a map replace
+// those with the same key of the previous maps.
+func encodeMergedMaps(
+	p unsafe.Pointer, n int, dst []byte, opts encOpts, t reflect.Type, ki, vi instruction,
+) ([]byte, error) {
+	pfx := opts.mapKeyPrefix()
+	opts.depth++
+	if opts.depthExceeded() {
+		return dst, ErrMaxDepthExceeded
+	}
+	if err := opts.deadlineExceeded(); err != nil {
+		return dst, err
+	}
+	var (
+		err error
+		buf = cachedBuffer()
+		mel = cachedMapElems(0)
+		rt  = unpackEface(t).word
+	)
+	for i := 0; i < n && err == nil; i++ {
+		m := *(*unsafe.Pointer)(unsafe.Pointer(uintptr(p) + (uintptr(i) * t.Size())))
+		if m == nil || maplen(m) == 0 {
+			continue
 		}
-		kv.keyval = buf.B[off:len(buf.B)]
-		mel.s = append(mel.s, kv)
-		off = len(buf.B)
+		it := newHiter(rt, m)
+		err = appendMapElems(it, buf, mel, opts, t.Elem(), ki, vi, pfx)
+		hiterPool.Put(it)
 	}
 	if err == nil {
-		// Sort map entries by key in
-		// lexicographical order.
-		sort.Sort(mel)
-
-		// Append sorted comma-delimited k/v
-		// pairs to the given buffer.
-		for i, kv := range mel.s {
-			if i != 0 {
-				dst = append(dst, ',')
+		// The stable sort keeps the elements with
+		// the same key in the order of the maps,
+		// and only the last of each is retained.
+		sort.Stable(mel.byKey(opts, t.Key(), pfx))
+		j := 0
+		for i := range mel.s {
+			if i+1 < len(mel.s) && bytes.Equal(mel.s[i].key, mel.s[i+1].key) {
+				continue
 			}
-			dst = append(dst, kv.keyval...)
+			mel.s[j] = mel.s[i]
+			j++
 		}
+		mel.s = mel.s[:j]
+		dst = appendSortedMapElems(dst, mel, opts)
 	}
-	// The map elements must be released before
-	// the buffer, because each k/v pair holds
-	// two sublices that points to the buffer's
-	// backing array.
 	releaseMapElems(mel)
 	bufferPool.Put(buf)
 
 	return dst, err
 }
 
+// appendMapElems encodes the elements of the map
+// iterated by it to buf, with the key prefix pfx,
+// and adds them to mel.
+func appendMapElems(
+	it *hiter, buf *buffer, mel *mapElems, opts encOpts, et reflect.Type, ki, vi instruction, pfx []byte,
+) error {
+	e := newMapElemEncoder(opts, et, ki, vi, pfx)
+
+	for ; it.key != nil; mapiternext(it) {
+		if err := e.encode(it.key, it.val, buf, mel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapElemEncoder encodes the k/v pairs of a map
+// to a buffer, and adds them to map elements.
+type mapElemEncoder struct {
+	opts   encOpts
+	et     reflect.Type
+	ki, vi instruction
+	pfx    []byte
+	keys   stringSet
+	sel    *fieldPath
+	mask   *MapMask
+	puny   bool
+	less   func(a, b interface{}) bool
+}
+
+func newMapElemEncoder(opts encOpts, et reflect.Type, ki, vi instruction, pfx []byte) mapElemEncoder {
+	return mapElemEncoder{
+		opts: opts,
+		et:   et,
+		ki:   ki,
+		vi:   vi,
+		pfx:  pfx,
+		keys: opts.allowedMapKeys(),
+		sel:  opts.path,
+		mask: opts.mapMask(),
+		puny: opts.flags.has(punycodeKeys),
+		less: opts.mapValueLess(),
+	}
+}
+
+// encode encodes the k/v pair pointed by k and v
+// to buf, and adds it to mel, unless its key is
+// not selected.
+func (e *mapElemEncoder) encode(k, v unsafe.Pointer, buf *buffer, mel *mapElems) error {
+	var (
+		off = len(buf.B)
+		err error
+		ok  bool
+		kv  = kv{}
+	)
+	// Encode the key and store the buffer
+	// portion to use during sort.
+	if buf.B, err = e.ki(k, buf.B, e.opts); err != nil {
+		return err
+	}
+	// Omit quotes of keys.
+	kv.key = buf.B[off+1 : len(buf.B)-1]
+
+	if err = checkMapKey(kv.key, e.opts); err != nil {
+		return err
+	}
+	if e.opts.path, ok = selectMapKey(kv.key, e.keys, e.sel); !ok {
+		buf.B = buf.B[:off]
+		return nil
+	}
+	masked := e.mask.hasKey(kv.key)
+	if e.puny {
+		buf.B = punycodeKey(buf.B, off)
+		kv.key = buf.B[off+1 : len(buf.B)-1]
+	}
+	if e.pfx != nil {
+		buf.B = insertKeyPrefix(buf.B, off, e.pfx, e.opts)
+		kv.key = buf.B[off+1 : len(buf.B)-1]
+	}
+	// Add separator after key.
+	buf.B = append(buf.B, ':')
+
+	// Encode the value and store the buffer
+	// portion corresponding to the semicolon
+	// delimited key/value pair.
+	if masked {
+		buf.B = e.mask.appendReplacement(buf.B, e.opts)
+	} else if buf.B, err = e.vi(v, buf.B, e.opts); err != nil {
+		return prependErrorPath(err, string(kv.key))
+	}
+	kv.keyval = buf.B[off:len(buf.B)]
+	if e.less != nil {
+		kv.val = reflect.NewAt(e.et, v).Elem().Interface()
+	}
+	mel.s = append(mel.s, kv)
+
+	return nil
+}
+
+// appendSortedMapElems appends the elements of mel,
+// sorted by key, as comma-separated k/v pairs to dst,
+// after sorting them by value if configured in opts.
+// With the MapPreview option, the elements beyond the
+// maximum are replaced by an overflow marker.
+func appendSortedMapElems(dst []byte, mel *mapElems, opts encOpts) []byte {
+	if less := opts.mapValueLess(); less != nil {
+		mel.sortByValue(less)
+	}
+	elems := mel.s
+	max, preview := opts.mapPreviewMax()
+	if preview && len(elems) > max {
+		elems = elems[:max]
+	}
+	for i, kv := range elems {
+		if i != 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, kv.keyval...)
+	}
+	if len(elems) < len(mel.s) {
+		if len(elems) != 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendPreviewMarker(dst, len(mel.s)-len(elems), opts)
+	}
+	return dst
+}
+
+// previewMarkerKey is the key of the overflow
+// marker of the maps, with the MapPreview option.
+var previewMarkerKey = []byte("…")
+
+// appendPreviewMarker appends to dst the k/v pair
+// that indicates the number n of elements of a map
+// omitted with the MapPreview option.
+func appendPreviewMarker(dst []byte, n int, opts encOpts) []byte {
+	var b [32]byte
+
+	val := append(b[:0], '<')
+	val = strconv.AppendInt(val, int64(n), 10)
+	val = append(val, " more>"...)
+
+	dst = append(dst, '"')
+	dst = appendEscapedBytes(dst, previewMarkerKey, opts)
+	dst = append(dst, `":"`...)
+	dst = appendEscapedBytes(dst, val, opts)
+
+	return append(dst, '"')
+}
+
 // encodeSyncMap appends the elements of a sync.Map pointed
 // to by p to dst and returns the extended buffer.
 // This function replicates the behavior of encoding Go maps,
@@ -490,7 +1433,7 @@ func encodeSyncMap(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
 	// the error is stored and the method used by Range()
 	// returns false to stop the map's iteration.
 	var err error
-	if opts.flags.has(unsortedMap) {
+	if !opts.sortedMap() {
 		dst, err = encodeUnsortedSyncMap(sm, dst, opts)
 	} else {
 		dst, err = encodeSortedSyncMap(sm, dst, opts)
@@ -505,21 +1448,55 @@ func encodeSyncMap(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
 // but operates on a sync.Map type instead of a Go map.
 func encodeUnsortedSyncMap(sm *sync.Map, dst []byte, opts encOpts) ([]byte, error) {
 	var (
-		n   int
-		err error
+		n    int
+		err  error
+		ok   bool
+		keys = opts.allowedMapKeys()
+		sel  = opts.path
+		mask = opts.mapMask()
+		pfx  = opts.mapKeyPrefix()
+		puny = opts.flags.has(punycodeKeys)
 	)
+	opts.depth++
+	if opts.depthExceeded() {
+		return dst, ErrMaxDepthExceeded
+	}
+	if err := opts.deadlineExceeded(); err != nil {
+		return dst, err
+	}
+
 	sm.Range(func(key, value interface{}) bool {
+		off := len(dst)
 		if n != 0 {
 			dst = append(dst, ',')
 		}
 		// Encode the key.
+		ko := len(dst)
 		if dst, err = appendSyncMapKey(dst, key, opts); err != nil {
 			return false
 		}
+		if err = checkMapKey(dst[ko+1:len(dst)-1], opts); err != nil {
+			return false
+		}
+		if opts.path, ok = selectMapKey(dst[ko+1:len(dst)-1], keys, sel); !ok {
+			dst = dst[:off]
+			return true
+		}
+		masked := mask.hasKey(dst[ko+1 : len(dst)-1])
+		if puny {
+			dst = punycodeKey(dst, ko)
+		}
+		if pfx != nil {
+			dst = insertKeyPrefix(dst, ko, pfx, opts)
+		}
+		mk := dst[ko+1 : len(dst)-1]
 		dst = append(dst, ':')
 
 		// Encode the value.
-		if dst, err = appendJSON(dst, value, opts); err != nil {
+		if masked {
+			dst = mask.appendReplacement(dst, opts)
+		} else if dst, err = encodeInterface(unsafe.Pointer(&value), dst, opts); err != nil {
+			err = prependErrorPath(err, string(mk))
 			return false
 		}
 		n++
@@ -532,16 +1509,28 @@ func encodeUnsortedSyncMap(sm *sync.Map, dst []byte, opts encOpts) ([]byte, erro
 // but operates on a sync.Map type instead of a Go map.
 func encodeSortedSyncMap(sm *sync.Map, dst []byte, opts encOpts) ([]byte, error) {
 	var (
-		off int
-		err error
-		buf = cachedBuffer()
-		mel *mapElems
+		off  int
+		err  error
+		buf  = cachedBuffer()
+		mel  *mapElems
+		ok   bool
+		keys = opts.allowedMapKeys()
+		sel  = opts.path
+		mask = opts.mapMask()
+		pfx  = opts.mapKeyPrefix()
+		puny = opts.flags.has(punycodeKeys)
+		less = opts.mapValueLess()
 	)
-	if v := mapElemsPool.Get(); v != nil {
-		mel = v.(*mapElems)
-	} else {
-		mel = &mapElems{s: make([]kv, 0)}
+	opts.depth++
+	if opts.depthExceeded() {
+		return dst, ErrMaxDepthExceeded
+	}
+	if err := opts.deadlineExceeded(); err != nil {
+		return dst, err
 	}
+
+	mel = cachedMapElems(0)
+
 	sm.Range(func(key, value interface{}) bool {
 		kv := kv{}
 
@@ -553,16 +1542,39 @@ func encodeSortedSyncMap(sm *sync.Map, dst []byte, opts encOpts) ([]byte, error)
 		// Omit quotes of keys.
 		kv.key = buf.B[off+1 : len(buf.B)-1]
 
+		if err = checkMapKey(kv.key, opts); err != nil {
+			return false
+		}
+		if opts.path, ok = selectMapKey(kv.key, keys, sel); !ok {
+			buf.B = buf.B[:off]
+			return true
+		}
+		masked := mask.hasKey(kv.key)
+		if puny {
+			buf.B = punycodeKey(buf.B, off)
+			kv.key = buf.B[off+1 : len(buf.B)-1]
+		}
+		if pfx != nil {
+			buf.B = insertKeyPrefix(buf.B, off, pfx, opts)
+			kv.key = buf.B[off+1 : len(buf.B)-1]
+		}
+
 		// Add separator after key.
 		buf.B = append(buf.B, ':')
 
 		// Encode the value and store the buffer
 		// portion corresponding to the semicolon
 		// delimited key/value pair.
-		if buf.B, err = appendJSON(buf.B, value, opts); err != nil {
+		if masked {
+			buf.B = mask.appendReplacement(buf.B, opts)
+		} else if buf.B, err = encodeInterface(unsafe.Pointer(&value), buf.B, opts); err != nil {
+			err = prependErrorPath(err, string(kv.key))
 			return false
 		}
 		kv.keyval = buf.B[off:len(buf.B)]
+		if less != nil {
+			kv.val = value
+		}
 		mel.s = append(mel.s, kv)
 		off = len(buf.B)
 
@@ -571,16 +1583,8 @@ func encodeSortedSyncMap(sm *sync.Map, dst []byte, opts encOpts) ([]byte, error)
 	if err == nil {
 		// Sort map entries by key in
 		// lexicographical order.
-		sort.Sort(mel)
-
-		// Append sorted comma-delimited k/v
-		// pairs to the given buffer.
-		for i, kv := range mel.s {
-			if i != 0 {
-				dst = append(dst, ',')
-			}
-			dst = append(dst, kv.keyval...)
-		}
+		sort.Sort(mel.byKey(opts, nil, nil))
+		dst = appendSortedMapElems(dst, mel, opts)
 	}
 	releaseMapElems(mel)
 	bufferPool.Put(buf)
@@ -588,6 +1592,38 @@ func encodeSortedSyncMap(sm *sync.Map, dst []byte, opts encOpts) ([]byte, error)
 	return dst, err
 }
 
+// insertKeyPrefix inserts the escaped prefix pfx
+// after the opening quote of the map key located
+// at the end of dst, from offset off.
+func insertKeyPrefix(dst []byte, off int, pfx []byte, opts encOpts) []byte {
+	n := len(dst)
+	dst = appendEscapedBytes(dst, pfx, opts)
+
+	// Rotate the key and the prefix appended
+	// after it in place, with three reversals.
+	reverseBytes(dst[off+1 : n])
+	reverseBytes(dst[n:])
+	reverseBytes(dst[off+1:])
+
+	return dst
+}
+
+func reverseBytes(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+// checkMapKey returns an error if the unquoted
+// map key is empty and the RejectEmptyMapKeys
+// option is used.
+func checkMapKey(key []byte, opts encOpts) error {
+	if len(key) == 0 && opts.flags.has(rejectEmptyMapKeys) {
+		return &UnsupportedValueError{Str: "empty map key"}
+	}
+	return nil
+}
+
 func appendSyncMapKey(dst []byte, key interface{}, opts encOpts) ([]byte, error) {
 	if key == nil {
 		return dst, errors.New("unsupported nil key in sync.Map")
@@ -611,7 +1647,7 @@ func appendSyncMapKey(dst []byte, key interface{}, opts encOpts) ([]byte, error)
 	// string by using the encodeString function
 	// directly instead of the generic appendJSON.
 	if isStr {
-		dst, err = encodeString(unpackEface(key).word, dst, opts)
+		dst, err = encodeKeyString(unpackEface(key).word, dst, opts)
 		runtime.KeepAlive(key)
 	} else {
 		if quoted {
@@ -650,12 +1686,12 @@ func encodeMarshaler(
 	if !canAddr {
 		if t.Kind() == reflect.Ptr || t.Kind() == reflect.Interface {
 			if *(*unsafe.Pointer)(p) == nil {
-				return append(dst, "null"...), nil
+				return appendNull(dst, opts), nil
 			}
 		}
 	} else {
 		if p == nil {
-			return append(dst, "null"...), nil
+			return appendNull(dst, opts), nil
 		}
 		t = reflect.PtrTo(t)
 	}
@@ -681,7 +1717,7 @@ func encodeAppendMarshalerCtx(
 ) ([]byte, error) {
 	dst2, err := i.(AppendMarshalerCtx).AppendJSONContext(opts.ctx, dst)
 	if err != nil {
-		return dst, &MarshalerError{t, err, marshalerAppendJSONCtx}
+		return dst, &MarshalerError{Type: t, Err: err, funcName: marshalerAppendJSONCtx}
 	}
 	return dst2, nil
 }
@@ -691,7 +1727,35 @@ func encodeAppendMarshaler(
 ) ([]byte, error) {
 	dst2, err := i.(AppendMarshaler).AppendJSON(dst)
 	if err != nil {
-		return dst, &MarshalerError{t, err, marshalerAppendJSON}
+		return dst, &MarshalerError{Type: t, Err: err, funcName: marshalerAppendJSON}
+	}
+	return dst2, nil
+}
+
+// encodeAppendMarshalerTab is equivalent to calling
+// encodeMarshaler with encodeAppendMarshaler, for the
+// concrete type t whose itab of the AppendMarshaler
+// interface is tab. If canAddr is true, t is the
+// pointer type of the value at p.
+func encodeAppendMarshalerTab(
+	p unsafe.Pointer, dst []byte, opts encOpts, t reflect.Type, canAddr bool, tab unsafe.Pointer,
+) ([]byte, error) {
+	word := p
+	if canAddr {
+		if p == nil {
+			return appendNull(dst, opts), nil
+		}
+	} else if t.Kind() == reflect.Ptr {
+		if word = *(*unsafe.Pointer)(p); word == nil {
+			return appendNull(dst, opts), nil
+		}
+	}
+	var m AppendMarshaler
+	*(*iface)(unsafe.Pointer(&m)) = iface{tab: tab, word: word}
+
+	dst2, err := m.AppendJSON(dst)
+	if err != nil {
+		return dst, &MarshalerError{Type: t, Err: err, funcName: marshalerAppendJSON}
 	}
 	return dst2, nil
 }
@@ -699,7 +1763,7 @@ func encodeAppendMarshaler(
 func encodeJSONMarshaler(i interface{}, dst []byte, opts encOpts, t reflect.Type) ([]byte, error) {
 	b, err := i.(json.Marshaler).MarshalJSON()
 	if err != nil {
-		return dst, &MarshalerError{t, err, marshalerJSON}
+		return dst, &MarshalerError{Type: t, Err: err, funcName: marshalerJSON}
 	}
 	if opts.flags.has(noCompact) {
 		return append(dst, b...), nil
@@ -709,9 +1773,9 @@ func encodeJSONMarshaler(i interface{}, dst []byte, opts encOpts, t reflect.Type
 	// being, we can't use the scanner of the
 	// standard library.
 	if !json.Valid(b) {
-		return dst, &MarshalerError{t, &SyntaxError{
+		return dst, &MarshalerError{Type: t, Err: &SyntaxError{
 			msg: "json: invalid value",
-		}, marshalerJSON}
+		}, funcName: marshalerJSON}
 	}
 	return appendCompactJSON(dst, b, !opts.flags.has(noHTMLEscaping))
 }
@@ -719,7 +1783,7 @@ func encodeJSONMarshaler(i interface{}, dst []byte, opts encOpts, t reflect.Type
 func encodeTextMarshaler(i interface{}, dst []byte, _ encOpts, t reflect.Type) ([]byte, error) {
 	b, err := i.(encoding.TextMarshaler).MarshalText()
 	if err != nil {
-		return dst, &MarshalerError{t, err, marshalerText}
+		return dst, &MarshalerError{Type: t, Err: err, funcName: marshalerText}
 	}
 	dst = append(dst, '"')
 	dst = append(dst, b...)
@@ -728,6 +1792,145 @@ func encodeTextMarshaler(i interface{}, dst []byte, _ encOpts, t reflect.Type) (
 	return dst, nil
 }
 
+// encodeTextMarshalerNumber is similar to encodeTextMarshaler,
+// but appends the text as a JSON number, without quotes.
+func encodeTextMarshalerNumber(i interface{}, dst []byte, opts encOpts, t reflect.Type) ([]byte, error) {
+	b, err := i.(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		return dst, &MarshalerError{Type: t, Err: err, funcName: marshalerText}
+	}
+	if !opts.flags.has(noNumberValidation) && !isValidNumber(string(b)) {
+		return dst, &MarshalerError{Type: t, Err: fmt.Errorf(
+			"json: invalid number literal %q", b,
+		), funcName: marshalerText}
+	}
+	return append(dst, b...), nil
+}
+
+// encodeBinaryMarshaler appends the result of the
+// MarshalBinary method of i to dst, as a base64
+// encoded JSON string.
+func encodeBinaryMarshaler(i interface{}, dst []byte, opts encOpts, t reflect.Type) ([]byte, error) {
+	b, err := i.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return dst, &MarshalerError{Type: t, Err: err, funcName: marshalerBinary}
+	}
+	dst = append(dst, '"')
+	dst = appendBase64(dst, b, opts.base64Encoding())
+
+	return append(dst, '"'), nil
+}
+
+// encodeSQLValuer appends the value returned by the
+// Value method of i to dst, or null if it is nil.
+func encodeSQLValuer(i interface{}, dst []byte, opts encOpts, t reflect.Type) ([]byte, error) {
+	v, err := i.(driver.Valuer).Value()
+	if err != nil {
+		return dst, &MarshalerError{Type: t, Err: err, funcName: marshalerValue}
+	}
+	if v == nil {
+		return appendNull(dst, opts), nil
+	}
+	ins := typeInstr(reflect.TypeOf(v), opts)
+
+	return ins(unpackEface(v).word, dst, opts)
+}
+
+const (
+	// stringReaderChunkSize is the size of the chunks
+	// read from the reader of a StringReader.
+	stringReaderChunkSize = 4096
+
+	// maxConsecutiveEmptyReads is the number of reads
+	// without data nor error after which the reader of
+	// a StringReader is deemed broken, like bufio does.
+	maxConsecutiveEmptyReads = 100
+)
+
+var chunkPool sync.Pool // *[]byte
+
+// encodeStringReader appends the text read from the
+// reader returned by the JSONStringReader method of
+// i to dst as a JSON string, or null if it is nil.
+// The reader is read until io.EOF, and is never
+// closed, even if it implements io.Closer.
+func encodeStringReader(i interface{}, dst []byte, opts encOpts, t reflect.Type) ([]byte, error) {
+	r := i.(StringReader).JSONStringReader()
+	if r == nil {
+		return appendNull(dst, opts), nil
+	}
+	dst = append(dst, '"')
+
+	bp, _ := chunkPool.Get().(*[]byte)
+	if bp == nil {
+		b := make([]byte, utf8.UTFMax+stringReaderChunkSize)
+		bp = &b
+	}
+	defer chunkPool.Put(bp)
+
+	var (
+		buf   = *bp
+		rem   int // bytes of an incomplete rune
+		empty int // consecutive empty reads
+	)
+	for {
+		n, err := r.Read(buf[rem:])
+		if n == 0 && err == nil {
+			if empty++; empty >= maxConsecutiveEmptyReads {
+				err = io.ErrNoProgress
+			}
+		} else {
+			empty = 0
+		}
+		n += rem
+		// Keep the bytes of a rune split between two
+		// chunks for the next one, so that it isn't
+		// escaped as invalid UTF-8.
+		rem = incompleteRuneLen(buf[:n])
+		if err != nil && err != io.EOF {
+			return dst, &MarshalerError{Type: t, Err: err, funcName: marshalerStringReader}
+		}
+		if err == io.EOF {
+			rem = 0
+		}
+		dst = appendEscapedBytes(dst, buf[:n-rem], opts)
+		copy(buf, buf[n-rem:n])
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return append(dst, '"'), nil
+}
+
+// incompleteRuneLen returns the length of the
+// incomplete UTF-8 encoded rune at the end of b.
+func incompleteRuneLen(b []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if c < utf8.RuneSelf {
+			return 0
+		}
+		if utf8.RuneStart(c) {
+			if utf8.FullRune(b[len(b)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+func encodeErrorString(i interface{}, dst []byte, opts encOpts, _ reflect.Type) ([]byte, error) {
+	s := i.(error).Error()
+
+	dst = append(dst, '"')
+	dst = appendEscapedBytes(dst, sp2b(unsafe.Pointer(&s)), opts)
+	dst = append(dst, '"')
+
+	return dst, nil
+}
+
 // appendCompactJSON appends to dst the JSON-encoded src
 // with insignificant space characters elided. If escHTML
 // is true, HTML-characters are also escaped.
@@ -801,6 +2004,45 @@ func appendCompactJSON(dst, src []byte, escHTML bool) ([]byte, error) {
 	return dst, nil
 }
 
+// appendEscapedRune appends the \uXXXX escape sequence
+// of r to dst, or a surrogate pair of sequences if r is
+// beyond the Basic Multilingual Plane.
+func appendEscapedRune(dst []byte, r rune) []byte {
+	if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+		dst = appendEscapedRune(dst, r1)
+		return appendEscapedRune(dst, r2)
+	}
+	return append(dst, '\\', 'u',
+		hex[r>>12&0xF], hex[r>>8&0xF], hex[r>>4&0xF], hex[r&0xF],
+	)
+}
+
+// appendKeyEscapes appends the precomputed JSON key
+// b to dst, with the additional escapes configured by
+// the EscapeAllNonASCII and EscapeForwardSlash options.
+func appendKeyEscapes(dst []byte, b []byte, opts encOpts) []byte {
+	ascii := opts.flags.has(escapeNonASCII)
+	slash := opts.flags.has(escapeSlash)
+
+	for i := 0; i < len(b); {
+		c := b[i]
+		if c == '/' && slash {
+			dst = append(dst, '\\', '/')
+			i++
+			continue
+		}
+		if c < utf8.RuneSelf || !ascii {
+			dst = append(dst, c)
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(b[i:])
+		dst = appendEscapedRune(dst, r)
+		i += size
+	}
+	return dst
+}
+
 func appendEscapedBytes(dst []byte, b []byte, opts encOpts) []byte {
 	if opts.flags.has(noStringEscaping) {
 		return append(dst, b...)
@@ -810,14 +2052,29 @@ func appendEscapedBytes(dst []byte, b []byte, opts encOpts) []byte {
 		at = 0
 	)
 	noCoerce := opts.flags.has(noUTF8Coercion)
-	noEscape := opts.flags.has(noHTMLEscaping)
+	ascii := opts.flags.has(escapeNonASCII)
+
+	// The set is selected once, so that the
+	// escaping flags aren't tested for each
+	// character of the string.
+	var set int
+	if opts.flags.has(noHTMLEscaping) {
+		set |= safeNoHTML
+	}
+	if ascii {
+		set |= safeNoDEL
+	}
+	if opts.flags.has(escapeSlash) {
+		set |= safeNoSlash
+	}
+	safe := &safeSets[set]
 
 	for i < len(b) {
 		if c := b[i]; c < utf8.RuneSelf {
 			// Check whether c can be used in a JSON string
 			// without escaping, or it is a problematic HTML
 			// character.
-			if c >= ' ' && c != '\\' && c != '"' && (noEscape || (c != '<' && c != '>' && c != '&')) {
+			if safe[c] {
 				// If the current character doesn't need
 				// to be escaped, accumulate the bytes to
 				// save some operations.
@@ -834,7 +2091,7 @@ func appendEscapedBytes(dst []byte, b []byte, opts encOpts) []byte {
 			// \b and \f were ignored on purpose, see
 			// https://codereview.appspot.com/4678046.
 			switch c {
-			case '"', '\\':
+			case '"', '\\', '/':
 				dst = append(dst, '\\', c)
 			case '\n': // 0xA, line feed
 				dst = append(dst, '\\', 'n')
@@ -853,6 +2110,17 @@ func appendEscapedBytes(dst []byte, b []byte, opts encOpts) []byte {
 		}
 		r, size := utf8.DecodeRune(b[i:])
 
+		if ascii {
+			// The invalid bytes are always replaced,
+			// because they are not ASCII characters.
+			if at < i {
+				dst = append(dst, b[at:i]...)
+			}
+			dst = appendEscapedRune(dst, r)
+			i += size
+			at = i
+			continue
+		}
 		if !noCoerce {
 			// Coerce to valid UTF-8, by replacing invalid
 			// bytes with the Unicode replacement rune.
@@ -252,6 +252,7 @@ func ExampleDurationFormat() {
 		jettison.DurationMilliseconds,
 		jettison.DurationMicroseconds,
 		jettison.DurationNanoseconds,
+		jettison.DurationISO8601,
 	} {
 		b, err := jettison.MarshalOpts(d, jettison.DurationFormat(format))
 		if err != nil {
@@ -266,6 +267,7 @@ func ExampleDurationFormat() {
 	// 3782066
 	// 3782066000
 	// 3782066000000
+	// "PT1H3M2.066S"
 }
 
 func ExampleUnsortedMap() {
@@ -1,16 +1,23 @@
 package jettison
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 var (
 	instrCachePtr    unsafe.Pointer // *instrCache
-	structInstrCache sync.Map       // map[string]instruction
+	structInstrCache sync.Map       // map[structInstrKey]instruction
+	namedInstrCache  sync.Map       // map[namedInstrKey]instruction
 )
 
 // An instruction appends the JSON representation
@@ -42,7 +49,7 @@ func cachedInstr(t reflect.Type) instruction {
 	// At this point, we only need to know if the value is
 	// a pointer, the others instructions will handle that
 	// themselves for their type, or pass-by the value.
-	instr := newInstruction(t, canAddr, false)
+	instr := newInstruction(t, canAddr, false, defaultNaming)
 	if isInlined(t) {
 		instr = wrapInlineInstr(instr)
 	}
@@ -51,6 +58,41 @@ func cachedInstr(t reflect.Type) instruction {
 	return instr
 }
 
+type namedInstrKey struct {
+	typ    unsafe.Pointer
+	naming fieldNaming
+}
+
+// cachedNamedInstr is similar to cachedInstr, but
+// returns an instruction built for the given naming
+// of the struct fields.
+func cachedNamedInstr(t reflect.Type, naming fieldNaming) instruction {
+	id := namedInstrKey{typeID(t), naming}
+
+	if instr, ok := namedInstrCache.Load(id); ok {
+		return instr.(instruction)
+	}
+	instr := newInstruction(t, t.Kind() == reflect.Ptr, false, naming)
+	if isInlined(t) {
+		instr = wrapInlineInstr(instr)
+	}
+	namedInstrCache.Store(id, instr)
+
+	return instr
+}
+
+// typeInstr returns the instruction to encode the
+// values of type t with the naming of the struct
+// fields of opts, whose default is the fast path.
+func typeInstr(t reflect.Type, opts encOpts) instruction {
+	if opts.x != nil {
+		if naming := opts.fieldNaming(); naming != defaultNaming {
+			return cachedNamedInstr(t, naming)
+		}
+	}
+	return cachedInstr(t)
+}
+
 func loadCache() instrCache {
 	p := atomic.LoadPointer(&instrCachePtr)
 	return *(*instrCache)(unsafe.Pointer(&p))
@@ -81,45 +123,105 @@ func storeInstr(key unsafe.Pointer, instr instruction, cache instrCache) {
 // newInstruction returns an instruction to encode t.
 // canAddr and quoted respectively indicates if the
 // value to encode is addressable and must be enclosed
-// with double-quote character in the output.
-func newInstruction(t reflect.Type, canAddr, quoted bool) instruction {
+// with double-quote character in the output. The
+// fields of the structs are named according to naming.
+func newInstruction(t reflect.Type, canAddr, quoted bool, naming fieldNaming) instruction {
+	// The encoders registered by the user
+	// have precedence over anything else.
+	if fn := registeredTypeEncoder(t); fn != nil {
+		return newTypeEncoderInstr(t, fn)
+	}
+	if t.Kind() == reflect.Ptr && registeredTypeEncoder(t.Elem()) != nil {
+		// The methods of a pointer type are ignored
+		// in favor of the encoder of its element.
+		return newPtrInstr(t, quoted, naming)
+	}
+	return newTypeInstr(t, canAddr, quoted, naming)
+}
+
+// newTypeInstr is similar to newInstruction, but
+// ignores the encoders registered for t.
+func newTypeInstr(t reflect.Type, canAddr, quoted bool, naming fieldNaming) instruction {
 	// Go types must be checked first, because a Duration
 	// is an int64, json.Number is a string, and both would
 	// be interpreted as a basic type. Also, the time.Time
 	// type implements the TextMarshaler interface, but we
 	// want to use a special instruction instead.
-	if ins := newGoTypeInstr(t); ins != nil {
+	if ins := newGoTypeInstr(t, canAddr); ins != nil {
+		return ins
+	}
+	if ins := newRegisteredTypeInstr(t); ins != nil {
 		return ins
 	}
 	if ins := newMarshalerTypeInstr(t, canAddr); ins != nil {
 		return ins
 	}
+	ins := newKindInstr(t, canAddr, quoted, naming)
+
+	return newOptMarshalerTypeInstr(t, canAddr, ins)
+}
+
+// newKindInstr returns an instruction to encode t
+// based on its kind only.
+func newKindInstr(t reflect.Type, canAddr, quoted bool, naming fieldNaming) instruction {
 	if ins := newBasicTypeInstr(t, quoted); ins != nil {
 		return ins
 	}
 	switch t.Kind() {
 	case reflect.Interface:
-		return encodeInterface
+		if t.NumMethod() == 0 {
+			return encodeInterface
+		}
+		return encodeMethodInterface
 	case reflect.Struct:
-		return newStructInstr(t, canAddr)
+		return cachedStructInstr(t, canAddr, naming)
 	case reflect.Map:
-		return newMapInstr(t)
+		return newMapInstr(t, naming)
 	case reflect.Slice:
-		return newSliceInstr(t)
+		return newSliceInstr(t, naming)
 	case reflect.Array:
-		return newArrayInstr(t, canAddr)
+		return newArrayInstr(t, canAddr, naming)
 	case reflect.Ptr:
-		return newPtrInstr(t, quoted)
+		return newPtrInstr(t, quoted, naming)
+	case reflect.Func:
+		if ok, withErr := isFuncValue(t); ok {
+			return newFuncValueInstr(t, withErr)
+		}
+	case reflect.Complex64, reflect.Complex128:
+		return newComplexInstr(t)
 	}
 	return newUnsupportedTypeInstr(t)
 }
 
-func newGoTypeInstr(t reflect.Type) instruction {
+func newGoTypeInstr(t reflect.Type, canAddr bool) instruction {
 	switch t {
+	case bigIntPtrType:
+		return encodeBigIntPtr
+	case bigIntType:
+		// The MarshalJSON method of big.Int has
+		// a pointer receiver, and is not used if
+		// the value isn't addressable.
+		if canAddr {
+			return encodeBigInt
+		}
+		return nil
+	case bigRatPtrType:
+		return encodeBigRatPtr
+	case bigRatType:
+		// Same as big.Int, for the MarshalText
+		// method used by the standard library.
+		if canAddr {
+			return encodeBigRat
+		}
+		return nil
 	case syncMapType:
 		return encodeSyncMap
 	case timeTimeType:
 		return encodeTime
+	case timeTimePtrType:
+		// The MarshalJSON method of the pointer
+		// type would ignore the time options.
+		return newPtrInstr(t, false, defaultNaming)
 	case timeDurationType:
 		return encodeDuration
 	case jsonNumberType:
@@ -131,6 +233,31 @@ func newGoTypeInstr(t reflect.Type) instruction {
 	}
 }
 
+// newRegisteredTypeInstr returns an instruction to
+// encode a type registered with BitFlagStrings or
+// EnumStrings.
+func newRegisteredTypeInstr(t reflect.Type) instruction {
+	size := t.Size()
+	if bf := registeredBitFlags(t); bf != nil {
+		return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+			return encodeBitFlags(loadUint64(p, size), dst, opts, *bf), nil
+		}
+	}
+	if en := registeredEnum(t); en != nil {
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+				return encodeEnum(loadInt64(p, size), false, dst, opts, en)
+			}
+		default:
+			return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+				return encodeEnum(int64(loadUint64(p, size)), true, dst, opts, en)
+			}
+		}
+	}
+	return nil
+}
+
 // newMarshalerTypeInstr returns an instruction to handle
 // a type that implement one of the Marshaler, MarshalerCtx,
 // json.Marshal, encoding.TextMarshaler interfaces.
@@ -160,6 +287,47 @@ func newMarshalerTypeInstr(t reflect.Type, canAddr bool) instruction {
 	}
 }
 
+// newOptMarshalerTypeInstr returns an instruction to
+// handle a type that implement an interface whose use
+// is enabled by an option at runtime, such as error.
+// When the option is disabled, the instruction ins is
+// used instead.
+func newOptMarshalerTypeInstr(t reflect.Type, canAddr bool, ins instruction) instruction {
+	isPtr := t.Kind() == reflect.Ptr
+	ptrTo := reflect.PtrTo(t)
+
+	// The instruction of the dynamic type
+	// of an interface handles the option.
+	if t.Kind() != reflect.Interface {
+		switch {
+		case t.Implements(binaryMarshalerType):
+			ins = newBinaryMarshalerInstr(t, false, ins)
+		case !isPtr && canAddr && ptrTo.Implements(binaryMarshalerType):
+			ins = newBinaryMarshalerInstr(t, true, ins)
+		}
+		switch {
+		case t.Implements(sqlValuerType):
+			ins = newSQLValuerInstr(t, false, ins)
+		case !isPtr && canAddr && ptrTo.Implements(sqlValuerType):
+			ins = newSQLValuerInstr(t, true, ins)
+		}
+		switch {
+		case t.Implements(stringReaderType):
+			ins = newStringReaderInstr(t, false, ins)
+		case !isPtr && canAddr && ptrTo.Implements(stringReaderType):
+			ins = newStringReaderInstr(t, true, ins)
+		}
+	}
+	switch {
+	case t.Implements(errorType):
+		return newErrorInstr(t, false, ins)
+	case !isPtr && canAddr && ptrTo.Implements(errorType):
+		return newErrorInstr(t, true, ins)
+	default:
+		return ins
+	}
+}
+
 func newBasicTypeInstr(t reflect.Type, quoted bool) instruction {
 	var ins instruction
 
@@ -167,6 +335,9 @@ func newBasicTypeInstr(t reflect.Type, quoted bool) instruction {
 	case reflect.Bool:
 		ins = encodeBool
 	case reflect.String:
+		if isTemplateType(t) {
+			return newTemplateStringInstr(quoted)
+		}
 		return newStringInstr(quoted)
 	case reflect.Int:
 		ins = encodeInt
@@ -210,17 +381,88 @@ func newStringInstr(quoted bool) instruction {
 	return encodeString
 }
 
+// newTemplateStringInstr returns an instruction to
+// encode a string type of the html/template package,
+// whose content is not HTML-escaped if the values of
+// such types are trusted.
+func newTemplateStringInstr(quoted bool) instruction {
+	ins := newStringInstr(quoted)
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		if opts.flags.has(trustTemplateTypes) {
+			opts.flags.set(noHTMLEscaping)
+		}
+		return ins(p, dst, opts)
+	}
+}
+
 func newUnsupportedTypeInstr(t reflect.Type) instruction {
 	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
 		return dst, &UnsupportedTypeError{t}
 	}
 }
 
-func newPtrInstr(t reflect.Type, quoted bool) instruction {
+// newInvalidTagInstr returns an instruction that
+// fails with err, for the struct types that have
+// a field with an invalid tag option.
+func newInvalidTagInstr(err error) instruction {
+	return func(_ unsafe.Pointer, dst []byte, _ encOpts) ([]byte, error) {
+		return dst, err
+	}
+}
+
+// newFuncValueInstr returns an instruction to encode
+// the value returned by a function of type t, which
+// is unsupported unless the ResolveFuncValues option
+// is set.
+func newFuncValueInstr(t reflect.Type, withErr bool) instruction {
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		if !opts.flags.has(resolveFuncValues) {
+			return dst, &UnsupportedTypeError{t}
+		}
+		return encodeFuncValue(p, dst, opts, t, withErr)
+	}
+}
+
+// newComplexInstr returns an instruction to encode
+// the complex numbers of type t as objects, which
+// are unsupported unless the ComplexAsObject option
+// is set. Each part is encoded as a float.
+func newComplexInstr(t reflect.Type) instruction {
+	fi, size := encodeFloat64, uintptr(8)
+	if t.Kind() == reflect.Complex64 {
+		fi, size = encodeFloat32, 4
+	}
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		if !opts.flags.has(complexAsObject) {
+			return dst, &UnsupportedTypeError{t}
+		}
+		var err error
+		dst = append(dst, `{"real":`...)
+		if dst, err = fi(p, dst, opts); err != nil {
+			return dst, err
+		}
+		dst = append(dst, `,"imag":`...)
+		if dst, err = fi(unsafe.Pointer(uintptr(p)+size), dst, opts); err != nil {
+			return dst, err
+		}
+		return append(dst, '}'), nil
+	}
+}
+
+func newPtrInstr(t reflect.Type, quoted bool, naming fieldNaming) instruction {
 	e := t.Elem()
-	i := newInstruction(e, true, quoted)
+	i := newInstruction(e, true, quoted, naming)
+
+	// The nil pointers to the structs encoded as
+	// objects have no zero-value, and are encoded
+	// as null with the ExplicitDefaults option.
+	var z unsafe.Pointer
+	if e.Kind() != reflect.Struct || registeredTypeEncoder(e) != nil || newGoTypeInstr(e, true) != nil {
+		z = unsafe.Pointer(reflect.New(e).Pointer())
+	}
+
 	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
-		return encodePointer(p, dst, opts, i)
+		return encodePointer(p, dst, opts, t, i, z)
 	}
 }
 
@@ -231,8 +473,36 @@ func newAppendMarshalerCtxInstr(t reflect.Type, hasPtr bool) instruction {
 }
 
 func newAppendMarshalerInstr(t reflect.Type, hasPtr bool) instruction {
+	if t.Kind() == reflect.Interface {
+		return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+			return encodeMarshaler(p, dst, opts, t, hasPtr, encodeAppendMarshaler)
+		}
+	}
+	// The concrete type is known, so the itab of
+	// the interface is resolved once, instead of
+	// asserting the interface for each value, such
+	// as the elements of a slice.
+	mt := t
+	if hasPtr {
+		mt = reflect.PtrTo(t)
+	}
+	tab := appendMarshalerTab(mt)
+
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		return encodeAppendMarshalerTab(p, dst, opts, mt, hasPtr, tab)
+	}
+}
+
+func newTypeEncoderInstr(t reflect.Type, fn TypeEncoderFunc) instruction {
+	enc := func(i interface{}, dst []byte, _ encOpts, t reflect.Type) ([]byte, error) {
+		dst2, err := fn(i, dst)
+		if err != nil {
+			return dst, &MarshalerError{Type: t, Err: err, funcName: typeEncoderCall}
+		}
+		return dst2, nil
+	}
 	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
-		return encodeMarshaler(p, dst, opts, t, hasPtr, encodeAppendMarshaler)
+		return encodeMarshaler(p, dst, opts, t, false, enc)
 	}
 }
 
@@ -243,13 +513,73 @@ func newJSONMarshalerInstr(t reflect.Type, hasPtr bool) instruction {
 }
 
 func newTextMarshalerInstr(t reflect.Type, hasPtr bool) instruction {
+	fn := encodeTextMarshaler
+	if isNumberTextMarshaler(t) {
+		fn = encodeTextMarshalerNumber
+	}
 	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
-		return encodeMarshaler(p, dst, opts, t, hasPtr, encodeTextMarshaler)
+		return encodeMarshaler(p, dst, opts, t, hasPtr, fn)
 	}
 }
 
-func newStructInstr(t reflect.Type, canAddr bool) instruction {
-	id := fmt.Sprintf("%p-%t", typeID(t), canAddr)
+func newErrorInstr(t reflect.Type, hasPtr bool, ins instruction) instruction {
+	if t.Kind() == reflect.Interface {
+		// The instruction of the dynamic type of the
+		// interface handles the ErrorAsString option,
+		// and gives precedence to the marshalers.
+		return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+			if opts.flags.has(nilErrorEmptyObject) && *(*unsafe.Pointer)(p) == nil {
+				return append(dst, "{}"...), nil
+			}
+			return ins(p, dst, opts)
+		}
+	}
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		if !opts.flags.has(errorAsString) {
+			return ins(p, dst, opts)
+		}
+		return encodeMarshaler(p, dst, opts, t, hasPtr, encodeErrorString)
+	}
+}
+
+func newBinaryMarshalerInstr(t reflect.Type, hasPtr bool, ins instruction) instruction {
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		if !opts.flags.has(binaryMarshalerBase64) {
+			return ins(p, dst, opts)
+		}
+		return encodeMarshaler(p, dst, opts, t, hasPtr, encodeBinaryMarshaler)
+	}
+}
+
+func newSQLValuerInstr(t reflect.Type, hasPtr bool, ins instruction) instruction {
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		if !opts.flags.has(sqlValuer) {
+			return ins(p, dst, opts)
+		}
+		return encodeMarshaler(p, dst, opts, t, hasPtr, encodeSQLValuer)
+	}
+}
+
+func newStringReaderInstr(t reflect.Type, hasPtr bool, ins instruction) instruction {
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		if !opts.flags.has(streamStringReaders) {
+			return ins(p, dst, opts)
+		}
+		return encodeMarshaler(p, dst, opts, t, hasPtr, encodeStringReader)
+	}
+}
+
+type structInstrKey struct {
+	typ     unsafe.Pointer
+	canAddr bool
+	naming  fieldNaming
+}
+
+// cachedStructInstr returns an instruction to encode
+// the struct type t, whose fields are defined by the
+// given naming, from a cache, or create one on the fly.
+func cachedStructInstr(t reflect.Type, canAddr bool, naming fieldNaming) instruction {
+	id := structInstrKey{typeID(t), canAddr, naming}
 
 	if instr, ok := structInstrCache.Load(id); ok {
 		return instr.(instruction)
@@ -276,14 +606,14 @@ func newStructInstr(t reflect.Type, canAddr bool) instruction {
 	}
 	// Generate the real instruction and replace
 	// the indirect func with it.
-	ins = newStructFieldsInstr(t, canAddr)
+	ins = newStructFieldsInstr(t, canAddr, naming)
 	wg.Done()
 	structInstrCache.Store(id, ins)
 
 	return ins
 }
 
-func newStructFieldsInstr(t reflect.Type, canAddr bool) instruction {
+func newStructFieldsInstr(t reflect.Type, canAddr bool, naming fieldNaming) instruction {
 	if t.NumField() == 0 {
 		// Fast path for empty struct.
 		return func(_ unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
@@ -291,7 +621,7 @@ func newStructFieldsInstr(t reflect.Type, canAddr bool) instruction {
 		}
 	}
 	var (
-		flds = cachedFields(t)
+		flds = cachedFields(t, naming.tagKey, naming.namer)
 		dupl = append(flds[:0:0], flds...) // clone
 	)
 	for i := range dupl {
@@ -313,95 +643,311 @@ func newStructFieldsInstr(t reflect.Type, canAddr bool) instruction {
 		// Generate instruction and empty func of the field.
 		// Only strings, floats, integers, and booleans
 		// types can be quoted.
-		f.instr = newInstruction(ftyp, canAddr, f.quoted && isBasicType(etyp))
+		f.instr = newInstruction(ftyp, canAddr, f.quoted && isBasicType(etyp), naming)
+		if f.byteFmt != byteSliceDefault && isByteSlice(ftyp) && newMarshalerTypeInstr(ftyp, canAddr) == nil {
+			f.instr = newByteSliceFmtInstr(f.byteFmt)
+		}
+		if f.floatFmt != floatSpecialDefault && isFloatingPoint(etyp) && newMarshalerTypeInstr(ftyp, canAddr) == nil {
+			f.instr = newFloatSpecialInstr(ftyp, f.floatFmt, f.instr)
+		}
+		if f.timeLayout != nil && etyp == timeTimeType {
+			if *f.timeLayout == "" {
+				return newInvalidTagInstr(fmt.Errorf("json: empty time layout in tag of field %s of type %s", f.name, t))
+			}
+			f.instr = newTimeLayoutInstr(ftyp, *f.timeLayout)
+		}
+		if f.cleanNumber && isString(etyp) && newMarshalerTypeInstr(ftyp, canAddr) == nil {
+			f.instr = newCleanNumberInstr(ftyp)
+		}
+		if f.indent {
+			f.instr = newIndentInstr(f.instr)
+		}
+		if f.since < 0 || f.until < 0 {
+			return newInvalidTagInstr(fmt.Errorf("json: invalid API version in tag of field %s of type %s", f.name, t))
+		}
 		if f.omitEmpty {
 			f.empty = cachedEmptyFuncOf(ftyp)
+			if ftyp.Kind() == reflect.Struct && registeredEmptyPredicate(ftyp) == nil {
+				f.zero = cachedZeroFuncOf(ftyp)
+			}
 		}
 	}
+	// Fields sorted by key, for use with the
+	// SortStructFields option, with and without
+	// the PunycodeKeys option.
+	sorted := sortFieldsByKey(dupl, false)
+	punySorted := sorted
+	for i := range dupl {
+		if dupl[i].punyKey != nil {
+			punySorted = sortFieldsByKey(dupl, true)
+			break
+		}
+	}
+	// Fields sorted for the Canonical option,
+	// by the UTF-16 code units of their names.
+	canonical := append(dupl[:0:0], dupl...)
+	sort.SliceStable(canonical, func(i, j int) bool {
+		return compareUTF16([]byte(canonical[i].name), []byte(canonical[j].name)) < 0
+	})
 	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		if opts.flags.has(canonicalJSON) {
+			return encodeStruct(p, dst, opts, canonical)
+		}
+		if opts.flags.has(sortStructFields) {
+			if opts.flags.has(punycodeKeys) {
+				return encodeStruct(p, dst, opts, punySorted)
+			}
+			return encodeStruct(p, dst, opts, sorted)
+		}
 		return encodeStruct(p, dst, opts, dupl)
 	}
 }
 
-func newArrayInstr(t reflect.Type, canAddr bool) instruction {
+// sortFieldsByKey returns a copy of flds sorted by the
+// names of their keys, which are the IDNA form of the
+// names if puny is true.
+func sortFieldsByKey(flds []field, puny bool) []field {
+	name := func(f *field) string {
+		if puny && f.punyKey != nil {
+			return f.punyKey.name
+		}
+		return f.name
+	}
+	sorted := append(flds[:0:0], flds...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return name(&sorted[i]) < name(&sorted[j])
+	})
+	return sorted
+}
+
+func newArrayInstr(t reflect.Type, canAddr bool, naming fieldNaming) instruction {
 	var (
 		etyp = t.Elem()
 		size = etyp.Size()
-		isba = false
 	)
 	// Array elements are addressable if the
 	// array itself is addressable.
-	ins := newInstruction(etyp, canAddr, false)
+	ins := newInstruction(etyp, canAddr, false, naming)
 
 	// Byte arrays does not encode as a string
 	// by default, this behavior is defined by
 	// the encoder's options during marshaling.
-	if etyp.Kind() == reflect.Uint8 {
-		pe := reflect.PtrTo(etyp)
-		if !pe.Implements(jsonMarshalerType) && !pe.Implements(textMarshalerType) {
-			isba = true
-		}
-	}
+	isba := isByteElem(etyp)
+
+	// Named arrays of 16 bytes are assumed to
+	// represent UUIDs, see UUIDArraysAsString.
+	isUUID := isba && t.Len() == 16 && t.Name() != ""
+	empty, zero := elemEmptyFuncs(etyp)
+
 	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
-		return encodeArray(p, dst, opts, ins, size, t.Len(), isba)
+		if isUUID && opts.flags.has(uuidArrayAsString) {
+			return appendUUID(dst, (*[16]byte)(p)), nil
+		}
+		return encodeArray(p, dst, opts, ins, size, t.Len(), isba, empty, zero)
 	}
 }
 
-func newSliceInstr(t reflect.Type) instruction {
+func newSliceInstr(t reflect.Type, naming fieldNaming) instruction {
 	etyp := t.Elem()
 
-	if etyp.Kind() == reflect.Uint8 {
-		pe := reflect.PtrTo(etyp)
-		if !pe.Implements(jsonMarshalerType) && !pe.Implements(textMarshalerType) {
-			return encodeByteSlice
-		}
+	if isByteSlice(t) {
+		return encodeByteSlice
 	}
 	// Slice elements are always addressable.
 	// see https://golang.org/pkg/reflect/#Value.CanAddr
 	// for reference.
 	var (
-		ins  = newInstruction(etyp, true, false)
-		size = etyp.Size()
+		ins         = newInstruction(etyp, true, false, naming)
+		size        = etyp.Size()
+		empty, zero = elemEmptyFuncs(etyp)
 	)
 	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
-		return encodeSlice(p, dst, opts, ins, size)
+		return encodeSlice(p, dst, opts, t, ins, size, empty, zero)
 	}
 }
 
-func newMapInstr(t reflect.Type) instruction {
-	var (
-		ki instruction
-		vi instruction
-	)
-	kt := t.Key()
-	et := t.Elem()
+// elemEmptyFuncs returns the functions that report
+// whether an element of type t is empty, and if t is
+// a struct type without a registered predicate, the
+// zero value of its type, like for the struct fields
+// with the omitempty option.
+func elemEmptyFuncs(t reflect.Type) (empty, zero emptyFunc) {
+	empty = cachedEmptyFuncOf(t)
+	if t.Kind() == reflect.Struct && registeredEmptyPredicate(t) == nil {
+		zero = cachedZeroFuncOf(t)
+	}
+	return empty, zero
+}
 
-	if !isString(kt) && !isInteger(kt) && !kt.Implements(textMarshalerType) {
+func newByteSliceFmtInstr(bf byteSliceFmt) instruction {
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		return encodeByteSliceFmt(p, dst, opts, bf)
+	}
+}
+
+// newFloatSpecialInstr returns an instruction that
+// encodes the NaN and infinite values of the float,
+// or pointer to float type t, using the format ff,
+// and the instruction ins otherwise.
+func newFloatSpecialInstr(t reflect.Type, ff floatSpecialFmt, ins instruction) instruction {
+	isPtr := t.Kind() == reflect.Ptr
+	if isPtr {
+		t = t.Elem()
+	}
+	is32 := t.Kind() == reflect.Float32
+
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		fp := p
+		if isPtr {
+			if fp = *(*unsafe.Pointer)(p); fp == nil {
+				return ins(p, dst, opts)
+			}
+		}
+		var f float64
+		if is32 {
+			f = float64(*(*float32)(fp))
+		} else {
+			f = *(*float64)(fp)
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return appendFloatSpecial(dst, f, ff), nil
+		}
+		return ins(p, dst, opts)
+	}
+}
+
+// newTimeLayoutInstr returns an instruction to encode
+// the time.Time, or pointer to time.Time type t, with
+// the given layout rather than the one of the options.
+func newTimeLayoutInstr(t reflect.Type, layout string) instruction {
+	offsetLayout := strings.ReplaceAll(layout, "Z07", "-07")
+
+	ins := func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		opts.flags.unset(unixTimeFlags)
+		opts.timeLayout = layout
+		if opts.flags.has(zuluAsOffset) {
+			opts.timeLayout = offsetLayout
+		}
+		return encodeTime(p, dst, opts)
+	}
+	if t.Kind() == reflect.Ptr {
+		z := unsafe.Pointer(&time.Time{})
+		return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+			return encodePointer(p, dst, opts, t, ins, z)
+		}
+	}
+	return ins
+}
+
+// newCleanNumberInstr returns an instruction to encode
+// the string, or pointer to string type t, as a number
+// literal, with the cleanumber tag's option.
+func newCleanNumberInstr(t reflect.Type) instruction {
+	if t.Kind() == reflect.Ptr {
+		z := unsafe.Pointer(new(string))
+		return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+			return encodePointer(p, dst, opts, t, encodeCleanNumber, z)
+		}
+	}
+	return encodeCleanNumber
+}
+
+// fieldIndent is the indent of the values of
+// the fields with the indent tag's option.
+const fieldIndent = "  "
+
+// newIndentInstr returns an instruction that formats
+// the JSON representation of the value encoded by ins
+// like the json.MarshalIndent function does.
+func newIndentInstr(ins instruction) instruction {
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		if opts.flags.has(decimalSeparator) {
+			// The output cannot be parsed to be indented.
+			return dst, &InvalidOptionError{
+				fmt.Errorf("indent tag option and decimal separator are mutually exclusive"),
+			}
+		}
+		off := len(dst)
+		dst, err := ins(p, dst, opts)
+		if err != nil || opts.flags.has(indentOutput) {
+			// The whole output is indented
+			// once fully encoded.
+			return dst, err
+		}
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, dst[off:], "", fieldIndent); err != nil {
+			return dst, err
+		}
+		return append(dst[:off], buf.Bytes()...), nil
+	}
+}
+
+func newMapInstr(t reflect.Type, naming fieldNaming) instruction {
+	ki := newMapKeyInstr(t.Key())
+	if ki == nil {
 		return newUnsupportedTypeInstr(t)
 	}
+	vi := newInstruction(t.Elem(), false, false, naming)
+
+	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
+		return encodeMap(p, dst, opts, t, ki, vi)
+	}
+}
+
+// mergeInstr encodes the n maps pointed by p
+// as a single object, see encodeMergedMaps.
+type mergeInstr func(p unsafe.Pointer, n int, dst []byte, opts encOpts) ([]byte, error)
+
+// newMergeInstr returns the instruction that
+// merges the maps of type t, or nil if the
+// keys of t are not supported.
+func newMergeInstr(t reflect.Type, naming fieldNaming) mergeInstr {
+	ki := newMapKeyInstr(t.Key())
+	if ki == nil {
+		return nil
+	}
+	vi := newInstruction(t.Elem(), false, false, naming)
+
+	return func(p unsafe.Pointer, n int, dst []byte, opts encOpts) ([]byte, error) {
+		return encodeMergedMaps(p, n, dst, opts, t, ki, vi)
+	}
+}
+
+// newMapKeyInstr returns the instruction of the keys
+// of type kt of a map, or nil if they are unsupported.
+func newMapKeyInstr(kt reflect.Type) instruction {
+	var ki instruction
+
+	if !isString(kt) && !isInteger(kt) && !kt.Implements(textMarshalerType) {
+		return nil
+	}
 	// The standard library has a strict precedence order
 	// for map key types, defined by the documentation of
 	// the json.Marshal function. That's why we bypass the
 	// newTypeInstr function if key type is string.
 	if isString(kt) {
-		ki = encodeString
+		ki = encodeKeyString
+	} else if isRegisteredType(kt) {
+		// Keys of registered types are encoded
+		// according to their kind only.
+		ki = newKindInstr(kt, false, false, defaultNaming)
+	} else if kt == bigIntPtrType || kt == bigRatPtrType || kt == timeTimePtrType {
+		// The instructions of these types may encode
+		// numbers, and keys must use the text form.
+		ki = newTextMarshalerInstr(kt, false)
 	} else {
-		ki = newInstruction(kt, false, false)
+		ki = newTypeInstr(kt, false, false, defaultNaming)
 	}
 	// Wrap the key instruction for types that
 	// do not encode with quotes by default.
-	if !isString(kt) && !kt.Implements(textMarshalerType) {
+	if !isString(kt) && (!kt.Implements(textMarshalerType) || isNumberTextMarshaler(kt)) {
 		ki = wrapQuotedInstr(ki)
 	}
 	// See issue golang.org/issue/33675 for reference.
 	if kt.Implements(textMarshalerType) && kt.Kind() == reflect.Ptr {
 		ki = wrapTextMarshalerNilCheck(ki)
 	}
-	vi = newInstruction(et, false, false)
-
-	return func(p unsafe.Pointer, dst []byte, opts encOpts) ([]byte, error) {
-		return encodeMap(p, dst, opts, t, ki, vi)
-	}
+	return ki
 }
 
 func wrapInlineInstr(ins instruction) instruction {
@@ -81,3 +81,33 @@ func encodeUintptr(
 ) ([]byte, error) {
 	return strconv.AppendUint(dst, uint64(*(*uintptr)(p)), 10), nil
 }
+
+// loadUint64 returns the bits of the integer of
+// the given size in bytes pointed by p.
+func loadUint64(p unsafe.Pointer, size uintptr) uint64 {
+	switch size {
+	case 1:
+		return uint64(*(*uint8)(p))
+	case 2:
+		return uint64(*(*uint16)(p))
+	case 4:
+		return uint64(*(*uint32)(p))
+	default:
+		return *(*uint64)(p)
+	}
+}
+
+// loadInt64 is similar to loadUint64, but
+// sign-extends the integer to 64 bits.
+func loadInt64(p unsafe.Pointer, size uintptr) int64 {
+	switch size {
+	case 1:
+		return int64(*(*int8)(p))
+	case 2:
+		return int64(*(*int16)(p))
+	case 4:
+		return int64(*(*int32)(p))
+	default:
+		return *(*int64)(p)
+	}
+}
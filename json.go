@@ -1,10 +1,18 @@
 package jettison
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // AppendMarshaler is a variant of the json.Marshaler
@@ -26,18 +34,57 @@ type AppendMarshalerCtx interface {
 	AppendJSONContext(context.Context, []byte) ([]byte, error)
 }
 
+// StringReader is implemented by types whose value is
+// a possibly large text, read from an io.Reader. With
+// the StreamStringReaders option, the text is read and
+// escaped by chunks into the destination buffer, which
+// avoids a copy of the whole text as a Go string. The
+// escaped text is still held in full by the buffer.
+// The reader is never closed by the encoder, even if
+// it implements io.Closer.
+type StringReader interface {
+	JSONStringReader() io.Reader
+}
+
+// SchemaProvider is implemented by types that can
+// describe their JSON representation with a schema,
+// which is included in the output along with the
+// value when the IncludeSchema option is used.
+type SchemaProvider interface {
+	JSONSchema() json.RawMessage
+}
+
 const (
 	marshalerJSON          = "MarshalJSON"
 	marshalerText          = "MarshalText"
+	marshalerBinary        = "MarshalBinary"
+	marshalerValue         = "Value"
+	marshalerStringReader  = "JSONStringReader"
 	marshalerAppendJSONCtx = "AppendJSONContext"
 	marshalerAppendJSON    = "AppendJSON"
+	methodJSONSchema       = "JSONSchema"
+	funcValueCall          = "function value"
+	typeEncoderCall        = "registered encoder"
 )
 
 // MarshalerError represents an error from calling
-// the methods MarshalJSON or MarshalText.
+// the methods MarshalJSON or MarshalText, a function
+// value resolved with ResolveFuncValues, or a function
+// registered with RegisterTypeEncoder.
 type MarshalerError struct {
-	Type     reflect.Type
-	Err      error
+	Type reflect.Type
+	Err  error
+
+	// Path locates the value whose encoding failed
+	// in the top-level value, with the keys of the
+	// struct fields and map entries separated by
+	// dots, and the indexes of the array and slice
+	// elements in brackets, such as "users[3].name".
+	// It is empty for the top-level value, and isn't
+	// part of the error message, which is that of
+	// the encoding/json package.
+	Path string
+
 	funcName string
 }
 
@@ -55,6 +102,22 @@ func (e *MarshalerError) Unwrap() error {
 	return e.Err
 }
 
+// prependErrorPath adds the segment seg, the key of a
+// struct field or map entry, or the index of an array
+// or slice element in brackets, to the path of err if
+// it's a MarshalerError, while the error is returned
+// from the nested values.
+func prependErrorPath(err error, seg string) error {
+	if me, ok := err.(*MarshalerError); ok {
+		if me.Path == "" || me.Path[0] == '[' {
+			me.Path = seg + me.Path
+		} else {
+			me.Path = seg + "." + me.Path
+		}
+	}
+	return err
+}
+
 // UnsupportedTypeError is the error returned
 // by Marshal when attempting to encode an
 // unsupported value type.
@@ -105,6 +168,57 @@ func (e *InvalidOptionError) Error() string {
 	return fmt.Sprintf("json: invalid option: %s", e.Err.Error())
 }
 
+// ErrMaxDepthExceeded is the error returned by
+// MarshalOpts when the nesting of the objects and
+// arrays of a value exceeds the limit set with the
+// MaxDepth option, such as for a pointer cycle.
+var ErrMaxDepthExceeded = errors.New("json: max depth exceeded")
+
+// ErrETagKeyConflict is the error returned by
+// MarshalOpts when the object of the top-level
+// value already has a member with the key of the
+// ComputeETag option.
+var ErrETagKeyConflict = errors.New("json: etag key conflicts with a member of the object")
+
+// ErrCycleDetected is the error wrapped by
+// a CycleError.
+var ErrCycleDetected = errors.New("json: cycle detected")
+
+// CycleError is the error returned by MarshalOpts
+// when a value that is part of a cycle is found,
+// with the DetectCycles option.
+type CycleError struct {
+	Type reflect.Type
+}
+
+// Error implements the builtin error interface.
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("json: unsupported value: encountered a cycle via %s", e.Type)
+}
+
+// Unwrap returns ErrCycleDetected.
+func (e *CycleError) Unwrap() error {
+	return ErrCycleDetected
+}
+
+// DeadlineError is the error returned by MarshalOpts
+// when the deadline of the Timeout option, or the one
+// of the context set with WithContext, has passed
+// before the end of the encoding.
+type DeadlineError struct {
+	Timeout time.Duration
+}
+
+// Error implements the builtin error interface.
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf("json: encoding deadline exceeded (timeout %s)", e.Timeout)
+}
+
+// Unwrap returns context.DeadlineExceeded.
+func (e *DeadlineError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
 // Marshal returns the JSON encoding of v.
 // The full documentation can be found at
 // https://golang.org/pkg/encoding/json/#Marshal.
@@ -128,9 +242,6 @@ func Append(dst []byte, v interface{}) ([]byte, error) {
 // MarshalOpts is similar to Marshal, but also accepts
 // a list of options to configure the encoding behavior.
 func MarshalOpts(v interface{}, opts ...Option) ([]byte, error) {
-	if v == nil {
-		return []byte("null"), nil
-	}
 	eo := defaultEncOpts()
 
 	if len(opts) != 0 {
@@ -139,15 +250,21 @@ func MarshalOpts(v interface{}, opts ...Option) ([]byte, error) {
 			return nil, &InvalidOptionError{err}
 		}
 	}
-	return marshalJSON(v, eo)
+	var (
+		b   []byte
+		err error
+	)
+	if v == nil {
+		b = appendNull(nil, eo)
+	} else if b, err = marshalJSON(v, eo); err != nil {
+		return nil, err
+	}
+	return postProcess(b, 0, v, eo)
 }
 
 // AppendOpts is similar to Append, but also accepts
 // a list of options to configure the encoding behavior.
 func AppendOpts(dst []byte, v interface{}, opts ...Option) ([]byte, error) {
-	if v == nil {
-		return append(dst, "null"...), nil
-	}
 	eo := defaultEncOpts()
 
 	if len(opts) != 0 {
@@ -156,11 +273,321 @@ func AppendOpts(dst []byte, v interface{}, opts ...Option) ([]byte, error) {
 			return nil, &InvalidOptionError{err}
 		}
 	}
-	return appendJSON(dst, v, eo)
+	off := len(dst)
+
+	if v == nil {
+		dst = appendNull(dst, eo)
+	} else {
+		var err error
+		if dst, err = appendJSON(dst, v, eo); err != nil {
+			return dst, err
+		}
+	}
+	return postProcess(dst, off, v, eo)
+}
+
+// EncodeToBuilder is similar to AppendOpts, but writes
+// the JSON representation of v to the builder b. The
+// encoding is done in a pooled buffer, and nothing is
+// written to b if an error occurs.
+func EncodeToBuilder(v interface{}, b *strings.Builder, opts ...Option) error {
+	buf := cachedBuffer()
+	var err error
+	if buf.B, err = AppendOpts(buf.B, v, opts...); err == nil {
+		b.Write(buf.B)
+	}
+	bufferPool.Put(buf)
+
+	return err
+}
+
+// EncodeCount is similar to EncodeToBuilder, but writes
+// the JSON representation of v to w, and returns the
+// number of bytes written. Nothing is written to w if
+// an error occurs during the encoding. If w returns an
+// error, the count is that of the bytes it reported as
+// written before the error, and if it writes less bytes
+// than the output without error, io.ErrShortWrite is
+// returned.
+func EncodeCount(v interface{}, w io.Writer, opts ...Option) (int, error) {
+	buf := cachedBuffer()
+	defer bufferPool.Put(buf)
+
+	var err error
+	if buf.B, err = AppendOpts(buf.B, v, opts...); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(buf.B)
+	if err != nil {
+		return n, err
+	}
+	if n < len(buf.B) {
+		return n, io.ErrShortWrite
+	}
+	return len(buf.B), nil
+}
+
+// postProcess applies the options that operate on the
+// complete output to the JSON representation of the
+// top-level value v, located in dst after offset off.
+func postProcess(dst []byte, off int, v interface{}, opts encOpts) ([]byte, error) {
+	if v != nil && opts.x != nil && opts.x.etagHash != nil && len(dst) > off {
+		var err error
+		if dst, err = appendETag(dst, off, v, opts); err != nil {
+			return dst[:off], err
+		}
+	}
+	if v != nil && opts.x != nil && opts.x.links != nil && len(dst) > off {
+		dst = appendLinks(dst, v, opts)
+	}
+	if v != nil && opts.x != nil && opts.x.schemaKey != nil {
+		if sp, ok := v.(SchemaProvider); ok {
+			var err error
+			if dst, err = wrapWithSchema(dst, off, sp, opts); err != nil {
+				return dst[:off], err
+			}
+		}
+	}
+	if opts.flags.has(canonicalJSON) {
+		b, err := appendCanonical(nil, dst[off:])
+		if err != nil {
+			return dst[:off], err
+		}
+		dst = append(dst[:off], b...)
+	}
+	if opts.flags.has(validateOutput) && !json.Valid(dst[off:]) {
+		return dst[:off], &SyntaxError{msg: "json: invalid output"}
+	}
+	if opts.flags.has(indentOutput) {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, dst[off:], opts.x.indentPrefix, opts.x.indent); err != nil {
+			return dst[:off], err
+		}
+		b := buf.Bytes()
+		if opts.flags.has(alignValues) {
+			b = alignKeys(b)
+		}
+		dst = append(dst[:off], b...)
+	}
+	if opts.x != nil && opts.x.transform != nil {
+		b, err := opts.x.transform(dst[off:])
+		if err != nil {
+			return dst[:off], err
+		}
+		dst = append(dst[:off], b...)
+	}
+	if opts.flags.has(trailingNewline) {
+		dst = append(dst, '\n')
+	}
+	return dst, nil
+}
+
+// etagFlags are the flags kept to encode the value
+// hashed by appendETag, without which some values
+// couldn't be encoded at all.
+const etagFlags = complexAsObject | resolveFuncValues
+
+// appendETag adds the member of the ComputeETag option
+// to the JSON object located in dst after offset off,
+// which is the representation of v, if it's an object.
+func appendETag(dst []byte, off int, v interface{}, opts encOpts) ([]byte, error) {
+	if dst[off] != '{' || dst[len(dst)-1] != '}' {
+		return dst, nil
+	}
+	if hasMember(dst[off:], opts.x.etagKey) {
+		return dst, ErrETagKeyConflict
+	}
+	// The value is encoded again with a fixed set of
+	// options, without the callbacks, so that the etag
+	// doesn't depend on the options of the caller.
+	eo := defaultEncOpts()
+	eo.flags = opts.flags & etagFlags
+
+	buf := cachedBuffer()
+	defer bufferPool.Put(buf)
+
+	var err error
+	if buf.B, err = appendJSON(buf.B, v, eo); err != nil {
+		return dst, err
+	}
+	can := cachedBuffer()
+	defer bufferPool.Put(can)
+
+	if can.B, err = appendCanonical(can.B, buf.B); err != nil {
+		return dst, err
+	}
+	tag := opts.x.etagHash(can.B)
+
+	dst = dst[:len(dst)-1]
+	if dst[len(dst)-1] != '{' {
+		dst = append(dst, ',')
+	}
+	dst = append(dst, '"')
+	dst = appendEscapedBytes(dst, opts.x.etagKey, opts)
+	dst = append(dst, `":"`...)
+	dst = appendEscapedBytes(dst, []byte(tag), opts)
+
+	return append(dst, `"}`...), nil
+}
+
+const linksKey = "_links"
+
+// appendLinks adds the links returned by the function
+// set with the HypermediaLinks option to the JSON object
+// that ends dst, if v is a struct or a pointer to a struct.
+func appendLinks(dst []byte, v interface{}, opts encOpts) []byte {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || dst[len(dst)-1] != '}' {
+		return dst
+	}
+	// A field of the struct has precedence.
+	for _, f := range cachedFields(t, opts.tagKey(), opts.keyNamer()) {
+		if f.name == linksKey {
+			return dst
+		}
+	}
+	links := opts.x.links(v)
+	if len(links) == 0 {
+		return dst
+	}
+	keys := make([]string, 0, len(links))
+	for k := range links {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	dst = dst[:len(dst)-1]
+	if dst[len(dst)-1] != '{' {
+		dst = append(dst, ',')
+	}
+	dst = append(dst, `"`+linksKey+`":{`...)
+	for i, k := range keys {
+		if i != 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, '"')
+		dst = appendEscapedBytes(dst, []byte(k), opts)
+		dst = append(dst, `":"`...)
+		dst = appendEscapedBytes(dst, []byte(links[k]), opts)
+		dst = append(dst, '"')
+	}
+	return append(dst, "}}"...)
+}
+
+// alignKeys pads the keys of the members of each
+// object of the indented JSON b with spaces, so that
+// the colons that follow the keys are aligned.
+func alignKeys(b []byte) []byte {
+	type member struct {
+		colon int // offset of the colon
+		width int // number of runes of the key
+	}
+	var (
+		stack   [][]member // members of the open objects
+		pads    []member   // colons to pad, and the padding
+		inStr   bool
+		escaped bool
+		strOff  int // offset of the last string
+		strEnd  int // offset of the end of the last string
+	)
+	for i, c := range b {
+		if inStr {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inStr = false
+				strEnd = i + 1
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inStr = true
+			strOff = i
+		case '{':
+			stack = append(stack, nil)
+		case ':':
+			n := len(stack) - 1
+			stack[n] = append(stack[n], member{i, utf8.RuneCount(b[strOff:strEnd])})
+		case '}':
+			n := len(stack) - 1
+			w := 0
+			for _, m := range stack[n] {
+				if m.width > w {
+					w = m.width
+				}
+			}
+			for _, m := range stack[n] {
+				if m.width < w {
+					pads = append(pads, member{m.colon, w - m.width})
+				}
+			}
+			stack = stack[:n]
+		}
+	}
+	if len(pads) == 0 {
+		return b
+	}
+	sort.Slice(pads, func(i, j int) bool {
+		return pads[i].colon < pads[j].colon
+	})
+	n := 0
+	for _, p := range pads {
+		n += p.width
+	}
+	out := make([]byte, 0, len(b)+n)
+	last := 0
+	for _, p := range pads {
+		out = append(out, b[last:p.colon]...)
+		for j := 0; j < p.width; j++ {
+			out = append(out, ' ')
+		}
+		last = p.colon
+	}
+	return append(out, b[last:]...)
+}
+
+// wrapWithSchema wraps the JSON representation of
+// the value located in dst after offset off, in an
+// object that contains the schema returned by sp.
+func wrapWithSchema(dst []byte, off int, sp SchemaProvider, opts encOpts) ([]byte, error) {
+	schema := sp.JSONSchema()
+	if !json.Valid(schema) {
+		return dst, &MarshalerError{Type: reflect.TypeOf(sp), Err: &SyntaxError{
+			msg: "json: invalid schema",
+		}, funcName: methodJSONSchema}
+	}
+	n := len(dst)
+
+	dst = append(dst, '{', '"')
+	dst = appendEscapedBytes(dst, opts.x.schemaKey, opts)
+	dst = append(dst, '"', ':')
+	if opts.flags.has(noCompact) {
+		dst = append(dst, schema...)
+	} else {
+		var err error
+		if dst, err = appendCompactJSON(dst, schema, !opts.flags.has(noHTMLEscaping)); err != nil {
+			return dst, err
+		}
+	}
+	dst = append(dst, `,"data":`...)
+
+	// Move the value after the schema.
+	reverseBytes(dst[off:n])
+	reverseBytes(dst[n:])
+	reverseBytes(dst[off:])
+
+	return append(dst, '}'), nil
 }
 
 func marshalJSON(v interface{}, opts encOpts) ([]byte, error) {
-	ins := cachedInstr(reflect.TypeOf(v))
+	ins := typeInstr(reflect.TypeOf(v), opts)
 	buf := cachedBuffer()
 
 	var err error
@@ -183,7 +610,7 @@ func marshalJSON(v interface{}, opts encOpts) ([]byte, error) {
 }
 
 func appendJSON(dst []byte, v interface{}, opts encOpts) ([]byte, error) {
-	ins := cachedInstr(reflect.TypeOf(v))
+	ins := typeInstr(reflect.TypeOf(v), opts)
 	var err error
 	dst, err = ins(unpackEface(v).word, dst, opts)
 	runtime.KeepAlive(v)
@@ -4,18 +4,29 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"math"
 	"math/big"
 	"net"
 	"reflect"
 	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
+	"unicode/utf8"
+	"unsafe"
 )
 
 type (
@@ -181,7 +192,7 @@ func TestInvalidEncodeOpts(t *testing.T) {
 	for _, opt := range []Option{
 		TimeLayout(""),
 		DurationFormat(DurationFmt(-1)),
-		DurationFormat(DurationFmt(6)),
+		DurationFormat(DurationFmt(7)),
 		WithContext(nil), // nolint:staticcheck
 	} {
 		_, err1 := MarshalOpts(struct{}{}, opt)
@@ -279,6 +290,257 @@ func TestUnsupportedTypes(t *testing.T) {
 	}
 }
 
+// pm has a MarshalJSON method with a pointer receiver,
+// and a field that can't be encoded without it.
+type pm struct{ C chan int }
+
+func (*pm) MarshalJSON() ([]byte, error) { return []byte(`"pm"`), nil }
+
+// TestCanEncode tests that CanEncode reports the types
+// that can't be encoded, with the path of their field,
+// and uses the methods with a pointer receiver only for
+// the addressable values, like the instructions.
+func TestCanEncode(t *testing.T) {
+	type (
+		node struct {
+			Next     *node
+			Children []node
+			M        map[string]*node
+		}
+		inner struct {
+			C chan int
+		}
+		outer struct {
+			A  int
+			In inner `json:"in"`
+		}
+		ignored struct {
+			A int
+			C chan int `json:"-"`
+			c chan int
+		}
+	)
+	for _, v := range []struct {
+		v    interface{}
+		opts []Option
+	}{
+		{v: node{}},
+		{v: ignored{}},
+		{v: time.Time{}},
+		{v: big.Int{}},
+		{v: json.RawMessage(nil)},
+		{v: map[int][]interface{}{}},
+		{v: map[mkvcmpMarshaler]string{}},
+		{v: &struct{ F func() interface{} }{}, opts: []Option{ResolveFuncValues()}},
+		{v: []complex64{}, opts: []Option{ComplexAsObject()}},
+		{v: &pm{}},
+		{v: []pm{}},
+		{v: &struct{ P pm }{}},
+		{v: map[string]*pm{}},
+	} {
+		if err := CanEncode(reflect.TypeOf(v.v), v.opts...); err != nil {
+			t.Errorf("%T: %s", v.v, err)
+		}
+	}
+	for _, v := range []interface{}{
+		make(chan int),
+		func() {},
+		func() interface{} { return nil },
+		complex64(0),
+		make([]chan int, 1),
+		&[1]complex128{},
+		map[int]chan bool{},
+		map[[2]int]string{},
+		unsafe.Pointer(nil),
+		struct{ F func() }{},
+		pm{},
+		map[string]pm{},
+		struct{ P pm }{},
+		[1]pm{},
+	} {
+		var ute *UnsupportedTypeError
+		if err := CanEncode(reflect.TypeOf(v)); !errors.As(err, &ute) {
+			t.Errorf("%T: got %T, want *jettison.UnsupportedTypeError", v, err)
+		}
+	}
+	err := CanEncode(reflect.TypeOf([]outer{}))
+	if err == nil {
+		t.Fatal("expected non-nil error")
+	}
+	var ute *UnsupportedTypeError
+	if !errors.As(err, &ute) {
+		t.Fatalf("got %T, want *jettison.UnsupportedTypeError", err)
+	}
+	if ute.Type != reflect.TypeOf(make(chan int)) {
+		t.Errorf("got %s, want chan int", ute.Type)
+	}
+	if got, want := err.Error(), "json: field In.C: json: unsupported type: chan int"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := CanEncode(nil); err != nil {
+		t.Errorf("expected nil error, got %s", err)
+	}
+}
+
+// TestBoolAsInt tests that the booleans are encoded as
+// the numbers 1 and 0 with the BoolAsInt option, at
+// any depth and with the string tag option.
+func TestBoolAsInt(t *testing.T) {
+	type x struct {
+		A bool            `json:"a"`
+		B bool            `json:"b"`
+		C bool            `json:"c,string"`
+		D *bool           `json:"d"`
+		E []bool          `json:"e"`
+		F map[string]bool `json:"f"`
+		G interface{}     `json:"g"`
+		H bool            `json:"h,omitempty"`
+	}
+	tr := true
+	xx := x{
+		A: true,
+		C: true,
+		D: &tr,
+		E: []bool{true, false},
+		F: map[string]bool{"y": true, "n": false},
+		G: false,
+	}
+	b, err := MarshalOpts(xx, BoolAsInt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":1,"b":0,"c":"1","d":1,"e":[1,0],"f":{"n":0,"y":1},"g":0}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	for v, want := range map[bool]string{true: `1`, false: `0`} {
+		b, err := MarshalOpts(v, BoolAsInt())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != want {
+			t.Errorf("got %#q, want %#q", got, want)
+		}
+	}
+	// The default remains true and false.
+	marshalCompare(t, xx, "")
+}
+
+// TestNullLiteral tests that the literal set with the
+// NullLiteral option replaces null for the nil values
+// of all kinds, but not for the raw messages that are
+// null or the strings whose text is null.
+func TestNullLiteral(t *testing.T) {
+	type x struct {
+		A []int           `json:"a"`
+		B map[string]int  `json:"b"`
+		C *int            `json:"c"`
+		D interface{}     `json:"d"`
+		E []byte          `json:"e"`
+		F *big.Int        `json:"f"`
+		G json.RawMessage `json:"g"`
+		H *niljsonm       `json:"h"`
+		I string          `json:"i"`
+		J json.RawMessage `json:"j"`
+		K []*int          `json:"k"`
+		L []int           `json:"l"`
+	}
+	xx := x{
+		I: "null",
+		J: json.RawMessage(`null`),
+		K: []*int{nil},
+	}
+	for _, v := range []struct {
+		opts []Option
+		want string
+	}{
+		{
+			[]Option{NullLiteral([]byte(`""`))},
+			`{"a":"","b":"","c":"","d":"","e":"","f":"","g":"","h":"","i":"null","j":null,"k":[""],"l":""}`,
+		},
+		{
+			[]Option{NullLiteral([]byte(`-1`)), NilSliceEmpty()},
+			`{"a":[],"b":-1,"c":-1,"d":-1,"e":-1,"f":-1,"g":-1,"h":-1,"i":"null","j":null,"k":[-1],"l":[]}`,
+		},
+		{
+			[]Option{NullLiteral(nil)},
+			`{"a":null,"b":null,"c":null,"d":null,"e":null,"f":null,"g":null,"h":null,"i":"null","j":null,"k":[null],"l":null}`,
+		},
+	} {
+		b, err := MarshalOpts(xx, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	b, err := MarshalOpts(nil, NullLiteral([]byte(`"N/A"`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `"N/A"`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	for _, lit := range []string{"", "nul", `"a`, "1 2"} {
+		_, err := MarshalOpts(xx, NullLiteral([]byte(lit)))
+		if _, ok := err.(*InvalidOptionError); !ok {
+			t.Errorf("%q: got %T, want *jettison.InvalidOptionError", lit, err)
+		}
+	}
+}
+
+// TestComplexAsObject tests that the complex numbers
+// are encoded as objects with a real and an imaginary
+// part with the ComplexAsObject option, and that the
+// parts that are NaN or infinite are rejected.
+func TestComplexAsObject(t *testing.T) {
+	type x struct {
+		C64  complex64             `json:"c64"`
+		C128 complex128            `json:"c128"`
+		S    []complex64           `json:"s"`
+		M    map[string]complex128 `json:"m"`
+		P    *complex128           `json:"p"`
+		I    interface{}           `json:"i"`
+	}
+	c := complex(3, -4)
+	testdata := []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{complex64(1 + 2i), nil, `{"real":1,"imag":2}`},
+		{complex128(1.5 - 0.25i), nil, `{"real":1.5,"imag":-0.25}`},
+		{[]complex128{0, 1i}, nil, `[{"real":0,"imag":0},{"real":0,"imag":1}]`},
+		{map[string]complex64{"z": 2.5}, nil, `{"z":{"real":2.5,"imag":0}}`},
+		{
+			x{C64: 1, C128: 2i, S: []complex64{3}, M: map[string]complex128{"k": 4}, P: &c, I: complex64(5i)}, nil,
+			`{"c64":{"real":1,"imag":0},"c128":{"real":0,"imag":2},"s":[{"real":3,"imag":0}],` +
+				`"m":{"k":{"real":4,"imag":0}},"p":{"real":3,"imag":-4},"i":{"real":0,"imag":5}}`,
+		},
+		// The parts obey the options of floats.
+		{complex128(1.23456 + 2i), []Option{FloatPrecision(2)}, `{"real":1.23,"imag":2.00}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, append(v.opts, ComplexAsObject())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	for _, v := range []interface{}{
+		complex(math.NaN(), 0),
+		complex64(complex(0, math.Inf(1))),
+	} {
+		_, err := MarshalOpts(v, ComplexAsObject())
+		if _, ok := err.(*UnsupportedValueError); !ok {
+			t.Errorf("got %T, want *jettison.UnsupportedValueError", err)
+		}
+	}
+}
+
 // TestInvalidFloatValues tests that encoding an
 // invalid float value returns UnsupportedValueError.
 func TestInvalidFloatValues(t *testing.T) {
@@ -335,6 +597,43 @@ func TestJSONNumber(t *testing.T) {
 	}
 }
 
+// TestJSONNumberAsString tests that the json.Number
+// values are encoded as strings with the option
+// JSONNumberAsString, and that the invalid numbers
+// are still rejected.
+func TestJSONNumberAsString(t *testing.T) {
+	type x struct {
+		N json.Number  `json:"n"`
+		P *json.Number `json:"p"`
+	}
+	n := json.Number("1e3")
+
+	for _, v := range []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{json.Number("42"), nil, `42`},
+		{json.Number("42"), []Option{JSONNumberAsString()}, `"42"`},
+		{json.Number(""), []Option{JSONNumberAsString()}, `"0"`},
+		{x{N: "-3.14", P: &n}, []Option{JSONNumberAsString()}, `{"n":"-3.14","p":"1e3"}`},
+		{x{N: "-3.14"}, []Option{JSONNumberAsString()}, `{"n":"-3.14","p":null}`},
+		{json.Number(`<"a">`), []Option{JSONNumberAsString(), NoNumberValidation()}, `"\u003c\"a\"\u003e"`},
+	} {
+		b, err := MarshalOpts(v.v, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// Invalid numbers are still rejected.
+	if _, err := MarshalOpts(json.Number("084"), JSONNumberAsString()); err == nil {
+		t.Error("expected non-nil error")
+	}
+}
+
 func TestInvalidTime(t *testing.T) {
 	// Special case to test error when the year
 	// of the date is outside of range [0.9999].
@@ -929,6 +1228,103 @@ func TestMarshalerError(t *testing.T) {
 	}
 }
 
+// TestMarshalerErrorPath tests that the Path field of
+// a MarshalerError locates the value of the marshaler
+// that returned the error.
+func TestMarshalerErrorPath(t *testing.T) {
+	type (
+		profile struct {
+			Name   string `json:"name"`
+			Avatar errvm  `json:"avatar"`
+		}
+		user struct {
+			Profile *profile `json:"profile"`
+		}
+	)
+	users := []user{{}, {}, {}, {Profile: &profile{}}}
+
+	sm := &sync.Map{}
+	sm.Store("k", []interface{}{1, &errrm{}})
+
+	for _, tt := range []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{errvm{}, nil, ""},
+		{map[string][]user{"users": users}, nil, "users[3].profile.avatar"},
+		{map[string][]user{"users": users}, []Option{UnsortedMap()}, "users[3].profile.avatar"},
+		{[2][]user{nil, users}, nil, "[1][3].profile.avatar"},
+		{map[int]interface{}{42: profile{}}, nil, "42.avatar"},
+		{sm, nil, "k[1]"},
+		{sm, []Option{UnsortedMap()}, "k[1]"},
+	} {
+		_, err := MarshalOpts(tt.v, tt.opts...)
+		me, ok := err.(*MarshalerError)
+		if !ok {
+			t.Fatalf("got %T, want MarshalerError", err)
+		}
+		if me.Path != tt.want {
+			t.Errorf("got %q, want %q", me.Path, tt.want)
+		}
+	}
+}
+
+type todoctxm struct{}
+
+func (*todoctxm) AppendJSONContext(ctx context.Context, dst []byte) ([]byte, error) {
+	if ctx == nil {
+		return dst, errors.New("nil context")
+	}
+	if ctx != context.TODO() {
+		return append(dst, `"other"`...), nil
+	}
+	return append(dst, `"todo"`...), nil
+}
+
+// TestMarshalerCtxDefaultContext tests that the
+// AppendJSONContext method of a type is called with
+// context.TODO when no context is given with the
+// WithContext option, whatever the entry point.
+func TestMarshalerCtxDefaultContext(t *testing.T) {
+	type x struct {
+		A todoctxm  `json:"a"`
+		B *todoctxm `json:"b"`
+	}
+	xx := &x{B: &todoctxm{}}
+	want := `{"a":"todo","b":"todo"}`
+
+	check := func(name string, b []byte, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if got := string(b); got != want {
+			t.Errorf("%s: got %#q, want %#q", name, got, want)
+		}
+	}
+	b, err := Marshal(xx)
+	check("Marshal", b, err)
+
+	b, err = Append(nil, xx)
+	check("Append", b, err)
+
+	b, err = MarshalOpts(xx, UnsortedMap())
+	check("MarshalOpts", b, err)
+
+	b, err = AppendOpts(nil, xx, NoHTMLEscaping())
+	check("AppendOpts", b, err)
+
+	// An explicit context is passed as is.
+	b, err = MarshalOpts(xx, WithContext(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"a":"other","b":"other"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
 // TestStructFieldName tests that invalid struct
 // field names are ignored during marshaling.
 func TestStructFieldName(t *testing.T) {
@@ -998,6 +1394,110 @@ func TestStructFieldOmitempty(t *testing.T) {
 	marshalCompare(t, xx, "")
 }
 
+// TestStructFieldOmitemptyStructs tests that the struct
+// fields with the omitempty option whose value is the zero
+// value of their type are omitted with the OmitEmptyStructs
+// option.
+func TestStructFieldOmitemptyStructs(t *testing.T) {
+	type (
+		inner struct {
+			A bool
+			B int64
+			C string
+			D []int
+		}
+		Embed struct {
+			E int `json:"e"`
+		}
+		x struct {
+			Embed `json:"embed,omitempty"`
+
+			Z1 inner     `json:"z1,omitempty"`
+			Z2 inner     `json:"z2,omitempty"`
+			Z3 inner     `json:"z3"`
+			Z4 *inner    `json:"z4,omitempty"`
+			Z5 *inner    `json:"z5,omitempty"`
+			Z6 time.Time `json:"z6,omitempty"`
+			Z7 struct{}  `json:"z7,omitempty"`
+			Z8 [2]inner  `json:"z8,omitempty"`
+		}
+	)
+	s := "Loreum"
+	xx := x{
+		Z2: inner{C: s[:0], D: []int{}},
+		Z5: &inner{},
+	}
+	b, err := MarshalOpts(xx, OmitEmptyStructs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"z2":{"A":false,"B":0,"C":"","D":[]},"z3":{"A":false,"B":0,"C":"","D":null},` +
+		`"z5":{"A":false,"B":0,"C":"","D":null},"z8":[{"A":false,"B":0,"C":"","D":null},{"A":false,"B":0,"C":"","D":null}]}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Without the option, the zero values
+	// of the struct fields are encoded.
+	marshalCompare(t, xx, "")
+
+	// With the ExplicitDefaults option,
+	// all the fields are encoded.
+	b, err = MarshalOpts(xx, OmitEmptyStructs(), ExplicitDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"z1":{`) {
+		t.Errorf("expected field z1 to be encoded: %s", b)
+	}
+}
+
+// TestZeroFuncOf tests that the functions returned by
+// zeroFuncOf report the zero values like the IsZero
+// method of reflect.Value, for the padded structs too.
+func TestZeroFuncOf(t *testing.T) {
+	type (
+		padded struct {
+			A int8
+			B int64
+			C string
+			D [3]string
+			E struct {
+				F bool
+				G float64
+			}
+		}
+	)
+	s := "Loreum"
+	for _, v := range []interface{}{
+		padded{},
+		padded{A: 1},
+		padded{B: 1},
+		padded{C: s[:0]},
+		padded{C: s},
+		padded{D: [3]string{2: s[:0]}},
+		padded{D: [3]string{2: s}},
+		padded{E: struct {
+			F bool
+			G float64
+		}{G: 0.5}},
+		[2]padded{},
+		[2]padded{1: {A: 1}},
+		time.Time{},
+		time.Unix(0, 0),
+		[0]string{},
+		struct{ P *int }{P: new(int)},
+	} {
+		rv := reflect.ValueOf(v)
+		p := reflect.New(rv.Type())
+		p.Elem().Set(rv)
+
+		fn := zeroFuncOf(rv.Type())
+		if got, want := fn(unsafe.Pointer(p.Pointer())), rv.IsZero(); got != want {
+			t.Errorf("%#v: got %t, want %t", v, got, want)
+		}
+	}
+}
+
 // TestStructFieldOmitnil tests that the fields of a
 // struct with the omitnil option are not encoded
 // when they have a nil value.
@@ -1301,6 +1801,169 @@ func TestRecursiveType(t *testing.T) {
 	marshalCompare(t, xx, "")
 }
 
+// TestMaxDepth tests that the encoding fails with
+// ErrMaxDepthExceeded when the values are nested
+// deeper than the limit set with the MaxDepth option,
+// which stops the cycles of pointers, maps and slices.
+func TestMaxDepth(t *testing.T) {
+	type x struct {
+		A string `json:"a"`
+		X *x     `json:"x,omitempty"`
+		M map[string]interface{}
+	}
+	xx := &x{A: "A1", X: &x{A: "A2"}}
+
+	b, err := MarshalOpts(xx, MaxDepth(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"a":"A1","x":{"a":"A2","M":null},"M":null}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	if _, err := MarshalOpts(xx, MaxDepth(1)); err != ErrMaxDepthExceeded {
+		t.Errorf("got %v, want %v", err, ErrMaxDepthExceeded)
+	}
+	// Pointer cycles.
+	cyclic := &x{A: "A"}
+	cyclic.X = cyclic
+	if _, err := MarshalOpts(cyclic, MaxDepth(100)); err != ErrMaxDepthExceeded {
+		t.Errorf("got %v, want %v", err, ErrMaxDepthExceeded)
+	}
+	m := map[string]interface{}{}
+	m["m"] = []interface{}{m}
+	for _, opt := range []Option{nil, UnsortedMap()} {
+		opts := []Option{MaxDepth(10)}
+		if opt != nil {
+			opts = append(opts, opt)
+		}
+		if _, err := MarshalOpts(m, opts...); err != ErrMaxDepthExceeded {
+			t.Errorf("got %v, want %v", err, ErrMaxDepthExceeded)
+		}
+	}
+	if _, err := MarshalOpts(xx, MaxDepth(0)); err == nil {
+		t.Error("expected non-nil error")
+	}
+}
+
+// TestTimeout tests that the encoding of a value fails
+// with a DeadlineError once the duration set with the
+// Timeout option, or the deadline of the context, elapsed.
+func TestTimeout(t *testing.T) {
+	v := make([][]int, 1<<16)
+	for i := range v {
+		v[i] = []int{i}
+	}
+	_, err := MarshalOpts(v, Timeout(time.Nanosecond))
+	if err == nil {
+		t.Fatal("expected non-nil error")
+	}
+	var derr *DeadlineError
+	if !errors.As(err, &derr) {
+		t.Fatalf("got %T, want *DeadlineError", err)
+	}
+	if derr.Timeout != time.Nanosecond {
+		t.Errorf("got timeout %s, want %s", derr.Timeout, time.Nanosecond)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected error to wrap context.DeadlineExceeded")
+	}
+	// The earliest of the two deadlines applies.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	_, err = MarshalOpts(v, Timeout(time.Hour), WithContext(ctx))
+	if !errors.As(err, &derr) {
+		t.Fatalf("got %v, want *DeadlineError", err)
+	}
+	b, err := MarshalOpts(v[:2], Timeout(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `[[0],[1]]`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestDetectCycles tests that the cycles of pointers,
+// maps and slices are reported with a CycleError with
+// the DetectCycles option, and that the values shared
+// by several paths outside of a cycle are encoded.
+func TestDetectCycles(t *testing.T) {
+	type x struct {
+		A string `json:"a"`
+		X *x     `json:"x,omitempty"`
+		Y *x     `json:"y,omitempty"`
+	}
+	ptr := &x{A: "A1"}
+	ptr.X = &x{A: "A2", X: ptr}
+
+	m := map[string]interface{}{}
+	m["m"] = m
+
+	s := []interface{}{nil}
+	s[0] = s
+
+	for _, v := range []struct {
+		v   interface{}
+		typ string
+	}{
+		{ptr, "*jettison.x"},
+		{m, "map[string]interface {}"},
+		{s, "[]interface {}"},
+	} {
+		for _, opts := range [][]Option{
+			{DetectCycles()},
+			{DetectCycles(), UnsortedMap()},
+		} {
+			_, err := MarshalOpts(v.v, opts...)
+			if !errors.Is(err, ErrCycleDetected) {
+				t.Fatalf("got %v, want %v", err, ErrCycleDetected)
+			}
+			var cerr *CycleError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("got %T, want %T", err, cerr)
+			}
+			if got := cerr.Type.String(); got != v.typ {
+				t.Errorf("got %s, want %s", got, v.typ)
+			}
+		}
+	}
+	// Values reachable from several paths,
+	// that aren't part of a cycle.
+	shared := &x{A: "S"}
+	sm := map[string]int{"k": 1}
+	ss := []int{1, 2, 3}
+	for _, v := range []interface{}{
+		&x{A: "A", X: shared, Y: shared},
+		[]interface{}{sm, sm, ss, ss, ss[:2], shared, shared},
+		[]*x{shared, shared},
+	} {
+		b, err := MarshalOpts(v, DetectCycles())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want) {
+			t.Errorf("got %#q, want %#q", b, want)
+		}
+	}
+	// A pointer to a struct, and another one
+	// to its first field, have the same address.
+	type y struct {
+		X x
+		P *x
+	}
+	yy := &y{X: x{A: "X"}}
+	yy.P = &yy.X
+	if _, err := MarshalOpts(yy, DetectCycles()); err != nil {
+		t.Error(err)
+	}
+}
+
 // TestTaggedFieldDominates tests that a struct
 // field with a tag dominates untagged fields.
 func TestTaggedFieldDominates(t *testing.T) {
@@ -1767,6 +2430,7 @@ func TestStringEscaping(t *testing.T) {
 	}{
 		{b, `"A\u0001\u0002\u0003\"\\/\u0008\u000c\n\r\tǣ\u2028\u2029"`, nil, true},
 		{b, `"` + string(b) + `"`, NoStringEscaping(), false},
+		{b, `"A\u0001\u0002\u0003\"\\/\u0008\u000c\n\r\t\u01e3\u2028\u2029"`, EscapeAllNonASCII(), false},
 	}
 	for _, tt := range testdata {
 		b, err := MarshalOpts(string(tt.b), tt.opt)
@@ -1790,39 +2454,154 @@ func TestStringEscaping(t *testing.T) {
 	}
 }
 
-// TestStringHTMLEscaping tests that HTML characters
-// are properly escaped when a string is marshaled.
-func TestStringHTMLEscaping(t *testing.T) {
-	htmlChars := []byte{'<', '>', '&'}
+// TestEscapeAllNonASCII tests that the non-ASCII runes
+// of the strings, keys and raw byte slices are escaped
+// with the EscapeAllNonASCII option, using surrogate
+// pairs outside of the BMP, and decode to the originals.
+func TestEscapeAllNonASCII(t *testing.T) {
+	type x struct {
+		A string         `json:"clé"`
+		M map[string]int `json:"m"`
+		B []byte         `json:"b"`
+	}
 	testdata := []struct {
-		b    []byte
-		s    string
+		v    interface{}
 		opts []Option
+		want string
 	}{
-		{htmlChars, `"\u003c\u003e\u0026"`, nil},
-		{htmlChars, `"<>&"`, []Option{NoHTMLEscaping()}},
-
-		// NoHTMLEscaping is ignored when NoStringEscaping
-		// is set, because it's part of the escaping options.
-		{htmlChars, `"<>&"`, []Option{NoStringEscaping()}},
-		{htmlChars, `"<>&"`, []Option{NoStringEscaping(), NoHTMLEscaping()}},
+		{"héllo", nil, `"h\u00e9llo"`},
+		{"日本", nil, `"\u65e5\u672c"`},
+		{"😀", nil, `"\ud83d\ude00"`},
+		{"a\x7fb", nil, `"a\u007fb"`},
+		{"a\xffb", nil, `"a\ufffdb"`},
+		// The invalid bytes are replaced even
+		// with the NoUTF8Coercion option.
+		{"a\xffb", []Option{NoUTF8Coercion()}, `"a\ufffdb"`},
+		{"\xff<\x7f", []Option{NoUTF8Coercion(), NoHTMLEscaping()}, `"\ufffd<\u007f"`},
+		{"<é>", []Option{NoHTMLEscaping()}, `"<\u00e9>"`},
+		{"<é>", nil, `"\u003c\u00e9\u003e"`},
+		{
+			x{A: "ü", M: map[string]int{"ñ": 1}, B: []byte("ø")},
+			[]Option{RawByteSlice()},
+			`{"cl\u00e9":"\u00fc","m":{"\u00f1":1},"b":"\u00f8"}`,
+		},
+		// Ignored with NoStringEscaping.
+		{x{A: "ü"}, []Option{NoStringEscaping()}, `{"clé":"ü","m":null,"b":null}`},
 	}
-	for _, tt := range testdata {
-		b, err := MarshalOpts(string(tt.b), tt.opts...)
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, append(v.opts, EscapeAllNonASCII())...)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		if s := string(b); s != tt.s {
-			t.Errorf("got %#q, want %#q", s, tt.s)
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
 		}
 	}
-}
-
-// TestStringUTF8Coercion tests that invalid bytes
-// are replaced by the Unicode replacement rune when
-// a string is marshaled.
-func TestStringUTF8Coercion(t *testing.T) {
-	utf8Seq := string([]byte{'H', 'e', 'l', 'l', 'o', ',', ' ', 0xff, 0xfe, 0xff})
+	// The escaped strings decode to the
+	// original ones.
+	for _, s := range []string{"héllo wörld", "日本語", "😀 and 𝄞", "\u2028"} {
+		b, err := MarshalOpts(s, EscapeAllNonASCII())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range b {
+			if c >= utf8.RuneSelf {
+				t.Errorf("non-ASCII byte in output %#q", b)
+				break
+			}
+		}
+		var got string
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != s {
+			t.Errorf("got %q, want %q", got, s)
+		}
+	}
+}
+
+// TestEscapeForwardSlash tests that the solidus of the
+// strings and keys is escaped with the option
+// EscapeForwardSlash, along with the other escapes,
+// and that it isn't escaped by default.
+func TestEscapeForwardSlash(t *testing.T) {
+	type x struct {
+		A string            `json:"a/b"`
+		M map[string]string `json:"m"`
+	}
+	testdata := []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{"</script>", nil, `"\u003c\/script\u003e"`},
+		{"</script>", []Option{NoHTMLEscaping()}, `"<\/script>"`},
+		{"a/\xff/é", []Option{EscapeAllNonASCII()}, `"a\/\ufffd\/\u00e9"`},
+		{"a/\xff", []Option{NoUTF8Coercion()}, "\"a\\/\xff\""},
+		{"a/\xff", nil, `"a\/\ufffd"`},
+		{
+			x{A: "https://é.com", M: map[string]string{"/": "/"}}, nil,
+			`{"a\/b":"https:\/\/é.com","m":{"\/":"\/"}}`,
+		},
+		{
+			x{A: "é/"}, []Option{EscapeAllNonASCII()},
+			`{"a\/b":"\u00e9\/","m":null}`,
+		},
+		// Ignored with NoStringEscaping.
+		{x{A: "/"}, []Option{NoStringEscaping()}, `{"a/b":"/","m":null}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, append(v.opts, EscapeForwardSlash())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// Off by default, like the standard library.
+	b, err := MarshalOpts("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `"a/b"`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestStringHTMLEscaping tests that HTML characters
+// are properly escaped when a string is marshaled.
+func TestStringHTMLEscaping(t *testing.T) {
+	htmlChars := []byte{'<', '>', '&'}
+	testdata := []struct {
+		b    []byte
+		s    string
+		opts []Option
+	}{
+		{htmlChars, `"\u003c\u003e\u0026"`, nil},
+		{htmlChars, `"<>&"`, []Option{NoHTMLEscaping()}},
+
+		// NoHTMLEscaping is ignored when NoStringEscaping
+		// is set, because it's part of the escaping options.
+		{htmlChars, `"<>&"`, []Option{NoStringEscaping()}},
+		{htmlChars, `"<>&"`, []Option{NoStringEscaping(), NoHTMLEscaping()}},
+	}
+	for _, tt := range testdata {
+		b, err := MarshalOpts(string(tt.b), tt.opts...)
+		if err != nil {
+			t.Error(err)
+		}
+		if s := string(b); s != tt.s {
+			t.Errorf("got %#q, want %#q", s, tt.s)
+		}
+	}
+}
+
+// TestStringUTF8Coercion tests that invalid bytes
+// are replaced by the Unicode replacement rune when
+// a string is marshaled.
+func TestStringUTF8Coercion(t *testing.T) {
+	utf8Seq := string([]byte{'H', 'e', 'l', 'l', 'o', ',', ' ', 0xff, 0xfe, 0xff})
 	testdata := []struct {
 		b   string
 		s   string
@@ -2020,3 +2799,3933 @@ func TestIssue5(t *testing.T) {
 		t.Errorf("got %s, want %s,", string(b), string(want))
 	}
 }
+
+// TestOutputTransform tests that the function set with
+// the OutputTransform option is applied to the complete
+// output of MarshalOpts and AppendOpts.
+func TestOutputTransform(t *testing.T) {
+	upper := OutputTransform(func(b []byte) ([]byte, error) {
+		return bytes.ToUpper(b), nil
+	})
+	type x struct {
+		A string `json:"a"`
+	}
+	b, err := MarshalOpts(x{A: "loreum"}, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"A":"LOREUM"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	b, err = AppendOpts([]byte("ipsum "), nil, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `ipsum NULL`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	errTransform := errors.New("transform error")
+
+	_, err = MarshalOpts(x{}, OutputTransform(func([]byte) ([]byte, error) {
+		return nil, errTransform
+	}))
+	if err != errTransform {
+		t.Errorf("got %v, want %v", err, errTransform)
+	}
+}
+
+// TestWithMapKeys tests that only the map entries
+// whose key is part of the list set with the option
+// WithMapKeys are encoded.
+func TestWithMapKeys(t *testing.T) {
+	var sm sync.Map
+	sm.Store("b", 2)
+	sm.Store("c", 3)
+	sm.Store("a", 1)
+
+	opt := WithMapKeys([]string{"a", "c", "z", "42"})
+
+	for _, v := range []interface{}{
+		map[string]int{"c": 3, "b": 2, "a": 1},
+		map[string]interface{}{"c": 3, "b": 2, "a": 1, "d": map[string]int{"a": 1, "b": 2}},
+		&sm,
+	} {
+		for _, unsorted := range []bool{false, true} {
+			opts := []Option{opt}
+			if unsorted {
+				opts = append(opts, UnsortedMap())
+			}
+			b, err := MarshalOpts(v, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := make(map[string]interface{})
+			if err := json.Unmarshal(b, &m); err != nil {
+				t.Fatal(err)
+			}
+			if len(m) != 2 || m["a"] == nil || m["c"] == nil {
+				t.Errorf("unexpected map entries: %s", b)
+			}
+		}
+	}
+	b, err := MarshalOpts(map[int]string{1: "a", 42: "b", 3: "c"}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"42":"b"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	b, err = MarshalOpts(map[string]string{"x": "y"}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// The keys are compared to the text of the
+	// map keys, before their characters are escaped.
+	m := map[string]int{"<a>": 1, "b&c": 2, "é": 3, "d": 4}
+	for _, opts := range [][]Option{
+		nil,
+		{UnsortedMap()},
+		{EscapeAllNonASCII()},
+	} {
+		opts = append(opts, WithMapKeys([]string{"<a>", "b&c", "é"}))
+		b, err := MarshalOpts(m, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]int
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]int{"<a>": 1, "b&c": 2, "é": 3}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+type strError struct{ msg string }
+
+func (e strError) Error() string { return e.msg }
+
+// TestErrorAsString tests the encoding of error
+// values, with and without the options ErrorAsString
+// and NilErrorAsEmptyObject.
+func TestErrorAsString(t *testing.T) {
+	type x struct {
+		A error `json:"a"`
+		B error `json:"b,omitempty"`
+		C error `json:"c"`
+		D error `json:"d,omitempty"`
+		E *strError
+		F strError
+	}
+	xx := x{
+		C: errors.New("<boom>"),
+		D: strError{"bam"},
+		F: strError{"bim"},
+	}
+	marshalCompare(t, xx, "")
+
+	testdata := []struct {
+		opts []Option
+		want string
+	}{
+		{
+			nil,
+			`{"a":null,"c":{},"d":{},"E":null,"F":{}}`,
+		},
+		{
+			[]Option{ErrorAsString()},
+			`{"a":null,"c":"\u003cboom\u003e","d":"bam","E":null,"F":"bim"}`,
+		},
+		{
+			[]Option{ErrorAsString(), NilErrorAsEmptyObject()},
+			`{"a":{},"c":"\u003cboom\u003e","d":"bam","E":null,"F":"bim"}`,
+		},
+		{
+			[]Option{NilErrorAsEmptyObject()},
+			`{"a":{},"c":{},"d":{},"E":null,"F":{}}`,
+		},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(xx, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	b, err := MarshalOpts(errors.New("boom"), ErrorAsString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `"boom"`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestByteSliceFieldFormat tests that the format
+// of byte slice struct fields can be chosen with
+// the raw, hex and base64 options of their tag,
+// independently of the RawByteSlice option.
+func TestByteSliceFieldFormat(t *testing.T) {
+	type bs []byte
+	type x struct {
+		A []byte `json:"a"`
+		B []byte `json:"b,raw"`
+		C []byte `json:"c,hex"`
+		D []byte `json:"d,base64"`
+		E bs     `json:"e,hex"`
+		F []byte `json:"f,hex"`
+		G []byte `json:"g,raw,omitempty"`
+	}
+	xx := x{
+		A: []byte("a!"),
+		B: []byte("b!"),
+		C: []byte("c!"),
+		D: []byte("d!"),
+		E: []byte{0xde, 0xad, 0xbe, 0xef},
+	}
+	testdata := []struct {
+		opts []Option
+		want string
+	}{
+		{
+			nil,
+			`{"a":"YSE=","b":"b!","c":"6321","d":"ZCE=","e":"deadbeef","f":null}`,
+		},
+		{
+			[]Option{RawByteSlice()},
+			`{"a":"a!","b":"b!","c":"6321","d":"ZCE=","e":"deadbeef","f":null}`,
+		},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(xx, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// Top-level byte slices are not affected.
+	marshalCompare(t, []byte("a!"), "")
+}
+
+type invalidJSONMarshaler struct{}
+
+func (invalidJSONMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`{"a":}`), nil
+}
+
+// TestValidateOutput tests that an invalid output
+// is reported when the ValidateOutput option is used.
+func TestValidateOutput(t *testing.T) {
+	v := []interface{}{1, invalidJSONMarshaler{}}
+
+	b, err := MarshalOpts(v, NoCompact())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `[1,{"a":}]`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	_, err = MarshalOpts(v, NoCompact(), ValidateOutput())
+	if err == nil {
+		t.Fatal("expected non-nil error")
+	}
+	if _, ok := err.(*SyntaxError); !ok {
+		t.Errorf("got %T, want *jettison.SyntaxError", err)
+	}
+	b, err = AppendOpts([]byte("ipsum "), v, NoCompact(), ValidateOutput())
+	if err == nil {
+		t.Fatal("expected non-nil error")
+	}
+	if got, want := string(b), "ipsum "; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	b, err = MarshalOpts([]int{1, 2}, ValidateOutput())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `[1,2]`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestTrustTemplateTypes tests that the content of
+// the string types of the html/template package is
+// not HTML-escaped with the TrustTemplateTypes option.
+func TestTrustTemplateTypes(t *testing.T) {
+	type x struct {
+		H template.HTML `json:"h"`
+		S string        `json:"s"`
+	}
+	xx := x{H: "<b>", S: "<b>"}
+
+	testdata := []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{xx, nil, `{"h":"\u003cb\u003e","s":"\u003cb\u003e"}`},
+		{xx, []Option{TrustTemplateTypes()}, `{"h":"<b>","s":"\u003cb\u003e"}`},
+		{
+			[]interface{}{template.JS("a<b"), template.CSS("a>b")},
+			[]Option{TrustTemplateTypes()},
+			`["a<b","a>b"]`,
+		},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	marshalCompare(t, xx, "")
+}
+
+// TestHypermediaLinks tests that the links returned by
+// the function set with the HypermediaLinks option are
+// added to the output of top-level structs only.
+func TestHypermediaLinks(t *testing.T) {
+	type (
+		x struct {
+			ID int `json:"id"`
+		}
+		y struct {
+			Links string `json:"_links"`
+		}
+		z struct{}
+	)
+	opt := HypermediaLinks(func(v interface{}) map[string]string {
+		if xx, ok := v.(*x); ok && xx.ID == 0 {
+			return nil
+		}
+		return map[string]string{
+			"self": "/x/1",
+			"next": "/x/2?a=1&b=2",
+		}
+	})
+	testdata := []struct {
+		v    interface{}
+		want string
+	}{
+		{x{ID: 1}, `{"id":1,"_links":{"next":"/x/2?a=1\u0026b=2","self":"/x/1"}}`},
+		{&x{ID: 1}, `{"id":1,"_links":{"next":"/x/2?a=1\u0026b=2","self":"/x/1"}}`},
+		{&x{}, `{"id":0}`},
+		{(*x)(nil), `null`},
+		{z{}, `{"_links":{"next":"/x/2?a=1\u0026b=2","self":"/x/1"}}`},
+		{y{Links: "none"}, `{"_links":"none"}`},
+		{[]x{{ID: 1}}, `[{"id":1}]`},
+		{map[string]int{"a": 1}, `{"a":1}`},
+		{nil, `null`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+}
+
+type decimal struct {
+	units int64
+	scale int
+}
+
+func (d decimal) MarshalText() ([]byte, error) {
+	s := strconv.FormatInt(d.units, 10)
+	if d.scale == 0 {
+		return []byte(s), nil
+	}
+	i := len(s) - d.scale
+	return []byte(s[:i] + "." + s[i:]), nil
+}
+
+type badDecimal string
+
+func (d *badDecimal) MarshalText() ([]byte, error) { return []byte(*d), nil }
+
+// TestTextMarshalerAsNumber tests that the values
+// of a type registered with TextMarshalerAsNumber
+// are encoded as JSON numbers.
+func TestTextMarshalerAsNumber(t *testing.T) {
+	type x struct {
+		A decimal  `json:"a"`
+		B *decimal `json:"b"`
+		C *decimal `json:"c"`
+		D []decimal
+		E map[decimal]decimal
+	}
+	xx := x{
+		A: decimal{1234, 2},
+		B: &decimal{-5, 0},
+		D: []decimal{{15, 1}, {10, 1}},
+		E: map[decimal]decimal{{42, 1}: {42, 0}},
+	}
+	b, err := Marshal(xx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":"12.34","b":"-5","c":null,"D":["1.5","1.0"],"E":{"4.2":"42"}}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	TextMarshalerAsNumber(reflect.TypeOf(decimal{}))
+
+	b, err = Marshal(xx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"a":12.34,"b":-5,"c":null,"D":[1.5,1.0],"E":{"4.2":42}}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	TextMarshalerAsNumber(reflect.TypeOf((*badDecimal)(nil)))
+
+	bd := badDecimal("1.2.3")
+	_, err = Marshal(&bd)
+	if err == nil {
+		t.Fatal("expected non-nil error")
+	}
+	if _, ok := err.(*MarshalerError); !ok {
+		t.Errorf("got %T, want *jettison.MarshalerError", err)
+	}
+	b, err = MarshalOpts(&bd, NoNumberValidation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `1.2.3`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestMaxInterfaceDepth tests that the dynamic values
+// of nested interfaces are truncated beyond the limit
+// set with the MaxInterfaceDepth option.
+func TestMaxInterfaceDepth(t *testing.T) {
+	var sm sync.Map
+	sm.Store("a", map[string]interface{}{"b": 1})
+
+	m := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": []interface{}{1, map[string]interface{}{"c": "d"}},
+		},
+		"e": 1,
+		"f": nil,
+		"g": &sm,
+	}
+	testdata := []struct {
+		n    int
+		want string
+	}{
+		{1, `{"a":{"b":"<truncated>"},"e":1,"f":null,"g":{"a":"<truncated>"}}`},
+		{2, `{"a":{"b":["<truncated>","<truncated>"]},"e":1,"f":null,"g":{"a":{"b":"<truncated>"}}}`},
+		{3, `{"a":{"b":[1,{"c":"<truncated>"}]},"e":1,"f":null,"g":{"a":{"b":1}}}`},
+		{4, `{"a":{"b":[1,{"c":"d"}]},"e":1,"f":null,"g":{"a":{"b":1}}}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(m, MaxInterfaceDepth(v.n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("n=%d: got %#q, want %#q", v.n, got, v.want)
+		}
+	}
+	_, err := MarshalOpts(m, MaxInterfaceDepth(0))
+	if err == nil {
+		t.Fatal("expected non-nil error")
+	}
+	if _, ok := err.(*InvalidOptionError); !ok {
+		t.Errorf("got %T, want *jettison.InvalidOptionError", err)
+	}
+}
+
+// TestBigInt tests that big.Int values are encoded
+// like with their MarshalJSON method.
+func TestBigInt(t *testing.T) {
+	type x struct {
+		A big.Int
+		B *big.Int
+		C *big.Int `json:",omitempty"`
+		D []big.Int
+		E []*big.Int
+		F map[string]*big.Int
+	}
+	huge, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+
+	xx := x{
+		A: *big.NewInt(42),
+		B: huge,
+		D: []big.Int{*big.NewInt(0), *huge},
+		E: []*big.Int{nil, big.NewInt(-1), huge},
+		F: map[string]*big.Int{"a": huge, "b": nil},
+	}
+	marshalCompare(t, xx, "non-pointer")
+	marshalCompare(t, &xx, "pointer")
+	marshalCompare(t, huge, "top-level pointer")
+	marshalCompare(t, *huge, "top-level non-pointer")
+}
+
+type emptyText struct{}
+
+func (emptyText) MarshalText() ([]byte, error) { return nil, nil }
+
+// TestRejectEmptyMapKeys tests that an error is
+// returned for map keys with an empty representation
+// when the RejectEmptyMapKeys option is used.
+func TestRejectEmptyMapKeys(t *testing.T) {
+	var sm sync.Map
+	sm.Store("", 1)
+
+	for _, v := range []interface{}{
+		map[string]int{"a": 1, "": 2},
+		map[emptyText]int{{}: 1},
+		&sm,
+	} {
+		if _, err := Marshal(v); err != nil {
+			t.Fatal(err)
+		}
+		for _, opt := range []Option{nil, UnsortedMap()} {
+			_, err := MarshalOpts(v, opt, RejectEmptyMapKeys())
+			if err == nil {
+				t.Fatal("expected non-nil error")
+			}
+			if _, ok := err.(*UnsupportedValueError); !ok {
+				t.Errorf("got %T, want *jettison.UnsupportedValueError", err)
+			}
+		}
+	}
+	marshalCompare(t, map[emptyText]int{{}: 1}, "")
+
+	b, err := MarshalOpts(map[string]int{"a": 1}, RejectEmptyMapKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"a":1}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestEncodeToBuilder tests that the JSON representation
+// of a value is written to a strings.Builder, unless an
+// error occurs.
+func TestEncodeToBuilder(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("ipsum ")
+
+	if err := EncodeToBuilder(map[string]int{"a": 1}, &sb, UnsortedMap()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sb.String(), `ipsum {"a":1}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	err := EncodeToBuilder([]interface{}{1, math.NaN()}, &sb)
+	if err == nil {
+		t.Fatal("expected non-nil error")
+	}
+	if _, ok := err.(*UnsupportedValueError); !ok {
+		t.Errorf("got %T, want *jettison.UnsupportedValueError", err)
+	}
+	if got, want := sb.String(), `ipsum {"a":1}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	err = EncodeToBuilder(nil, &sb, TimeLayout(""))
+	if _, ok := err.(*InvalidOptionError); !ok {
+		t.Errorf("got %T, want *jettison.InvalidOptionError", err)
+	}
+}
+
+// TestEncodeCount tests that the JSON representation
+// of a value is written to an io.Writer, and that the
+// number of bytes written is returned.
+func TestEncodeCount(t *testing.T) {
+	var buf bytes.Buffer
+
+	n, err := EncodeCount(map[string]string{"a": "é"}, &buf, Newline())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "{\"a\":\"é\"}\n"; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	if n != buf.Len() {
+		t.Errorf("got %d bytes, want %d", n, buf.Len())
+	}
+	// Nothing is written if the encoding fails.
+	n, err = EncodeCount([]interface{}{1, math.NaN()}, &buf)
+	if _, ok := err.(*UnsupportedValueError); !ok {
+		t.Errorf("got %T, want *jettison.UnsupportedValueError", err)
+	}
+	if l := len(`{"a":"é"}`) + 1; n != 0 || buf.Len() != l {
+		t.Errorf("got %d bytes and a length of %d, want 0 and %d", n, buf.Len(), l)
+	}
+	// The errors of the writer are returned.
+	werr := errors.New("write error")
+	if _, err = EncodeCount(1, failWriter{werr}); err != werr {
+		t.Errorf("got %v, want %v", err, werr)
+	}
+	// A short write without error is reported.
+	n, err = EncodeCount("abc", countWriter(1))
+	if n != 1 || err != io.ErrShortWrite {
+		t.Errorf("got (%d, %v), want (1, %v)", n, err, io.ErrShortWrite)
+	}
+	// The count is that of the output only.
+	n, err = EncodeCount("abc", countWriter(10))
+	if n != 5 || err != nil {
+		t.Errorf("got (%d, %v), want (5, <nil>)", n, err)
+	}
+}
+
+// TestKeyPrefix tests that the prefix set with the
+// KeyPrefix option is added to the keys of the fields
+// of the top-level struct only, and to the keys of the
+// top-level map with the PrefixMapKeys option.
+func TestKeyPrefix(t *testing.T) {
+	type (
+		y struct {
+			C int `json:"c"`
+		}
+		x struct {
+			A int            `json:"a"`
+			B y              `json:"b"`
+			M map[string]int `json:"m"`
+			S []y            `json:"s"`
+		}
+	)
+	xx := x{A: 1, M: map[string]int{"d": 2}, S: []y{{}}}
+
+	var sm sync.Map
+	sm.Store("z", 1)
+	sm.Store("a", 2)
+
+	testdata := []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{xx, nil, `{"app_a":1,"app_b":{"c":0},"app_m":{"d":2},"app_s":[{"c":0}]}`},
+		{&xx, []Option{PrefixMapKeys()}, `{"app_a":1,"app_b":{"c":0},"app_m":{"d":2},"app_s":[{"c":0}]}`},
+		{[]x{{}}, nil, `[{"a":0,"b":{"c":0},"m":null,"s":null}]`},
+		{map[string]y{"b": {}, "a": {}}, nil, `{"a":{"c":0},"b":{"c":0}}`},
+		{map[string]y{"b": {}, "a": {}}, []Option{PrefixMapKeys()}, `{"app_a":{"c":0},"app_b":{"c":0}}`},
+		{map[int]int{2: 1, 10: 2}, []Option{PrefixMapKeys()}, `{"app_10":2,"app_2":1}`},
+		{map[string]int{"a": 1}, []Option{PrefixMapKeys(), UnsortedMap()}, `{"app_a":1}`},
+		{&sm, []Option{PrefixMapKeys()}, `{"app_a":2,"app_z":1}`},
+		{map[string]int{"a": 1}, []Option{PrefixMapKeys(), KeyPrefix("<")}, `{"\u003ca":1}`},
+		{map[string]int{"a": 1}, []Option{PrefixMapKeys(), WithMapKeys([]string{"a"})}, `{"app_a":1}`},
+	}
+	for _, v := range testdata {
+		opts := append([]Option{KeyPrefix("app_")}, v.opts...)
+		b, err := MarshalOpts(v.v, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	var sm2 sync.Map
+	sm2.Store("a", 1)
+
+	b, err := MarshalOpts(&sm2, KeyPrefix("app_"), PrefixMapKeys(), UnsortedMap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"app_a":1}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+type codeError struct{ code int }
+
+func (e codeError) Error() string { return "code " + strconv.Itoa(e.code) }
+
+func (e codeError) MarshalJSON() ([]byte, error) {
+	return []byte(`{"code":` + strconv.Itoa(e.code) + `}`), nil
+}
+
+// TestErrorAsStringMarshalerPrecedence tests that the
+// ErrorAsString option doesn't apply to errors which
+// implement the json.Marshaler interface.
+func TestErrorAsStringMarshalerPrecedence(t *testing.T) {
+	type x struct {
+		A error `json:"a"`
+		B error `json:"b"`
+		C codeError
+		D *codeError
+	}
+	xx := x{
+		A: codeError{500},
+		B: strError{"boom"},
+		C: codeError{404},
+		D: &codeError{418},
+	}
+	b, err := MarshalOpts(xx, ErrorAsString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":{"code":500},"b":"boom","C":{"code":404},"D":{"code":418}}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	b, err = MarshalOpts(error(codeError{500}), ErrorAsString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"code":500}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+type (
+	binm   [4]byte
+	binpm  struct{ B []byte }
+	bintm  [2]byte
+	binerr struct{}
+)
+
+func (m binm) MarshalBinary() ([]byte, error)   { return m[:], nil }
+func (m *binpm) MarshalBinary() ([]byte, error) { return m.B, nil }
+func (m bintm) MarshalBinary() ([]byte, error)  { return m[:], nil }
+func (m bintm) MarshalText() ([]byte, error)    { return []byte("text"), nil }
+func (binerr) MarshalBinary() ([]byte, error)   { return nil, errMarshaler }
+
+// TestBinaryMarshalerAsBase64 tests that the values of
+// types that implement the encoding.BinaryMarshaler
+// interface are encoded as base64 strings with the
+// BinaryMarshalerAsBase64 option.
+func TestBinaryMarshalerAsBase64(t *testing.T) {
+	type x struct {
+		A binm   `json:"a"`
+		B *binm  `json:"b"`
+		C *binm  `json:"c"`
+		D binpm  `json:"d"`
+		E *binpm `json:"e"`
+		F bintm  `json:"f"`
+	}
+	xx := &x{
+		A: binm{0xfb, 0xff, 0xbf, 0x01},
+		C: &binm{1, 2, 3, 4},
+		D: binpm{[]byte("Loreum")},
+		F: bintm{1, 2},
+	}
+	b, err := MarshalOpts(xx, BinaryMarshalerAsBase64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":"+/+/AQ==","b":null,"c":"AQIDBA==","d":"TG9yZXVt","e":null,"f":"text"}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// The base64 encoding is configurable.
+	b, err = MarshalOpts(xx.A, BinaryMarshalerAsBase64(), Base64URLNoPad())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `"-_-_AQ"`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Without the option, the values are
+	// encoded like the encoding/json package.
+	marshalCompare(t, xx, "")
+
+	_, err = MarshalOpts(binerr{}, BinaryMarshalerAsBase64())
+	me, ok := err.(*MarshalerError)
+	if !ok {
+		t.Fatalf("got %T, want *jettison.MarshalerError", err)
+	}
+	if me.Err != errMarshaler {
+		t.Errorf("got %v, want %v", me.Err, errMarshaler)
+	}
+}
+
+type (
+	valuerm   string
+	valuerpm  struct{ n int }
+	valuererr struct{}
+)
+
+func (m valuerm) Value() (driver.Value, error) {
+	if m == "" {
+		return nil, nil
+	}
+	return string(m), nil
+}
+func (m *valuerpm) Value() (driver.Value, error) { return int64(m.n), nil }
+func (valuererr) Value() (driver.Value, error)   { return nil, errMarshaler }
+
+// TestSQLNull tests that the values of types that
+// implement the driver.Valuer interface are encoded
+// with the result of their Value method with the
+// SQLNull option.
+func TestSQLNull(t *testing.T) {
+	type x struct {
+		A sql.NullString  `json:"a"`
+		B sql.NullString  `json:"b"`
+		C sql.NullInt64   `json:"c"`
+		D sql.NullInt64   `json:"d"`
+		E sql.NullFloat64 `json:"e"`
+		F sql.NullBool    `json:"f"`
+		G sql.NullTime    `json:"g"`
+		H sql.NullTime    `json:"h"`
+		I *sql.NullString `json:"i"`
+		J valuerm         `json:"j"`
+		K valuerm         `json:"k"`
+		L valuerpm        `json:"l"`
+		M []sql.NullInt32 `json:"m"`
+	}
+	xx := &x{
+		A: sql.NullString{String: "Loreum", Valid: true},
+		B: sql.NullString{String: "ignored"},
+		C: sql.NullInt64{Int64: 42, Valid: true},
+		E: sql.NullFloat64{Float64: 3.14, Valid: true},
+		F: sql.NullBool{Bool: false, Valid: true},
+		G: sql.NullTime{Time: time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC), Valid: true},
+		J: valuerm("ipsum"),
+		L: valuerpm{n: 7},
+		M: []sql.NullInt32{{Int32: 1, Valid: true}, {}},
+	}
+	b, err := MarshalOpts(xx, SQLNull())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":"Loreum","b":null,"c":42,"d":null,"e":3.14,"f":false,` +
+		`"g":"2021-03-01T12:00:00Z","h":null,"i":null,"j":"ipsum","k":null,"l":7,"m":[1,null]}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Without the option, the values are
+	// encoded like the encoding/json package.
+	marshalCompare(t, xx, "")
+
+	_, err = MarshalOpts(valuererr{}, SQLNull())
+	me, ok := err.(*MarshalerError)
+	if !ok {
+		t.Fatalf("got %T, want *jettison.MarshalerError", err)
+	}
+	if me.Err != errMarshaler {
+		t.Errorf("got %v, want %v", me.Err, errMarshaler)
+	}
+}
+
+type textBlob struct {
+	Text string
+	wrap func(io.Reader) io.Reader
+}
+
+func (tb *textBlob) JSONStringReader() io.Reader {
+	if tb.wrap == nil {
+		return nil
+	}
+	return tb.wrap(strings.NewReader(tb.Text))
+}
+
+// TestStreamStringReaders tests that the values of
+// types that implement the StringReader interface
+// are encoded as JSON strings with the text of their
+// reader, escaped by chunks, with the option
+// StreamStringReaders, and that a reader which
+// makes no progress, or fails, returns an error.
+func TestStreamStringReaders(t *testing.T) {
+	text := strings.Repeat("Lo\"re\\um\n<ipsum> é€😀 \x00 ", 300) + "\xff\xfe end 😀"
+	if len(text) <= stringReaderChunkSize {
+		t.Fatal("text must span several chunks")
+	}
+	want, err := json.Marshal(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, wrap := range map[string]func(io.Reader) io.Reader{
+		"full":     func(r io.Reader) io.Reader { return r },
+		"onebyte":  iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"dataerr":  iotest.DataErrReader,
+		"multiple": func(r io.Reader) io.Reader { return io.MultiReader(r, strings.NewReader("")) },
+	} {
+		b, err := MarshalOpts(&textBlob{Text: text, wrap: wrap}, StreamStringReaders())
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !bytes.Equal(b, want) {
+			t.Errorf("%s: got %#q, want %#q", name, b, want)
+		}
+	}
+	// Nil reader.
+	b, err := MarshalOpts(&textBlob{Text: text}, StreamStringReaders())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `null`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Without the option, the values are
+	// encoded like the encoding/json package.
+	marshalCompare(t, &textBlob{Text: "Loreum"}, "")
+
+	_, err = MarshalOpts(&textBlob{Text: text, wrap: iotest.TimeoutReader}, StreamStringReaders())
+	me, ok := err.(*MarshalerError)
+	if !ok {
+		t.Fatalf("got %T, want *jettison.MarshalerError", err)
+	}
+	if me.Err != iotest.ErrTimeout {
+		t.Errorf("got %v, want %v", me.Err, iotest.ErrTimeout)
+	}
+	empty := func(io.Reader) io.Reader { return emptyReader{} }
+
+	_, err = MarshalOpts(&textBlob{Text: text, wrap: empty}, StreamStringReaders())
+	me, ok = err.(*MarshalerError)
+	if !ok {
+		t.Fatalf("got %T, want *jettison.MarshalerError", err)
+	}
+	if me.Err != io.ErrNoProgress {
+		t.Errorf("got %v, want %v", me.Err, io.ErrNoProgress)
+	}
+}
+
+// emptyReader is an io.Reader that never
+// returns data nor error.
+type emptyReader struct{}
+
+func (emptyReader) Read([]byte) (int, error) { return 0, nil }
+
+// TestFloatSpecialFieldFormat tests that the NaN and
+// infinite values of float fields are encoded according
+// to the floatnull and floatstr options of their tag.
+func TestFloatSpecialFieldFormat(t *testing.T) {
+	type x struct {
+		A float64  `json:"a,floatnull"`
+		B float32  `json:"b,floatstr"`
+		C *float64 `json:"c,floatstr"`
+		D *float64 `json:"d,floatnull,omitempty"`
+		E float64  `json:"e,floatstr,string"`
+		F float64  `json:"f"`
+	}
+	var (
+		inf  = math.Inf(1)
+		ninf = math.Inf(-1)
+		one  = 1.5
+	)
+	testdata := []struct {
+		v    x
+		want string
+	}{
+		{
+			x{A: math.NaN(), B: float32(inf), C: &ninf, E: math.NaN()},
+			`{"a":null,"b":"+Inf","c":"-Inf","e":"NaN","f":0}`,
+		},
+		{
+			x{A: 1, B: 2, C: &one, D: &one, E: 3},
+			`{"a":1,"b":2,"c":1.5,"d":1.5,"e":"3","f":0}`,
+		},
+	}
+	for _, v := range testdata {
+		b, err := Marshal(v.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// Fields without a tag option still
+	// report the unsupported values.
+	_, err := Marshal(x{F: math.NaN()})
+	if _, ok := err.(*UnsupportedValueError); !ok {
+		t.Errorf("got %T, want *jettison.UnsupportedValueError", err)
+	}
+}
+
+// TestNarrowIntegralFloats tests that the floating-point
+// numbers without a fractional part are encoded as integers
+// with the NarrowIntegralFloats option.
+func TestNarrowIntegralFloats(t *testing.T) {
+	m := map[string]interface{}{
+		"a": 3.0,
+		"b": 3.5,
+		"c": -42.0,
+		"d": math.Copysign(0, -1),
+		"e": float64(1 << 62),
+		"f": 1e19,
+		"g": 1e300,
+		"h": float32(7),
+		"i": 1e-7,
+	}
+	b, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":3,"b":3.5,"c":-42,"d":-0,"e":4611686018427388000,"f":10000000000000000000,"g":1e+300,"h":7,"i":1e-7}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	b, err = MarshalOpts(m, NarrowIntegralFloats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"a":3,"b":3.5,"c":-42,"d":0,"e":4611686018427387904,"f":10000000000000000000,"g":1e+300,"h":7,"i":1e-7}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestEscapingProfile tests that the escaping profiles
+// override the escaping options given before them.
+func TestEscapingProfile(t *testing.T) {
+	var (
+		s      = "<a>\"\xff\u2028"
+		strict = `"\u003ca\u003e\"\ufffd\u2028"`
+		raw    = "\"<a>\\\"\xff\u2028\""
+	)
+	testdata := []struct {
+		opts []Option
+		want string
+	}{
+		{[]Option{EscapingProfile(ProfileStrict)}, strict},
+		{[]Option{NoHTMLEscaping(), EscapingProfile(ProfileStrict)}, strict},
+		{[]Option{NoStringEscaping(), EscapingProfile(ProfileWeb)}, strict},
+		{[]Option{NoStringEscaping(), EscapingProfile(ProfileRaw)}, raw},
+		{[]Option{EscapingProfile(ProfileRaw), NoStringEscaping()}, "\"<a>\"\xff\u2028\""},
+		{[]Option{EscapingProfile(ProfileRaw), EscapingProfile(ProfileStrict)}, strict},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(s, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	marshalCompare(t, s, "")
+
+	// The web profile also escapes the solidus
+	// character, but not all non-ASCII characters.
+	for _, opts := range [][]Option{
+		{EscapingProfile(ProfileWeb)},
+		{NoHTMLEscaping(), EscapeAllNonASCII(), EscapingProfile(ProfileWeb)},
+	} {
+		b, err := MarshalOpts("</a>é\u2028\u2029", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), `"\u003c\/a\u003eé\u2028\u2029"`; got != want {
+			t.Errorf("got %#q, want %#q", got, want)
+		}
+	}
+}
+
+type uuid [16]byte
+
+// TestUUIDArraysAsString tests that the named byte
+// arrays of length 16 are encoded as canonical UUIDs
+// with the UUIDArraysAsString option.
+func TestUUIDArraysAsString(t *testing.T) {
+	type x struct {
+		A uuid     `json:"a"`
+		B *uuid    `json:"b"`
+		C [16]byte `json:"c"`
+		D [2]byte  `json:"d"`
+	}
+	// Output of uuid.MustParse(...).String() with
+	// the github.com/google/uuid package.
+	u := uuid{
+		0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1,
+		0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8,
+	}
+	xx := x{A: u, B: &u, D: [2]byte{'a', 'b'}}
+
+	b, err := MarshalOpts(xx, UUIDArraysAsString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":"6ba7b810-9dad-11d1-80b4-00c04fd430c8","b":"6ba7b810-9dad-11d1-80b4-00c04fd430c8",` +
+		`"c":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0],"d":[97,98]}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	b, err = MarshalOpts(u, UUIDArraysAsString(), ByteArrayAsString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `"6ba7b810-9dad-11d1-80b4-00c04fd430c8"`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	marshalCompare(t, xx, "")
+}
+
+type perm uint8
+
+// TestBitFlagStrings tests that the values of an integer
+// type registered with BitFlagStrings are encoded as the
+// array of the names of the flags set.
+func TestBitFlagStrings(t *testing.T) {
+	type x struct {
+		A perm           `json:"a"`
+		B *perm          `json:"b"`
+		C perm           `json:"c,omitempty"`
+		D map[perm]int   `json:"d"`
+		E []perm         `json:"e"`
+		F map[string]int `json:"f"`
+	}
+	p := perm(3)
+	xx := x{
+		A: 1 | 4 | 32,
+		B: &p,
+		D: map[perm]int{5: 1},
+		E: []perm{0, 7},
+	}
+	BitFlagStrings(reflect.TypeOf(perm(0)), map[uint64]string{
+		1: "READ",
+		2: "WRITE",
+		4: "EXEC",
+		0: "NONE",
+	})
+	testdata := []struct {
+		opts []Option
+		want string
+	}{
+		{
+			nil,
+			`{"a":["READ","EXEC"],"b":["READ","WRITE"],"d":{"5":1},"e":[[],["READ","WRITE","EXEC"]],"f":null}`,
+		},
+		{
+			[]Option{KeepUnknownBitFlags()},
+			`{"a":["READ","EXEC",32],"b":["READ","WRITE"],"d":{"5":1},"e":[[],["READ","WRITE","EXEC"]],"f":null}`,
+		},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(xx, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	b, err := MarshalOpts(perm(255), KeepUnknownBitFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `["READ","WRITE","EXEC",8,16,32,64,128]`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestIndent tests that the output is formatted like
+// json.MarshalIndent does with the Indent option.
+func TestIndent(t *testing.T) {
+	type x struct {
+		B []int          `json:"b"`
+		A map[string]int `json:"a"`
+		C struct{}       `json:"c"`
+		D string         `json:"d"`
+	}
+	xx := x{B: []int{1, 2}, A: map[string]int{"z": 1, "y": 2}, D: "<>"}
+
+	for _, v := range []struct {
+		prefix, indent string
+	}{
+		{"", "  "},
+		{"> ", "\t"},
+		{"", ""},
+	} {
+		b, err := MarshalOpts(xx, Indent(v.prefix, v.indent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := json.MarshalIndent(xx, v.prefix, v.indent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want) {
+			t.Errorf("got %#q, want %#q", b, want)
+		}
+	}
+	b, err := AppendOpts([]byte("ipsum "), []int{1}, Indent("", " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "ipsum [\n 1\n]"; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestGoldenFormat tests that the GoldenFormat option
+// produces an indented output with sorted keys.
+func TestGoldenFormat(t *testing.T) {
+	type (
+		y struct {
+			Z int `json:"z"`
+			A int `json:"a"`
+		}
+		x struct {
+			y
+			M map[string]int `json:"m"`
+			B string         `json:"b"`
+			S []y            `json:"s"`
+		}
+	)
+	xx := x{
+		y: y{Z: 1, A: 2},
+		M: map[string]int{"b": 1, "a": 2},
+		B: "<b>",
+		S: []y{{}},
+	}
+	want := `{
+  "a": 2,
+  "b": "<b>",
+  "m": {
+    "a": 2,
+    "b": 1
+  },
+  "s": [
+    {
+      "a": 0,
+      "z": 0
+    }
+  ],
+  "z": 1
+}`
+	b, err := MarshalOpts(xx, UnsortedMap(), GoldenFormat())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// The order of the fields must
+	// not change without the option.
+	marshalCompare(t, xx, "")
+}
+
+// TestSortKeys tests that the keys of all the objects
+// are sorted with the SortKeys option, at any depth.
+func TestSortKeys(t *testing.T) {
+	type (
+		leaf struct {
+			Zeta  int `json:"zeta"`
+			Alpha int `json:"alpha"`
+		}
+		Embed struct {
+			Mid string `json:"mid"`
+		}
+		node struct {
+			Embed
+			Z  string                 `json:"z"`
+			B  *leaf                  `json:"b"`
+			A  []leaf                 `json:"a"`
+			M  map[string]interface{} `json:"m"`
+			C  interface{}            `json:"c"`
+			AA int                    `json:"aa,omitempty"`
+		}
+	)
+	v := node{
+		Embed: Embed{Mid: "m"},
+		Z:     "z",
+		B:     &leaf{Zeta: 1, Alpha: 2},
+		A:     []leaf{{Zeta: 3}},
+		M: map[string]interface{}{
+			"y": leaf{},
+			"x": map[string]int{"d": 1, "c": 2},
+		},
+		C: &node{Z: "inner", AA: 1},
+	}
+	b, err := MarshalOpts(v, UnsortedMap(), SortKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":[{"alpha":0,"zeta":3}],"b":{"alpha":2,"zeta":1},` +
+		`"c":{"a":null,"aa":1,"b":null,"c":null,"m":null,"mid":"","z":"inner"},` +
+		`"m":{"x":{"c":2,"d":1},"y":{"alpha":0,"zeta":0}},"mid":"m","z":"z"}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// The output is the same as the one of the
+	// standard library for a generic value, whose
+	// maps are always sorted.
+	var iv interface{}
+	if err := json.Unmarshal(b, &iv); err != nil {
+		t.Fatal(err)
+	}
+	canonical, err := json.Marshal(iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, canonical) {
+		t.Errorf("got %#q, want %#q", b, canonical)
+	}
+	// The fields are sorted by their final key.
+	type y struct {
+		E int `json:"é"`
+		Z int `json:"z"`
+		A int `json:"a"`
+	}
+	for _, v := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, `{"a":0,"z":0,"é":0}`},
+		{[]Option{PunycodeKeys()}, `{"a":0,"xn--9ca":0,"z":0}`},
+	} {
+		b, err := MarshalOpts(y{}, append(v.opts, SortKeys(), NoHTMLEscaping())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// The order of the fields must
+	// not change without the option.
+	marshalCompare(t, v, "")
+}
+
+// TestSortStructFields tests that the fields of structs
+// are sorted by their key with the SortStructFields
+// option, and that the keys of maps are not affected.
+func TestSortStructFields(t *testing.T) {
+	type (
+		Embed struct {
+			Mid string `json:"mid"`
+			Ptr *int   `json:"ptr,omitempty"`
+		}
+		node struct {
+			Z string `json:"z"`
+			Embed
+			B int            `json:"b"`
+			M map[string]int `json:"m"`
+			A struct {
+				Y int
+				X int
+			} `json:"a"`
+		}
+	)
+	v := node{
+		Z:     "z",
+		Embed: Embed{Mid: "m", Ptr: new(int)},
+		B:     1,
+		M:     map[string]int{"d": 1, "c": 2},
+	}
+	b, err := MarshalOpts(v, SortStructFields())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":{"X":0,"Y":0},"b":1,"m":{"c":2,"d":1},"mid":"m","ptr":0,"z":"z"}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Unlike SortKeys, the option doesn't
+	// override a previous UnsortedMap option.
+	eo := defaultEncOpts()
+	eo.apply(UnsortedMap(), SortStructFields())
+	if eo.sortedMap() {
+		t.Error("expected unsorted maps")
+	}
+	// The fields are sorted by their final key,
+	// with the names transformed by KeyNamer.
+	type y struct {
+		Zed   int
+		Beta  int
+		Apple int `json:"apple"`
+	}
+	for _, v := range []struct {
+		opts []Option
+		want string
+	}{
+		{[]Option{SnakeCase()}, `{"apple":0,"beta":0,"zed":0}`},
+		{[]Option{SnakeCase(), KeyPrefix("p_")}, `{"p_apple":0,"p_beta":0,"p_zed":0}`},
+		{[]Option{KeyPrefix("p_")}, `{"p_Beta":0,"p_Zed":0,"p_apple":0}`},
+	} {
+		b, err := MarshalOpts(y{}, append(v.opts, SortStructFields())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// The order of the fields must
+	// not change without the option.
+	marshalCompare(t, v, "")
+}
+
+// TestCanonical tests that the output is serialized
+// as defined by the RFC 8785 with the Canonical option.
+func TestCanonical(t *testing.T) {
+	// Examples of the sections 3.2.2 and 3.2.3
+	// of the RFC 8785.
+	testdata := []struct {
+		v    interface{}
+		want string
+	}{
+		{
+			map[string]interface{}{
+				"numbers":  []json.Number{"333333333.33333329", "1E30", "4.50", "2e-3", "0.000000000000000000000000001"},
+				"string":   "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"/",
+				"literals": []interface{}{nil, true, false},
+			},
+			`{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			map[string]string{
+				"\u20ac":     "Euro Sign",
+				"\r":         "Carriage Return",
+				"\ufb33":     "Hebrew Letter Dalet With Dagesh",
+				"1":          "One",
+				"\U0001f600": "Emoji: Grinning Face",
+				"\u0080":     "Control",
+				"\u00f6":     "Latin Small Letter O With Diaeresis",
+			},
+			"{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"ö\":\"Latin Small Letter O With Diaeresis\"," +
+				"\"€\":\"Euro Sign\",\"😀\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}",
+		},
+		{
+			struct {
+				Z  float64         `json:"z"`
+				F  float32         `json:"𝒜"`
+				E  float64         `json:"דּ"`
+				I  int64           `json:"i"`
+				U  uint64          `json:"u"`
+				S  string          `json:"s"`
+				R  json.RawMessage `json:"r"`
+				D  time.Duration   `json:"d"`
+				NS string          `json:"ns,string"`
+			}{
+				Z: math.Copysign(0, -1),
+				F: 0.1,
+				E: 1e21,
+				I: 1<<53 + 1,
+				U: math.MaxUint64,
+				S: "<\u2028>\xff\b\f\x7f",
+				R: json.RawMessage(`{ "b" : [1.0, "\u00e9\/"] }`),
+				D: time.Second,
+			},
+			`{"d":1000000000,"i":9007199254740992,"ns":"\"\"","r":{"b":[1,"é/"]},"s":"<` + "\u2028>\ufffd" + `\b\f` + "\x7f" + `",` +
+				`"u":18446744073709552000,"z":0,"𝒜":0.1,"דּ":1e+21}`,
+		},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, Canonical())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	if _, err := MarshalOpts(json.Number("1e400"), Canonical()); err == nil {
+		t.Error("expected non-nil error")
+	}
+	if _, err := MarshalOpts(1, Canonical(), Indent("", " ")); err == nil {
+		t.Error("expected non-nil error")
+	}
+	// The members of the objects returned by
+	// marshalers are sorted too, at any depth.
+	raw := json.RawMessage(`{"b":1,"\u00e9":[{"z":0,"a":{}}],"a":2,"\ud83d\ude00":3,"\ufb33":4}`)
+	b, err := MarshalOpts(map[string]interface{}{"m": raw, "n": []interface{}{raw}}, Canonical())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := `{"a":2,"b":1,"é":[{"a":{},"z":0}],"` + "\U0001F600" + `":3,"` + "\uFB33" + `":4}`
+	if got, want := string(b), `{"m":`+inner+`,"n":[`+inner+`]}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+type schemaItem struct {
+	Name string `json:"name"`
+}
+
+func (schemaItem) JSONSchema() json.RawMessage {
+	return json.RawMessage(`{ "type": "object",
+		"properties": { "name": { "type": "string" } } }`)
+}
+
+type badSchemaItem struct{}
+
+func (badSchemaItem) JSONSchema() json.RawMessage { return json.RawMessage(`{`) }
+
+// TestIncludeSchema tests that the top-level value is
+// wrapped with its schema with the IncludeSchema option.
+func TestIncludeSchema(t *testing.T) {
+	const schema = `{"type":"object","properties":{"name":{"type":"string"}}}`
+
+	testdata := []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{schemaItem{"a"}, nil, `{"name":"a"}`},
+		{schemaItem{"a"}, []Option{IncludeSchema("$schema")}, `{"$schema":` + schema + `,"data":{"name":"a"}}`},
+		{&schemaItem{"b"}, []Option{IncludeSchema("s")}, `{"s":` + schema + `,"data":{"name":"b"}}`},
+		{[]schemaItem{{"c"}}, []Option{IncludeSchema("s")}, `[{"name":"c"}]`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	b, err := AppendOpts([]byte("ipsum "), schemaItem{"d"}, IncludeSchema("s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `ipsum {"s":`+schema+`,"data":{"name":"d"}}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	_, err = MarshalOpts(badSchemaItem{}, IncludeSchema("s"))
+	if err == nil {
+		t.Fatal("expected non-nil error")
+	}
+	if _, ok := err.(*MarshalerError); !ok {
+		t.Errorf("got %T, want *jettison.MarshalerError", err)
+	}
+}
+
+// TestMapSortByValue tests that the entries of maps
+// are sorted by value with the MapSortByValue option.
+func TestMapSortByValue(t *testing.T) {
+	desc := MapSortByValue(func(a, b interface{}) bool {
+		return a.(int) > b.(int)
+	})
+	var sm sync.Map
+	sm.Store("a", 1)
+	sm.Store("b", 3)
+	sm.Store("c", 2)
+
+	testdata := []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{
+			map[string]int{"alice": 12, "bob": 42, "carol": 7, "dave": 42},
+			[]Option{desc},
+			`{"bob":42,"dave":42,"alice":12,"carol":7}`,
+		},
+		{
+			map[string]int{"alice": 12, "bob": 42, "carol": 7},
+			[]Option{UnsortedMap(), desc},
+			`{"bob":42,"alice":12,"carol":7}`,
+		},
+		{
+			map[string]int{"alice": 12, "bob": 42, "carol": 7},
+			[]Option{desc, MapSortByValue(nil)},
+			`{"alice":12,"bob":42,"carol":7}`,
+		},
+		{&sm, []Option{desc}, `{"b":3,"c":2,"a":1}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+}
+
+// TestMapPreview tests that the maps are truncated to
+// the number of entries set with the MapPreview option,
+// followed by an entry that reports how many entries
+// were left out.
+func TestMapPreview(t *testing.T) {
+	m := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		m[fmt.Sprintf("k%02d", i)] = i
+	}
+	for _, max := range []int{0, 1, 3, 99, 100, 150} {
+		b, err := MarshalOpts(m, MapPreview(max), UnsortedMap(), NoHTMLEscaping())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			sb strings.Builder
+			n  = max
+		)
+		if n > len(m) {
+			n = len(m)
+		}
+		sb.WriteByte('{')
+		for i := 0; i < n; i++ {
+			if i != 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, `"k%02d":%d`, i, i)
+		}
+		if n < len(m) {
+			if n != 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, `"…":"<%d more>"`, len(m)-n)
+		}
+		sb.WriteByte('}')
+
+		if got, want := string(b), sb.String(); got != want {
+			t.Errorf("%d: got %#q, want %#q", max, got, want)
+		}
+	}
+	// The sync.Map values, the sort by value
+	// and the escaping of the marker.
+	sm := &sync.Map{}
+	sm.Store("b", 1)
+	sm.Store("a", 2)
+	sm.Store("c", 3)
+	b, err := MarshalOpts(sm, MapPreview(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"a":2,"…":"\u003c2 more\u003e"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	less := func(a, b interface{}) bool { return a.(int) < b.(int) }
+	b, err = MarshalOpts(sm, MapPreview(2), MapSortByValue(less), NoHTMLEscaping(), EscapeAllNonASCII())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"b":1,"a":2,"\u2026":"<1 more>"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	if _, err := MarshalOpts(m, MapPreview(-1)); err == nil {
+		t.Error("expected non-nil error")
+	}
+}
+
+// TestParallelThreshold tests that the maps encoded in
+// parallel above the threshold set with the option
+// ParallelThreshold produce the same output as when
+// they are encoded sequentially, with the map options.
+func TestParallelThreshold(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	type val struct {
+		S string
+		M map[int]bool
+	}
+	var (
+		sm = make(map[string]val)
+		im = make(map[int]string)
+	)
+	for i := 0; i < 1000; i++ {
+		sm[fmt.Sprintf("k%d", i)] = val{
+			S: strconv.Itoa(i),
+			M: map[int]bool{i: true, -i: false},
+		}
+		im[i*7%1009-500] = strconv.Itoa(i)
+	}
+	less := func(a, b string) bool { return len(a) < len(b) || len(a) == len(b) && a > b }
+
+	for _, opts := range [][]Option{
+		nil,
+		{NumericMapKeys()},
+		{MapKeySort(less)},
+		{Canonical()},
+		{MapPreview(10)},
+		{AllowList([]string{"k1", "k10", "k999"})},
+		{MapSortByValue(func(a, b interface{}) bool { return fmt.Sprint(a) < fmt.Sprint(b) })},
+	} {
+		for _, m := range []interface{}{sm, im} {
+			want, err := MarshalOpts(m, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, n := range []int{1, 10, 999} {
+				got, err := MarshalOpts(m, append(opts, ParallelThreshold(n))...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%d: got %s, want %s", n, got, want)
+				}
+			}
+		}
+	}
+	em := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		em[strconv.Itoa(i)] = i
+	}
+	em["42"] = errvm{}
+
+	_, err := MarshalOpts(em, ParallelThreshold(1))
+	if !errors.Is(err, errMarshaler) {
+		t.Errorf("got %v, want %v", err, errMarshaler)
+	}
+	if _, err := MarshalOpts(sm, ParallelThreshold(0)); err == nil {
+		t.Error("expected non-nil error")
+	}
+}
+
+// TestMapKeySort tests that the keys of the maps are
+// sorted with the function set with the MapKeySort
+// option, for the sync.Map and integer maps too, and
+// that Canonical has precedence over it.
+func TestMapKeySort(t *testing.T) {
+	// Semantic versions, compared by their
+	// numeric components.
+	semverLess := func(a, b string) bool {
+		as, bs := strings.Split(a, "."), strings.Split(b, ".")
+		for i := 0; i < len(as) && i < len(bs); i++ {
+			x, _ := strconv.Atoi(as[i])
+			y, _ := strconv.Atoi(bs[i])
+			if x != y {
+				return x < y
+			}
+		}
+		return len(as) < len(bs)
+	}
+	m := map[string]int{"1.10.0": 3, "1.2.0": 1, "1.9.1": 2, "10.0.0": 4, "2.0": 5}
+
+	for _, v := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, `{"1.10.0":3,"1.2.0":1,"1.9.1":2,"10.0.0":4,"2.0":5}`},
+		{[]Option{MapKeySort(semverLess)}, `{"1.2.0":1,"1.9.1":2,"1.10.0":3,"2.0":5,"10.0.0":4}`},
+		{[]Option{MapKeySort(semverLess), Canonical()}, `{"1.10.0":3,"1.2.0":1,"1.9.1":2,"10.0.0":4,"2.0":5}`},
+	} {
+		b, err := MarshalOpts(m, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// The keys of a sync.Map and of integer
+	// maps are sorted with the function too.
+	sm := &sync.Map{}
+	for k, v := range m {
+		sm.Store(k, v)
+	}
+	b, err := MarshalOpts(sm, MapKeySort(semverLess))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"1.2.0":1,"1.9.1":2,"1.10.0":3,"2.0":5,"10.0.0":4}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	desc := func(a, b string) bool { return semverLess(b, a) }
+	b, err = MarshalOpts(map[int]bool{1: true, 10: false, 2: true}, MapKeySort(desc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"10":false,"2":true,"1":true}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestNumericMapKeys tests that the integer keys of the
+// maps are sorted by their numeric value with the
+// NumericMapKeys option, and that the string keys are
+// still sorted as strings.
+func TestNumericMapKeys(t *testing.T) {
+	m := map[int]string{1: "a", 2: "b", 10: "c", -3: "d", -20: "e", 0: "f"}
+
+	// Without the option, the keys are sorted
+	// like the encoding/json package does.
+	marshalCompare(t, m, "")
+
+	for _, v := range []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{m, nil, `{"-20":"e","-3":"d","0":"f","1":"a","2":"b","10":"c"}`},
+		{map[uint8]bool{255: true, 3: false, 20: true}, nil, `{"3":false,"20":true,"255":true}`},
+		{map[int64]int{-1: 1, -10: 2, -2: 3}, nil, `{"-10":2,"-2":3,"-1":1}`},
+		{map[string]int{"10": 1, "2": 2}, nil, `{"10":1,"2":2}`},
+		{m, []Option{KeyPrefix("k-"), PrefixMapKeys()}, `{"k--20":"e","k--3":"d","k-0":"f","k-1":"a","k-2":"b","k-10":"c"}`},
+		{m, []Option{MapPreview(2), NoHTMLEscaping()}, `{"-20":"e","-3":"d","…":"<4 more>"}`},
+	} {
+		opts := append([]Option{NumericMapKeys()}, v.opts...)
+		b, err := MarshalOpts(v.v, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+}
+
+// TestCaseInsensitiveMapSort tests that the keys of the
+// maps are sorted without regard to their case with the
+// CaseInsensitiveMapSort option, the case breaking the
+// ties, and that the sort by value has precedence.
+func TestCaseInsensitiveMapSort(t *testing.T) {
+	var sm sync.Map
+	sm.Store("b", 1)
+	sm.Store("A", 2)
+	sm.Store("a", 3)
+
+	m := map[string]int{"banana": 1, "Apple": 2, "cherry": 3, "apple": 4, "APPLE": 5, "Banana": 6}
+
+	testdata := []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{m, nil, `{"APPLE":5,"Apple":2,"apple":4,"Banana":6,"banana":1,"cherry":3}`},
+		{map[string]int{"b": 1, "B": 2, "ab": 3, "Aa": 4, "a": 5}, nil, `{"a":5,"Aa":4,"ab":3,"B":2,"b":1}`},
+		{map[string]int{"Éa": 1, "éb": 2, "Ec": 3}, nil, `{"Ec":3,"Éa":1,"éb":2}`},
+		{map[int]int{10: 1, 9: 2}, nil, `{"10":1,"9":2}`},
+		{&sm, nil, `{"A":2,"a":3,"b":1}`},
+		{m, []Option{MapSortByValue(func(a, b interface{}) bool {
+			return a.(int)%2 < b.(int)%2
+		})}, `{"Apple":2,"apple":4,"Banana":6,"APPLE":5,"banana":1,"cherry":3}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, append(v.opts, CaseInsensitiveMapSort())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+}
+
+// TestZuluAsOffset tests that the zone of UTC times
+// is written as +00:00 with the ZuluAsOffset option.
+func TestZuluAsOffset(t *testing.T) {
+	var (
+		utc = time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC)
+		cet = utc.In(time.FixedZone("", 2*3600))
+	)
+	testdata := []struct {
+		v    time.Time
+		opts []Option
+		want string
+	}{
+		{utc, nil, `"2020-01-02T03:04:05.0000006Z"`},
+		{utc, []Option{ZuluAsOffset()}, `"2020-01-02T03:04:05.0000006+00:00"`},
+		{cet, []Option{ZuluAsOffset()}, `"2020-01-02T05:04:05.0000006+02:00"`},
+		{utc, []Option{ZuluAsOffset(), TimeLayout(time.RFC3339)}, `"2020-01-02T03:04:05+00:00"`},
+		{cet, []Option{ZuluAsOffset(), TimeLayout(time.RFC3339)}, `"2020-01-02T05:04:05+02:00"`},
+		{utc, []Option{TimeLayout("2006-01-02 Z0700"), ZuluAsOffset()}, `"2020-01-02 +0000"`},
+		{cet, []Option{TimeLayout("2006-01-02 Z0700"), ZuluAsOffset()}, `"2020-01-02 +0200"`},
+		{utc, []Option{TimeLayout(time.Kitchen), ZuluAsOffset()}, `"3:04AM"`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+}
+
+// TestTimeLocation tests that the times are converted
+// to the location set with the TimeLocation option
+// before they are formatted, with the layouts of the
+// fields too, and that a nil location is rejected.
+func TestTimeLocation(t *testing.T) {
+	var (
+		utc = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		loc = time.FixedZone("CET", 3600)
+	)
+	type x struct {
+		T  time.Time  `json:"t"`
+		P  *time.Time `json:"p"`
+		TL time.Time  `json:"tl,layout=2006-01-02T15:04MST"`
+	}
+	testdata := []struct {
+		opts []Option
+		want string
+	}{
+		{nil, `{"t":"2020-01-02T03:04:05Z","p":"2020-01-02T03:04:05Z","tl":"2020-01-02T03:04UTC"}`},
+		{[]Option{TimeLocation(loc)}, `{"t":"2020-01-02T04:04:05+01:00","p":"2020-01-02T04:04:05+01:00","tl":"2020-01-02T04:04CET"}`},
+		// Layouts without zone are left unchanged.
+		{[]Option{TimeLocation(loc), TimeLayout(time.Kitchen)}, `{"t":"3:04AM","p":"3:04AM","tl":"2020-01-02T04:04CET"}`},
+		// Unix timestamps are location-independent.
+		{[]Option{TimeLocation(loc), UnixTime()}, `{"t":1577934245,"p":1577934245,"tl":"2020-01-02T04:04CET"}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(x{T: utc, P: &utc, TL: utc}, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	if _, err := MarshalOpts(utc, TimeLocation(nil)); err == nil {
+		t.Error("expected non-nil error")
+	}
+}
+
+// TestFloatPrecision tests that floating-point numbers
+// are encoded with a fixed number of decimals with the
+// FloatPrecision option.
+func TestFloatPrecision(t *testing.T) {
+	testdata := []struct {
+		v    interface{}
+		prec int
+		want string
+	}{
+		{3.14159, 4, `3.1416`},
+		{float32(2.5), 2, `2.50`},
+		{[]float64{1e21, -1e-7, 0}, 3, `[1000000000000000000000.000,-0.000,0.000]`},
+		{map[string]float64{"a": 1.005}, 0, `{"a":1}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, FloatPrecision(v.prec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	if _, err := MarshalOpts(math.NaN(), FloatPrecision(2)); err == nil {
+		t.Error("expected non-nil error")
+	}
+	_, err := MarshalOpts(1.0, FloatPrecision(-1))
+	if _, ok := err.(*InvalidOptionError); !ok {
+		t.Errorf("got %T, want *jettison.InvalidOptionError", err)
+	}
+}
+
+// TestFloatFormat tests that the floating-point numbers
+// are formatted with the format and precision set with
+// the FloatFormat option, and that the formats which
+// don't produce valid JSON are rejected.
+func TestFloatFormat(t *testing.T) {
+	type x struct {
+		A float32   `json:"a"`
+		B float64   `json:"b"`
+		C []float64 `json:"c"`
+		D *float32  `json:"d"`
+	}
+	f := float32(0.125)
+	xx := x{A: 3.5, B: -1234.5678, C: []float64{1, 1e21}, D: &f}
+
+	testdata := []struct {
+		fmt  byte
+		prec int
+		want string
+	}{
+		{'f', 2, `{"a":3.50,"b":-1234.57,"c":[1.00,1000000000000000000000.00],"d":0.12}`},
+		{'e', 3, `{"a":3.500e+00,"b":-1.235e+03,"c":[1.000e+00,1.000e+21],"d":1.250e-01}`},
+		{'E', -1, `{"a":3.5E+00,"b":-1.2345678E+03,"c":[1E+00,1E+21],"d":1.25E-01}`},
+		{'g', 3, `{"a":3.5,"b":-1.23e+03,"c":[1,1e+21],"d":0.125}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(xx, FloatFormat(v.fmt, v.prec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("%c/%d: got %#q, want %#q", v.fmt, v.prec, got, v.want)
+		}
+		if !json.Valid(b) {
+			t.Errorf("%c/%d: invalid JSON %s", v.fmt, v.prec, b)
+		}
+	}
+	for _, opt := range []Option{
+		FloatFormat('x', 2),
+		FloatFormat('b', -1),
+		FloatFormat('f', -1),
+		FloatFormat('e', -2),
+	} {
+		_, err := MarshalOpts(1.0, opt)
+		if _, ok := err.(*InvalidOptionError); !ok {
+			t.Errorf("got %T, want *jettison.InvalidOptionError", err)
+		}
+	}
+}
+
+// TestDecimalSeparator tests that the decimal point of
+// the floating point numbers is replaced by the rune set
+// with the DecimalSeparator option.
+func TestDecimalSeparator(t *testing.T) {
+	type x struct {
+		A float32   `json:"a"`
+		B float64   `json:"b"`
+		C []float64 `json:"c"`
+		D int       `json:"d"`
+		E string    `json:"e"`
+	}
+	xx := x{A: 3.5, B: -1234.5678, C: []float64{1, 0.001, 1.5e-7, 1e21}, D: 42, E: "1.5"}
+
+	for _, v := range []struct {
+		opts []Option
+		want string
+	}{
+		{
+			[]Option{DecimalSeparator(',')},
+			`{"a":3,5,"b":-1234,5678,"c":[1,0,001,1,5e-7,1e+21],"d":42,"e":"1.5"}`,
+		},
+		{
+			[]Option{DecimalSeparator(','), FloatPrecision(2)},
+			`{"a":3,50,"b":-1234,57,"c":[1,00,0,00,0,00,1000000000000000000000,00],"d":42,"e":"1.5"}`,
+		},
+		{
+			[]Option{DecimalSeparator('·')},
+			`{"a":3·5,"b":-1234·5678,"c":[1,0·001,1·5e-7,1e+21],"d":42,"e":"1.5"}`,
+		},
+	} {
+		b, err := MarshalOpts(xx, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	for _, opt := range []Option{
+		DecimalSeparator('"'),
+		DecimalSeparator('\\'),
+		DecimalSeparator(-1),
+	} {
+		_, err := MarshalOpts(1.5, opt)
+		if _, ok := err.(*InvalidOptionError); !ok {
+			t.Errorf("got %T, want *jettison.InvalidOptionError", err)
+		}
+	}
+	// The options that parse the output.
+	type y struct {
+		A map[string]float64 `json:"a,indent"`
+	}
+	for _, v := range []struct {
+		v    interface{}
+		opts []Option
+	}{
+		{1.5, []Option{Canonical()}},
+		{1.5, []Option{Indent("", " ")}},
+		{1.5, []Option{ValidateOutput()}},
+		{y{A: map[string]float64{"b": 5.5}}, nil},
+	} {
+		_, err := MarshalOpts(v.v, append(v.opts, DecimalSeparator(','))...)
+		var ierr *InvalidOptionError
+		if !errors.As(err, &ierr) {
+			t.Errorf("got %T, want *jettison.InvalidOptionError", err)
+		}
+	}
+}
+
+// TestFloatPrecisionSortedKeys tests that the FloatPrecision
+// option composes with the sort of keys, so that equal values
+// of types whose fields are declared in different orders have
+// the same representation.
+func TestFloatPrecisionSortedKeys(t *testing.T) {
+	type (
+		statsA struct {
+			Mean   float64            `json:"mean"`
+			StdDev float64            `json:"stddev"`
+			P      map[string]float64 `json:"p"`
+		}
+		statsB struct {
+			P      map[string]float64 `json:"p"`
+			StdDev float64            `json:"stddev"`
+			Mean   float64            `json:"mean"`
+		}
+	)
+	a := statsA{
+		Mean:   1.23456789,
+		StdDev: 0.1,
+		P:      map[string]float64{"p99": 9.99999, "p50": 5.00001},
+	}
+	b := statsB{
+		Mean:   1.2345678,
+		StdDev: 0.10000001,
+		P:      map[string]float64{"p50": 5.00002, "p99": 9.999991},
+	}
+	hash := func(v interface{}) [sha256.Size]byte {
+		bts, err := MarshalOpts(v, FloatPrecision(4), GoldenFormat())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sha256.Sum256(bts)
+	}
+	if hash(a) != hash(b) {
+		t.Error("expected equal hashes")
+	}
+}
+
+// TestTimeLayoutFieldTag tests that the time.Time
+// fields are encoded with the layout option of
+// their tag, rather than the one of the options.
+func TestTimeLayoutFieldTag(t *testing.T) {
+	type x struct {
+		A time.Time  `json:"a,layout=2006-01-02"`
+		B *time.Time `json:"b,omitempty,layout=15:04"`
+		C time.Time  `json:"c"`
+		D *time.Time `json:"d,layout=2006-01-02T15:04Z07:00"`
+	}
+	tm := time.Date(2020, 6, 3, 10, 30, 0, 0, time.UTC)
+
+	testdata := []struct {
+		v    x
+		opts []Option
+		want string
+	}{
+		{
+			x{A: tm, B: &tm, C: tm, D: &tm},
+			nil,
+			`{"a":"2020-06-03","b":"10:30","c":"2020-06-03T10:30:00Z","d":"2020-06-03T10:30Z"}`,
+		},
+		{
+			x{A: tm, C: tm},
+			[]Option{TimeLayout(time.Kitchen)},
+			`{"a":"2020-06-03","c":"10:30AM","d":null}`,
+		},
+		{
+			x{A: tm, C: tm, D: &tm},
+			[]Option{UnixTime(), ZuluAsOffset()},
+			`{"a":"2020-06-03","c":1591180200,"d":"2020-06-03T10:30+00:00"}`,
+		},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// An empty layout is reported even
+	// if the field is omitted.
+	type y struct {
+		A *time.Time `json:"a,omitempty,layout="`
+	}
+	if _, err := Marshal(y{}); err == nil {
+		t.Error("expected non-nil error")
+	}
+}
+
+// TestExplicitDefaults tests that every struct field
+// is encoded with the ExplicitDefaults option, and that
+// the nil values, but pointers to structs, are encoded
+// as the zero-value of their type.
+func TestExplicitDefaults(t *testing.T) {
+	type node struct {
+		V    int   `json:"v"`
+		Next *node `json:"next"`
+	}
+	type x struct {
+		A int               `json:"a,omitempty"`
+		B string            `json:"b,omitempty"`
+		C bool              `json:"c,omitempty"`
+		D []int             `json:"d,omitempty"`
+		E map[string]string `json:"e,omitempty"`
+		F *float64          `json:"f,omitnil"`
+		G *node             `json:"g"`
+		H []string          `json:"h"`
+		I interface{}       `json:"i,omitempty"`
+		J *struct {
+			X int `json:"x"`
+		} `json:"j,omitempty"`
+		K **int `json:"k"`
+	}
+	b, err := MarshalOpts(x{}, ExplicitDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":0,"b":"","c":false,"d":[],"e":{},"f":0,"g":null,"h":[],"i":null,"j":null,"k":null}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Non-nil pointers are encoded as usual.
+	f := 1.5
+	b, err = MarshalOpts(x{F: &f, G: &node{V: 1, Next: &node{V: 2}}}, ExplicitDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"a":0,"b":"","c":false,"d":[],"e":{},"f":1.5,"g":{"v":1,"next":{"v":2,"next":null}},"h":[],"i":null,"j":null,"k":null}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestResolveFuncValues tests that the functions without
+// parameters are called with the ResolveFuncValues option
+// and their result is encoded in their place, and that
+// the errors they return are wrapped in a MarshalerError.
+func TestResolveFuncValues(t *testing.T) {
+	type getter func() interface{}
+	type x struct {
+		A func() interface{}            `json:"a"`
+		B func() (interface{}, error)   `json:"b"`
+		C getter                        `json:"c,omitempty"`
+		D map[string]func() interface{} `json:"d"`
+		E []getter                      `json:"e"`
+	}
+	v := x{
+		A: func() interface{} { return 1 },
+		B: func() (interface{}, error) { return []string{"b"}, nil },
+		D: map[string]func() interface{}{
+			"k": func() interface{} { return map[string]int{"n": 2} },
+			"l": nil,
+		},
+		E: []getter{func() interface{} { return "e" }},
+	}
+	b, err := MarshalOpts(v, ResolveFuncValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":1,"b":["b"],"d":{"k":{"n":2},"l":null},"e":["e"]}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Top-level function.
+	b, err = MarshalOpts(func() interface{} { return "top" }, ResolveFuncValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `"top"`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Errors returned by the functions.
+	errFoo := errors.New("foo")
+	v.B = func() (interface{}, error) { return nil, errFoo }
+
+	_, err = MarshalOpts(v, ResolveFuncValues())
+	me, ok := err.(*MarshalerError)
+	if !ok {
+		t.Fatalf("got %T, want *jettison.MarshalerError", err)
+	}
+	if me.Err != errFoo {
+		t.Errorf("got %v, want %v", me.Err, errFoo)
+	}
+	// Without the option, functions
+	// are unsupported.
+	_, err = Marshal(v)
+	if _, ok := err.(*UnsupportedTypeError); !ok {
+		t.Errorf("got %T, want *jettison.UnsupportedTypeError", err)
+	}
+}
+
+// TestBase64Encoding tests that the byte slices are
+// encoded with the encoding set with the option
+// Base64Encoding, except for those with the hex or raw
+// formats, and that a nil encoding restores the default.
+func TestBase64Encoding(t *testing.T) {
+	type x struct {
+		A []byte `json:"a"`
+		B []byte `json:"b,base64"`
+		C []byte `json:"c,hex"`
+	}
+	bs := []byte{0xfb, 0xff, 0xbf, 0x01}
+	v := x{A: bs, B: bs, C: bs}
+
+	testdata := []struct {
+		opts []Option
+		want string
+	}{
+		{nil, `{"a":"+/+/AQ==","b":"+/+/AQ==","c":"fbffbf01"}`},
+		{[]Option{Base64Encoding(base64.URLEncoding)}, `{"a":"-_-_AQ==","b":"-_-_AQ==","c":"fbffbf01"}`},
+		{[]Option{Base64Encoding(base64.RawURLEncoding)}, `{"a":"-_-_AQ","b":"-_-_AQ","c":"fbffbf01"}`},
+		{[]Option{Base64Encoding(nil)}, `{"a":"+/+/AQ==","b":"+/+/AQ==","c":"fbffbf01"}`},
+		{[]Option{Base64Encoding(base64.URLEncoding), RawByteSlice()}, `{"a":"\ufffd\ufffd\ufffd\u0001","b":"-_-_AQ==","c":"fbffbf01"}`},
+	}
+	for _, v2 := range testdata {
+		b, err := MarshalOpts(v, v2.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v2.want {
+			t.Errorf("got %#q, want %#q", got, v2.want)
+		}
+	}
+	// Top-level byte slice.
+	b, err := MarshalOpts(bs, Base64Encoding(base64.RawStdEncoding))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `"+/+/AQ"`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestBase64URLNoPad tests that the byte slices are
+// encoded with the unpadded URL alphabet of base64 with
+// the Base64URLNoPad option, except for those with the
+// hex or raw formats.
+func TestBase64URLNoPad(t *testing.T) {
+	type x struct {
+		A []byte `json:"a"`
+		B []byte `json:"b,base64"`
+		C []byte `json:"c,hex"`
+		D []byte `json:"d,raw"`
+	}
+	for _, bs := range [][]byte{
+		{},
+		{0xfb},
+		{0xfb, 0xff},
+		{0xfb, 0xff, 0xbf, 0x01},
+		[]byte("Loreum ipsum?"),
+	} {
+		enc := base64.RawURLEncoding.EncodeToString(bs)
+
+		b, err := MarshalOpts(x{A: bs, B: bs, C: bs, D: bs}, Base64URLNoPad())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := json.Marshal(string(bs))
+		want := fmt.Sprintf(`{"a":"%s","b":"%s","c":"%x","d":%s}`, enc, enc, bs, d)
+		if got := string(b); got != want {
+			t.Errorf("got %#q, want %#q", got, want)
+		}
+		// Top-level byte slice.
+		b, err = MarshalOpts(bs, Base64URLNoPad())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), `"`+enc+`"`; got != want {
+			t.Errorf("got %#q, want %#q", got, want)
+		}
+	}
+}
+
+// TestFieldSizeReport tests that the size of the fields
+// of the top-level struct that are encoded is reported
+// to the function set with the FieldSizeReport option.
+func TestFieldSizeReport(t *testing.T) {
+	type y struct {
+		C string `json:"c"`
+	}
+	type x struct {
+		A int    `json:"a"`
+		B string `json:"b,omitempty"`
+		Y y      `json:"y"`
+		D []int  `json:"d"`
+	}
+	sizes := make(map[string]int)
+	report := func(key string, n int) { sizes[key] = n }
+
+	b, err := MarshalOpts(&x{A: 42, Y: y{C: "foo"}, D: []int{1, 2}}, FieldSizeReport(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"a":42,"y":{"c":"foo"},"d":[1,2]}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Only the fields of the top-level
+	// struct that are encoded are reported.
+	want := map[string]int{"a": 6, "y": 15, "d": 9}
+	if !reflect.DeepEqual(sizes, want) {
+		t.Errorf("got %v, want %v", sizes, want)
+	}
+}
+
+// TestHexByteSlice tests that the byte slices are
+// encoded as hexadecimal strings with the option
+// HexByteSlice, unless a field has the base64 format,
+// and that it can't be used with RawByteSlice.
+func TestHexByteSlice(t *testing.T) {
+	type (
+		b  byte
+		b1 []byte
+		b2 []b
+	)
+	type x struct {
+		A []byte `json:"a"`
+		B b2     `json:"b"`
+		C []byte `json:"c,base64"`
+		D []byte `json:"d"`
+	}
+	testdata := []struct {
+		v    interface{}
+		want string
+	}{
+		{[]byte{0xde, 0xad, 0xbe, 0xef}, `"deadbeef"`},
+		{b1("jet"), `"6a6574"`},
+		{b2("son"), `"736f6e"`},
+		{x{A: []byte{0x0a}, B: b2{0xff}, C: []byte{0xff}}, `{"a":"0a","b":"ff","c":"/w==","d":null}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, HexByteSlice())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// The option is mutually exclusive
+	// with RawByteSlice.
+	_, err := MarshalOpts([]byte{}, HexByteSlice(), RawByteSlice())
+	if _, ok := err.(*InvalidOptionError); !ok {
+		t.Errorf("got %T, want *jettison.InvalidOptionError", err)
+	}
+}
+
+// TestTruncateStrings tests that the strings longer than
+// the limit set with the TruncateStrings option are cut
+// on a rune boundary and followed by the marker, and
+// that the keys and base64 byte slices are left as-is.
+func TestTruncateStrings(t *testing.T) {
+	type x struct {
+		S string            `json:"a_long_key"`
+		M map[string]string `json:"m"`
+		B []byte            `json:"b"`
+		A [6]byte           `json:"arr"`
+	}
+	testdata := []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{"short", nil, `"short"`},
+		{"exactly5", nil, `"exact…"`},
+		{"héllo wörld", nil, `"héllo…"`},
+		// Each rune is 3 bytes long.
+		{"日本語のテキスト", nil, `"日本語のテ…"`},
+		{"日本語のテ", nil, `"日本語のテ"`},
+		{"😀😀😀😀😀😀😀", []Option{TruncateStrings(2, "…(+%d bytes)")}, `"😀😀…(+20 bytes)"`},
+		{"<script>", []Option{TruncateStrings(3, "<%d>")}, `"\u003csc\u003c5\u003e"`},
+		{"abc", []Option{TruncateStrings(0, "")}, `""`},
+		{
+			x{S: "abcdefgh", M: map[string]string{"a_long_key": "abcdefgh"}, B: []byte("abcdefgh"), A: [6]byte{'a', 'b', 'c', 'd', 'e', 'f'}},
+			[]Option{TruncateStrings(5, "…"), RawByteSlice(), ByteArrayAsString()},
+			`{"a_long_key":"abcde…","m":{"a_long_key":"abcde…"},"b":"abcde…","arr":"abcde…"}`,
+		},
+		{
+			x{B: []byte("abcdefgh")}, nil,
+			`{"a_long_key":"","m":null,"b":"YWJjZGVmZ2g=","arr":[0,0,0,0,0,0]}`,
+		},
+	}
+	for _, v := range testdata {
+		opts := v.opts
+		if opts == nil {
+			opts = []Option{TruncateStrings(5, "…")}
+		}
+		b, err := MarshalOpts(v.v, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+		if !utf8.Valid(b) {
+			t.Errorf("invalid UTF-8 output %#q", b)
+		}
+	}
+	if _, err := MarshalOpts("", TruncateStrings(-1, "")); err == nil {
+		t.Error("expected non-nil error")
+	}
+}
+
+// TestEnumStrings tests that the values of the integer
+// types registered with EnumStrings are encoded as their
+// names, and that the unknown values are handled by the
+// fallback of their type.
+func TestEnumStrings(t *testing.T) {
+	type (
+		color  int8
+		status uint16
+		level  int
+	)
+	type x struct {
+		A color         `json:"a"`
+		B *status       `json:"b"`
+		C level         `json:"c,omitempty"`
+		D map[color]int `json:"d"`
+		E []status      `json:"e"`
+		F []level       `json:"f"`
+	}
+	EnumStrings(reflect.TypeOf(color(0)), map[int64]string{-1: "NONE", 1: "RED"}, EnumNumber)
+	EnumStrings(reflect.TypeOf(status(0)), map[int64]string{200: "OK"}, EnumUnknown)
+	EnumStrings(reflect.TypeOf(level(0)), map[int64]string{1: "DEBUG"}, EnumError)
+
+	s := status(404)
+	xx := x{
+		A: -1,
+		B: &s,
+		D: map[color]int{1: 1},
+		E: []status{200, 500},
+		F: []level{1},
+	}
+	b, err := Marshal(xx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":"NONE","b":"UNKNOWN(404)","d":{"1":1},"e":["OK","UNKNOWN(500)"],"f":["DEBUG"]}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Numeric fallback.
+	b, err = Marshal([]color{1, 2, -3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `["RED",2,-3]`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Error fallback.
+	xx.C = 3
+	_, err = Marshal(xx)
+	if _, ok := err.(*UnsupportedValueError); !ok {
+		t.Errorf("got %T, want *jettison.UnsupportedValueError", err)
+	}
+}
+
+// TestZeroFloat tests that a zero float is encoded as
+// 0 by default, like the standard library does, and
+// with padded decimals with the FloatPrecision option.
+func TestZeroFloat(t *testing.T) {
+	type x struct {
+		A float64  `json:"a"`
+		B float32  `json:"b"`
+		C *float64 `json:"c"`
+	}
+	var zero float64
+	xx := x{C: &zero}
+
+	testdata := []struct {
+		opts []Option
+		want string
+	}{
+		{nil, `{"a":0,"b":0,"c":0}`},
+		{[]Option{NarrowIntegralFloats()}, `{"a":0,"b":0,"c":0}`},
+		{[]Option{FloatPrecision(2)}, `{"a":0.00,"b":0.00,"c":0.00}`},
+		{[]Option{FloatPrecision(0)}, `{"a":0,"b":0,"c":0}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(xx, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	marshalCompare(t, xx, "zero floats")
+	marshalCompare(t, []float64{0, math.Copysign(0, -1)}, "signed zeros")
+}
+
+// TestAllowListPaths tests that the dotted paths of the
+// AllowList option select the fields and map entries at
+// any depth, through slices and interfaces, and that the
+// paths that don't resolve are ignored.
+func TestAllowListPaths(t *testing.T) {
+	type (
+		address struct {
+			Street string `json:"street"`
+			City   string `json:"city"`
+		}
+		user struct {
+			Name    string            `json:"name"`
+			Address *address          `json:"address"`
+			Tags    map[string]string `json:"tags"`
+		}
+		x struct {
+			ID    int         `json:"id"`
+			User  user        `json:"user"`
+			Users []user      `json:"users"`
+			Meta  interface{} `json:"meta"`
+		}
+	)
+	u := user{
+		Name:    "Bob",
+		Address: &address{Street: "Main St", City: "Springfield"},
+		Tags:    map[string]string{"a": "1", "b": "2"},
+	}
+	xx := x{
+		ID:    1,
+		User:  u,
+		Users: []user{u},
+		Meta:  map[string]interface{}{"v": 1, "w": map[string]int{"y": 2, "z": 3}},
+	}
+	testdata := []struct {
+		fields []string
+		want   string
+	}{
+		{
+			[]string{"user.address.city"},
+			`{"user":{"address":{"city":"Springfield"}}}`,
+		},
+		{
+			[]string{"id", "user.name", "user.tags.b", "users.address"},
+			`{"id":1,"user":{"name":"Bob","tags":{"b":"2"}},"users":[{"address":{"street":"Main St","city":"Springfield"}}]}`,
+		},
+		{
+			[]string{"meta.w.z", "user.address.city", "user"},
+			`{"user":{"name":"Bob","address":{"street":"Main St","city":"Springfield"},"tags":{"a":"1","b":"2"}},"meta":{"w":{"z":3}}}`,
+		},
+		{
+			// Paths that don't resolve.
+			[]string{"id", "user.zip", "nope.x"},
+			`{"id":1,"user":{}}`,
+		},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(xx, AllowList(v.fields))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("%v: got %#q, want %#q", v.fields, got, v.want)
+		}
+	}
+	// Map as top-level value.
+	b, err := MarshalOpts(map[string]user{"k": u, "l": u}, AllowList([]string{"k.name"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"k":{"name":"Bob"}}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestWithFieldTree tests that the fields selected by the
+// tree of the WithFieldTree option are encoded at any
+// depth, that a nil subtree selects the whole value, and
+// that the tree replaces the list of AllowList.
+func TestWithFieldTree(t *testing.T) {
+	type (
+		address struct {
+			Street string `json:"street"`
+			City   string `json:"city"`
+		}
+		user struct {
+			Name    string   `json:"name"`
+			Address *address `json:"address"`
+		}
+		team struct {
+			Name    string `json:"name"`
+			Members []user `json:"members"`
+		}
+		x struct {
+			ID    int    `json:"id"`
+			Teams []team `json:"teams"`
+			Owner user   `json:"owner"`
+		}
+	)
+	u := user{Name: "Bob", Address: &address{Street: "Main St", City: "Springfield"}}
+	xx := x{
+		ID:    1,
+		Teams: []team{{Name: "A", Members: []user{u, {Name: "Alice"}}}},
+		Owner: u,
+	}
+	testdata := []struct {
+		tree FieldSelection
+		want string
+	}{
+		{
+			FieldSelection{"owner": map[string]interface{}{"address": nil}},
+			`{"owner":{"address":{"street":"Main St","city":"Springfield"}}}`,
+		},
+		{
+			FieldSelection{
+				"id": nil,
+				"teams": FieldSelection{
+					"members": FieldSelection{
+						"name":    true,
+						"address": FieldSelection{"city": nil},
+					},
+				},
+			},
+			`{"id":1,"teams":[{"members":[{"name":"Bob","address":{"city":"Springfield"}},{"name":"Alice","address":null}]}]}`,
+		},
+		{
+			FieldSelection{"owner": FieldSelection(nil), "nope": nil},
+			`{"owner":{"name":"Bob","address":{"street":"Main St","city":"Springfield"}}}`,
+		},
+		{
+			FieldSelection{"id": nil, "owner": FieldSelection{}},
+			`{"id":1,"owner":{}}`,
+		},
+		{
+			nil,
+			`{"id":1,"teams":[{"name":"A","members":[{"name":"Bob","address":{"street":"Main St","city":"Springfield"}},{"name":"Alice","address":null}]}],"owner":{"name":"Bob","address":{"street":"Main St","city":"Springfield"}}}`,
+		},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(xx, WithFieldTree(v.tree))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("%v: got %#q, want %#q", v.tree, got, v.want)
+		}
+	}
+	// The tree replaces the list of AllowList.
+	b, err := MarshalOpts(xx, AllowList([]string{"id"}), WithFieldTree(FieldSelection{"owner": FieldSelection{"name": nil}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"owner":{"name":"Bob"}}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestKeyNamer tests that the names of the struct
+// fields without an explicit name in their tag are
+// transformed by the function set with KeyNamer.
+func TestKeyNamer(t *testing.T) {
+	type x struct {
+		UserID     int
+		HTTPServer string
+		FirstName  string `json:",omitempty"`
+		LastName   string `json:"LastName"`
+		Skipped    bool   `json:"-"`
+	}
+	xx := x{UserID: 1, HTTPServer: "s", FirstName: "f", LastName: "l"}
+
+	testdata := []struct {
+		opts []Option
+		want string
+	}{
+		{nil, `{"UserID":1,"HTTPServer":"s","FirstName":"f","LastName":"l"}`},
+		{[]Option{SnakeCase()}, `{"user_id":1,"http_server":"s","first_name":"f","LastName":"l"}`},
+		{[]Option{CamelCase()}, `{"userID":1,"httpServer":"s","firstName":"f","LastName":"l"}`},
+		{[]Option{SnakeCase(), AllowList([]string{"user_id", "LastName"})}, `{"user_id":1,"LastName":"l"}`},
+		{[]Option{SnakeCase(), KeyNamer(nil)}, `{"UserID":1,"HTTPServer":"s","FirstName":"f","LastName":"l"}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(xx, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// The transformed names are escaped.
+	namer := KeyNamer(func(s string) string { return "<" + s + "\"" })
+	type y struct{ A int }
+
+	for _, v := range []struct {
+		opts []Option
+		want string
+	}{
+		{[]Option{namer}, `{"\u003cA\"":0}`},
+		{[]Option{namer, NoHTMLEscaping()}, `{"<A\"":0}`},
+	} {
+		b, err := MarshalOpts(y{}, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// A field with an explicit name dominates the
+	// fields whose transformed name is the same.
+	type z struct {
+		UserID int
+		Foo    int `json:"user_id"`
+		Bar    int
+	}
+	for _, v := range []struct {
+		opts []Option
+		want string
+	}{
+		{[]Option{SnakeCase()}, `{"user_id":2,"bar":3}`},
+		{nil, `{"UserID":1,"user_id":2,"Bar":3}`},
+		{[]Option{SnakeCase(), SortStructFields()}, `{"bar":3,"user_id":2}`},
+	} {
+		b, err := MarshalOpts(z{UserID: 1, Foo: 2, Bar: 3}, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+}
+
+// TestKeyNamerCache tests that the instructions built
+// for the function of a KeyNamer option are reused by
+// the options created later with the same function,
+// and that the nested structs are encoded with the
+// namer, including those held by interfaces.
+func TestKeyNamerCache(t *testing.T) {
+	type (
+		inner struct {
+			FooBar int
+		}
+		outer struct {
+			In inner
+			P  *inner
+			I  interface{}
+			S  []inner
+			M  map[string]inner
+		}
+	)
+	v := outer{P: &inner{1}, I: inner{2}, S: []inner{{3}}, M: map[string]inner{"k": {4}}}
+	want := `{"in":{"foo_bar":0},"p":{"foo_bar":1},"i":{"foo_bar":2},"s":[{"foo_bar":3}],"m":{"k":{"foo_bar":4}}}`
+
+	count := func() (n int) {
+		for _, m := range []*sync.Map{&structInstrCache, &namedInstrCache, &fieldsCache} {
+			m.Range(func(_, _ interface{}) bool { n++; return true })
+		}
+		return n
+	}
+	var before int
+	for i := 0; i < 100; i++ {
+		b, err := MarshalOpts(v, KeyNamer(snakeCase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != want {
+			t.Fatalf("got %#q, want %#q", got, want)
+		}
+		if i == 0 {
+			before = count()
+		}
+	}
+	if after := count(); after != before {
+		t.Errorf("got %d cached entries, want %d", after, before)
+	}
+	if internNamer(strings.ToLower) != internNamer(strings.ToLower) {
+		t.Error("expected the same namer for the same function")
+	}
+}
+
+// TestAlignValues tests that the values of the objects
+// are aligned with the AlignValues option when the output
+// is indented, and that it has no effect otherwise.
+func TestAlignValues(t *testing.T) {
+	type x struct {
+		A     int               `json:"a"`
+		Bbbbb string            `json:"bbbbb"`
+		Cc    map[string]int    `json:"cc"`
+		D     []map[string]bool `json:"d"`
+	}
+	xx := x{
+		Bbbbb: "{x:\"y\"}",
+		Cc:    map[string]int{"k": 1, "long": 2, "é\"": 3},
+		D:     []map[string]bool{{"only": true}},
+	}
+	b, err := MarshalOpts(xx, Indent("", "  "), AlignValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "a"    : 0,
+  "bbbbb": "{x:\"y\"}",
+  "cc"   : {
+    "k"   : 1,
+    "long": 2,
+    "é\"" : 3
+  },
+  "d"    : [
+    {
+      "only": true
+    }
+  ]
+}`
+	if got := string(b); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if !json.Valid(b) {
+		t.Error("expected valid JSON")
+	}
+	// Without Indent, the option has no effect.
+	b, err = MarshalOpts(xx, AlignValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"a":0,"bbbbb":"{x:\"y\"}","cc":{"k":1,"long":2,"é\"":3},"d":[{"only":true}]}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestTagKey tests that the keys and options of the
+// fields are read from the tag set with the TagKey
+// option, the fields without it keeping their Go name,
+// and that an empty key restores the json tag.
+func TestTagKey(t *testing.T) {
+	type (
+		y struct {
+			Z int `db:"zz,string"`
+		}
+		x struct {
+			A    string `json:"a" db:"col_a"`
+			B    int    `json:"b" db:"col_b,omitempty"`
+			C    bool   `json:"c"`
+			D    string `json:"d" db:"-"`
+			Y    *y     `json:"y" db:"why"`
+			Next *x     `db:"next,omitempty"`
+		}
+	)
+	xx := &x{A: "a", C: true, D: "d", Y: &y{Z: 1}, Next: &x{A: "n", B: 2}}
+
+	testdata := []struct {
+		opts []Option
+		want string
+	}{
+		{
+			nil,
+			`{"a":"a","b":0,"c":true,"d":"d","y":{"Z":1},"Next":{"a":"n","b":2,"c":false,"d":"","y":null,"Next":null}}`,
+		},
+		{
+			[]Option{TagKey("db")},
+			`{"col_a":"a","C":true,"why":{"zz":"1"},"next":{"col_a":"n","col_b":2,"C":false,"why":null}}`,
+		},
+		{
+			[]Option{TagKey("db"), TagKey("")},
+			`{"a":"a","b":0,"c":true,"d":"d","y":{"Z":1},"Next":{"a":"n","b":2,"c":false,"d":"","y":null,"Next":null}}`,
+		},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(xx, v.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+}
+
+// TestMapMask tests that the values of the map entries
+// whose key is in the MapMask of the context are replaced,
+// for the integer maps and sync.Map values too, and that
+// the keys are compared before they are escaped.
+func TestMapMask(t *testing.T) {
+	type x struct {
+		Password string            `json:"password"`
+		M        map[string]string `json:"m"`
+		I        map[int]int       `json:"i"`
+		S        *sync.Map         `json:"s"`
+	}
+	sm := &sync.Map{}
+	sm.Store("password", "hunter2")
+	sm.Store("user", "bob")
+
+	xx := x{
+		Password: "not a map entry",
+		M:        map[string]string{"password": "hunter2", "user": "bob"},
+		I:        map[int]int{1: 1, 2: 2},
+		S:        sm,
+	}
+	ctx := context.WithValue(context.Background(), MapMaskKey, NewMapMask("<redacted>", "password", "2"))
+
+	want := `{"password":"not a map entry","m":{"password":"\u003credacted\u003e","user":"bob"},` +
+		`"i":{"1":1,"2":"\u003credacted\u003e"},"s":{"password":"\u003credacted\u003e","user":"bob"}}`
+
+	for _, opts := range [][]Option{
+		{WithContext(ctx)},
+		{WithContext(ctx), UnsortedMap()},
+	} {
+		b, err := MarshalOpts(xx, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Compare the decoded values, for the
+		// unordered entries of the maps.
+		if !equalJSON(t, b, []byte(want)) {
+			t.Errorf("got %#q, want %#q", b, want)
+		}
+	}
+	// Without mask in the context.
+	b, err := MarshalOpts(xx.M, WithContext(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"password":"hunter2","user":"bob"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// The keys are compared to the text of the
+	// map keys, before their characters are escaped.
+	ctx = context.WithValue(context.Background(), MapMaskKey, NewMapMask("***", "<k>", "é"))
+	b, err = MarshalOpts(map[string]string{"<k>": "a", "é": "b", "c": "d"},
+		WithContext(ctx), EscapeAllNonASCII())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"\u003ck\u003e":"***","\u00e9":"***","c":"d"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestRedactFields tests that the values of the fields
+// of the top-level struct named in the context returned
+// by RedactFields are replaced with RedactedValue, and
+// that the fields of the nested structs and the entries
+// of the maps are left as-is.
+func TestRedactFields(t *testing.T) {
+	type (
+		card struct {
+			Number string `json:"number"`
+			Expiry string `json:"expiry"`
+		}
+		x struct {
+			Email string            `json:"email"`
+			Name  string            `json:"name"`
+			SSN   *string           `json:"ssn,omitempty"`
+			Cards []card            `json:"cards"`
+			M     map[string]string `json:"m"`
+		}
+	)
+	xx := x{
+		Email: "lisa@example.com",
+		Name:  "Lisa",
+		Cards: []card{{Number: "4111", Expiry: "12/30"}},
+		M:     map[string]string{"email": "not a field"},
+	}
+	ctx := RedactFields(context.Background(), []string{"email", "ssn", "number"})
+
+	b, err := MarshalOpts(xx, WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"email":"**REDACTED**","name":"Lisa","cards":[{"number":"4111","expiry":"12/30"}],` +
+		`"m":{"email":"not a field"}}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// The struct is the top-level value.
+	b, err = MarshalOpts(xx.Cards[0], WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"number":"**REDACTED**","expiry":"12/30"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Without the context.
+	b, err = MarshalOpts(xx.Cards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `[{"number":"4111","expiry":"12/30"}]`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+func equalJSON(t *testing.T, a, b []byte) bool {
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// TestIndentFieldTag tests that the values of the fields
+// with the indent tag option are indented on their own,
+// and that they are formatted like the rest of the
+// output with the Indent option.
+func TestIndentFieldTag(t *testing.T) {
+	type (
+		payload struct {
+			A int      `json:"a"`
+			B []string `json:"b"`
+		}
+		envelope struct {
+			ID      int      `json:"id"`
+			Payload payload  `json:"payload,indent"`
+			Ptr     *payload `json:"ptr,indent,omitempty"`
+			Scalar  string   `json:"scalar,indent"`
+		}
+	)
+	v := envelope{
+		ID:      1,
+		Payload: payload{A: 2, B: []string{"x"}},
+		Scalar:  "s",
+	}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"id\":1,\"payload\":{\n  \"a\": 2,\n  \"b\": [\n    \"x\"\n  ]\n},\"scalar\":\"s\"}"
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	if !json.Valid(b) {
+		t.Error("expected valid JSON")
+	}
+	// The field is formatted like the rest
+	// of the output with the Indent option.
+	b, err = MarshalOpts(v, Indent("", "\t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want2, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want2) {
+		t.Errorf("got %#q, want %#q", b, want2)
+	}
+}
+
+// TestNewline tests that the output is the same as
+// the one of json.Encoder with the Newline option.
+func TestNewline(t *testing.T) {
+	type x struct {
+		A string `json:"a"`
+		B []int  `json:"b"`
+	}
+	for _, v := range []interface{}{
+		nil,
+		x{A: "<a>", B: []int{1, 2}},
+		[]string{"foo"},
+	} {
+		for _, indent := range []bool{false, true} {
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			opts := []Option{Newline()}
+			if indent {
+				enc.SetIndent("", "  ")
+				opts = append(opts, Indent("", "  "))
+			}
+			if err := enc.Encode(v); err != nil {
+				t.Fatal(err)
+			}
+			b, err := MarshalOpts(v, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, buf.Bytes()) {
+				t.Errorf("got %#q, want %#q", b, buf.Bytes())
+			}
+		}
+	}
+	// Appended values are separated.
+	b, err := AppendOpts(nil, 1, Newline())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = AppendOpts(b, 2, Newline())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "1\n2\n"; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// The newline is written after the
+	// output is transformed.
+	b, err = MarshalOpts("a", Newline(), OutputTransform(func(b []byte) ([]byte, error) {
+		return append([]byte("<"), append(b, '>')...), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "<\"a\">\n"; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestOmitEmptyElements tests that the empty elements of
+// the slices and arrays are left out with the option
+// OmitEmptyElements, and the zero structs only with
+// the option OmitEmptyStructs.
+func TestOmitEmptyElements(t *testing.T) {
+	one, two := 1, 2
+	testdata := []struct {
+		v    interface{}
+		want string
+	}{
+		{[]*int{nil, &one, nil, &two}, `[1,2]`},
+		{[][]int{{}, {1}, nil, {2, 3}}, `[[1],[2,3]]`},
+		{[]string{"", "a", "", "b", ""}, `["a","b"]`},
+		{[3]int{0, 4, 0}, `[4]`},
+		{[]string{"", ""}, `[]`},
+		{[]struct{ A int }{{}, {1}}, `[{"A":0},{"A":1}]`},
+		{map[string][]string{"k": {"", "v"}}, `{"k":["v"]}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, OmitEmptyElements())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+		// Without the option, the output is
+		// the same as the standard library.
+		marshalCompare(t, v.v, "")
+	}
+	type S struct{ A int }
+
+	for _, v := range []interface{}{
+		[]S{{}, {1}},
+		[2]S{{}, {1}},
+		[]*S{nil, {1}},
+	} {
+		b, err := MarshalOpts(v, OmitEmptyElements(), OmitEmptyStructs())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), `[{"A":1}]`; got != want {
+			t.Errorf("got %#q, want %#q", got, want)
+		}
+	}
+	// The zero structs aren't omitted with the
+	// option OmitEmptyStructs alone.
+	b, err := MarshalOpts([]S{{}, {1}}, OmitEmptyStructs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `[{"A":0},{"A":1}]`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestPunycodeKeys tests that the non-ASCII keys of the
+// structs and maps are converted to Punycode with the
+// PunycodeKeys option, before they are escaped.
+func TestPunycodeKeys(t *testing.T) {
+	type x struct {
+		A string `json:"名前"`
+		B int    `json:"a<é"`
+		C int
+	}
+	testdata := []struct {
+		v    interface{}
+		opts []Option
+		want string
+	}{
+		{x{A: "値"}, nil, `{"xn--ldr85b":"値","xn--a\u003c-cja":0,"C":0}`},
+		{x{}, []Option{NoHTMLEscaping()}, `{"xn--ldr85b":"","xn--a<-cja":0,"C":0}`},
+		{map[string]string{"名前": "値", "ascii": "a"}, nil, `{"ascii":"a","xn--ldr85b":"値"}`},
+		{map[string]int{"bücher.example": 1}, []Option{UnsortedMap()}, `{"xn--bcher-kva.example":1}`},
+		{struct{ Ünïcode int }{}, []Option{SnakeCase()}, `{"xn--ncode-cta3g":0}`},
+	}
+	for _, v := range testdata {
+		b, err := MarshalOpts(v.v, append(v.opts, PunycodeKeys())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	// Without the option, the keys are left
+	// as-is, and the output is the same as the
+	// standard library.
+	marshalCompare(t, x{A: "値"}, "")
+}
+
+type failWriter struct{ err error }
+
+func (w failWriter) Write([]byte) (int, error) { return 0, w.err }
+
+type countWriter int
+
+func (w countWriter) Write([]byte) (int, error) { return int(w), nil }
+
+type fakeSource struct {
+	rows []interface{}
+	err  error // returned by Scan for the last row
+	i    int
+}
+
+func (s *fakeSource) Next() bool {
+	s.i++
+	return s.i <= len(s.rows)
+}
+
+func (s *fakeSource) Scan() (interface{}, error) {
+	if s.err != nil && s.i == len(s.rows) {
+		return nil, s.err
+	}
+	return s.rows[s.i-1], nil
+}
+
+// TestEncodeSource tests that the rows of a RowSource
+// are written as a JSON array, like the slice of the
+// same rows, that the errors of the source, of the
+// writer and of the encoding are returned, and that
+// the options applied to the complete output of a
+// value are rejected.
+func TestEncodeSource(t *testing.T) {
+	rows := []interface{}{
+		map[string]interface{}{"id": 1, "name": "<a>"},
+		nil,
+		map[string]interface{}{"id": 2, "name": strings.Repeat("b", defaultBufCap)},
+	}
+	for _, opts := range [][]Option{
+		nil,
+		{NoHTMLEscaping()},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeSource(&fakeSource{rows: rows}, &buf, opts...); err != nil {
+			t.Fatal(err)
+		}
+		want, err := MarshalOpts(rows, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != string(want) {
+			t.Errorf("got %#q, want %#q", got, want)
+		}
+	}
+	var buf bytes.Buffer
+	if err := EncodeSource(&fakeSource{}, &buf, Newline()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "[]\n"; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Errors of the source and writer.
+	serr := errors.New("scan error")
+	if err := EncodeSource(&fakeSource{rows: rows, err: serr}, &buf); err != serr {
+		t.Errorf("got %v, want %v", err, serr)
+	}
+	werr := errors.New("write error")
+	if err := EncodeSource(&fakeSource{rows: rows}, failWriter{werr}); err != werr {
+		t.Errorf("got %v, want %v", err, werr)
+	}
+	if err := EncodeSource(&fakeSource{rows: []interface{}{make(chan int)}}, &buf); err == nil {
+		t.Error("expected non-nil error")
+	}
+	for _, opt := range []Option{
+		Indent("", "  "),
+		ValidateOutput(),
+		OutputTransform(func(b []byte) ([]byte, error) { return b, nil }),
+		IncludeSchema("$schema"),
+		ComputeETag("_etag", func(b []byte) string { return "" }),
+		HypermediaLinks(func(v interface{}) map[string]string { return nil }),
+	} {
+		buf.Reset()
+		err := EncodeSource(&fakeSource{rows: rows}, &buf, opt)
+		if _, ok := err.(*InvalidOptionError); !ok {
+			t.Errorf("got %T, want *InvalidOptionError", err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("got %#q, want empty output", buf.String())
+		}
+	}
+	buf.Reset()
+	if err := EncodeSource(&fakeSource{rows: rows}, &buf, Canonical()); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestComputeETag tests that the etag added with the
+// ComputeETag option is the hash of the canonical
+// encoding of the value, which doesn't depend on the
+// order of the map entries or the other options, that
+// the callbacks are called once, and that the key of
+// the etag can't be that of an existing member.
+func TestComputeETag(t *testing.T) {
+	hash := func(b []byte) string {
+		return fmt.Sprintf("%x", sha256.Sum256(b))
+	}
+	type x struct {
+		B int               `json:"b"`
+		A map[string]string `json:"a"`
+	}
+	m1 := make(map[string]string)
+	m2 := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		m1[strconv.Itoa(i)] = "v"
+		m2[strconv.Itoa(49-i)] = "v"
+	}
+	var etags []string
+	for _, v := range []struct {
+		v    interface{}
+		opts []Option
+	}{
+		{x{B: 1, A: m1}, nil},
+		{x{B: 1, A: m2}, nil},
+		{&x{B: 1, A: m2}, []Option{UnsortedMap()}},
+	} {
+		b, err := MarshalOpts(v.v, append(v.opts, ComputeETag("_etag", hash))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			B    int               `json:"b"`
+			A    map[string]string `json:"a"`
+			ETag string            `json:"_etag"`
+		}
+		if err := json.Unmarshal(b, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.B != 1 || len(out.A) != 50 || out.ETag == "" {
+			t.Errorf("unexpected output %s", b)
+		}
+		etags = append(etags, out.ETag)
+	}
+	if etags[0] != etags[1] || etags[1] != etags[2] {
+		t.Errorf("expected stable etags, got %v", etags)
+	}
+	// The etag is the hash of the canonical encoding,
+	// which sorts the fields of structs by name.
+	b, err := MarshalOpts(x{B: 2}, ComputeETag("_etag", hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"b":2,"a":null,"_etag":"` + hash([]byte(`{"a":null,"b":2}`)) + `"}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Values that aren't objects are unchanged.
+	for _, v := range []interface{}{1, []int{1}, "s"} {
+		b, err := MarshalOpts(v, ComputeETag("_etag", hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		marshalCompare(t, v, "")
+		if want, _ := json.Marshal(v); !bytes.Equal(b, want) {
+			t.Errorf("got %#q, want %#q", b, want)
+		}
+	}
+	b, err = MarshalOpts(map[string]int{}, ComputeETag("_etag", hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"_etag":"`+hash([]byte(`{}`))+`"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// The etag doesn't depend on the escaping and
+	// format options, nor on the names of the keys.
+	type y struct {
+		Name  string  `json:"name"`
+		Ratio float64 `json:"ratio"`
+		Ptr   *y      `json:"ptr,omitempty"`
+	}
+	yy := y{Name: "<é/>", Ratio: 0.5, Ptr: &y{Name: "a"}}
+	wantTag := hash([]byte(`{"name":"<é/>","ptr":{"name":"a","ratio":0},"ratio":0.5}`))
+	for _, opts := range [][]Option{
+		nil,
+		{NoHTMLEscaping()},
+		{EscapeAllNonASCII(), EscapeForwardSlash()},
+		{FloatFormat('e', 3)},
+		{Indent("", "  ")},
+		{SnakeCase(), KeyPrefix("p_")},
+	} {
+		b, err := MarshalOpts(yy, append(opts, ComputeETag("_etag", hash))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			ETag string `json:"_etag"`
+		}
+		if err := json.Unmarshal(b, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.ETag != wantTag {
+			t.Errorf("got etag %s, want %s", out.ETag, wantTag)
+		}
+	}
+	// The callbacks are called once per field.
+	var reports, filters int
+	_, err = MarshalOpts(yy,
+		ComputeETag("_etag", hash),
+		FieldSizeReport(func(string, int) { reports++ }),
+		FieldFilter(func(string, reflect.Value) bool { filters++; return true }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports != 3 || filters != 5 {
+		t.Errorf("got %d reports and %d filter calls, want 3 and 5", reports, filters)
+	}
+	// The key of the etag can't be that
+	// of an existing member.
+	for _, v := range []interface{}{
+		map[string]int{"_etag": 1},
+		map[string]interface{}{"a": []string{"_etag"}, "_etag": nil},
+		struct {
+			A string `json:"a"`
+			E int    `json:"_etag"`
+		}{A: `"_etag":`},
+	} {
+		if _, err := MarshalOpts(v, ComputeETag("_etag", hash)); err != ErrETagKeyConflict {
+			t.Errorf("%v: got %v, want %v", v, err, ErrETagKeyConflict)
+		}
+	}
+	if _, err := MarshalOpts(map[string]interface{}{"a": map[string]int{"_etag": 1}, "b": `"_etag"`}, ComputeETag("_etag", hash)); err != nil {
+		t.Errorf("expected nil error, got %v", err)
+	}
+}
+
+// TestBigRat tests that the big.Rat values with a finite
+// decimal expansion are encoded as numbers, and the
+// others as fraction strings, like map keys.
+func TestBigRat(t *testing.T) {
+	type x struct {
+		R1 big.Rat  `json:"r1"`
+		R2 big.Rat  `json:"r2,omitempty"`
+		R3 *big.Rat `json:"r3"`
+		R4 *big.Rat `json:"r4"`           // nil
+		R5 *big.Rat `json:"r5,omitempty"` // nil
+		R6 big.Rat  `json:"r6,omitempty"`
+	}
+	xx := &x{
+		R1: *big.NewRat(-3, 8),
+		R3: big.NewRat(1, 3),
+		R6: *big.NewRat(6, 3),
+	}
+	b, err := Marshal(xx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"r1":-0.375,"r3":"1/3","r4":null,"r6":2}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	for _, v := range []struct {
+		r    *big.Rat
+		want string
+	}{
+		{big.NewRat(0, 1), `0`},
+		{new(big.Rat), `0`},
+		{big.NewRat(7, 1), `7`},
+		{big.NewRat(1, 2), `0.5`},
+		{big.NewRat(-1, 40), `-0.025`},
+		{big.NewRat(1, 1024), `0.0009765625`},
+		{big.NewRat(3, 7), `"3/7"`},
+		{big.NewRat(1, 30), `"1/30"`},
+		{new(big.Rat).SetFrac(new(big.Int).Lsh(big.NewInt(1), 100), big.NewInt(5)), `253530120045645880299340641075.2`},
+	} {
+		b, err := Marshal(v.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != v.want {
+			t.Errorf("%s: got %#q, want %#q", v.r, got, v.want)
+		}
+	}
+	// Map keys use the text form.
+	b, err = Marshal(map[*big.Rat]int{big.NewRat(1, 2): 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"1/2":1}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	marshalCompare(t, map[*big.Int]int{big.NewInt(42): 1}, "big.Int key")
+}
+
+type opaqueID [4]byte
+
+func (id opaqueID) MarshalText() ([]byte, error) {
+	return []byte("text"), nil
+}
+
+// TestRegisterTypeEncoder tests that the values of a
+// type registered with RegisterTypeEncoder are encoded
+// by its function, including through pointers.
+func TestRegisterTypeEncoder(t *testing.T) {
+	typ := reflect.TypeOf(opaqueID{})
+	RegisterTypeEncoder(typ, func(v interface{}, dst []byte) ([]byte, error) {
+		id := v.(opaqueID)
+		if id == (opaqueID{}) {
+			return dst, errors.New("zero id")
+		}
+		return append(dst, fmt.Sprintf(`"%x"`, id[:])...), nil
+	})
+	defer RegisterTypeEncoder(typ, nil)
+
+	type x struct {
+		A opaqueID            `json:"a"`
+		B *opaqueID           `json:"b"`
+		C *opaqueID           `json:"c"`
+		D []opaqueID          `json:"d"`
+		E map[opaqueID]int    `json:"e"`
+		F map[string]opaqueID `json:"f"`
+	}
+	id := opaqueID{0xde, 0xad, 0xbe, 0xef}
+	xx := x{
+		A: id,
+		B: &id,
+		D: []opaqueID{id},
+		E: map[opaqueID]int{id: 1},
+		F: map[string]opaqueID{"k": id},
+	}
+	b, err := Marshal(xx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The encoder has precedence over the MarshalText
+	// method, except for the keys of maps.
+	want := `{"a":"deadbeef","b":"deadbeef","c":null,"d":["deadbeef"],"e":{"text":1},"f":{"k":"deadbeef"}}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	_, err = Marshal(x{B: &id})
+	var merr *MarshalerError
+	if !errors.As(err, &merr) {
+		t.Fatalf("got %T, want %T", err, merr)
+	}
+	if merr.Type != typ || merr.Err.Error() != "zero id" {
+		t.Errorf("unexpected error: %v", merr)
+	}
+	// Removing the registration restores the
+	// default encoding.
+	RegisterTypeEncoder(typ, nil)
+	marshalCompare(t, xx, "")
+}
+
+type celsius float64
+
+func (c celsius) String() string { return "unused" }
+
+// TestRegisterTypeEncoderInterface tests that the function
+// registered for a type is used for its values held by
+// interfaces, at any depth and for the top-level value.
+func TestRegisterTypeEncoderInterface(t *testing.T) {
+	typ := reflect.TypeOf(celsius(0))
+	RegisterTypeEncoder(typ, func(v interface{}, dst []byte) ([]byte, error) {
+		dst = strconv.AppendFloat(dst, float64(v.(celsius)), 'f', 1, 64)
+		return append(dst, `e0`...), nil
+	})
+	defer RegisterTypeEncoder(typ, nil)
+
+	type x struct {
+		A celsius                `json:"a"`
+		B interface{}            `json:"b"`
+		C fmt.Stringer           `json:"c"`
+		D interface{}            `json:"d"`
+		E []interface{}          `json:"e"`
+		F map[string]interface{} `json:"f"`
+	}
+	c := celsius(21.5)
+	xx := x{A: c, B: c, C: c, D: &c, E: []interface{}{c, nil}, F: map[string]interface{}{"k": c}}
+
+	b, err := Marshal(xx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":21.5e0,"b":21.5e0,"c":21.5e0,"d":21.5e0,"e":[21.5e0,null],"f":{"k":21.5e0}}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Top-level interface value.
+	b, err = Marshal(interface{}(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `21.5e0`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+type money struct {
+	Cents    int    `json:"cents"`
+	Currency string `json:"currency"`
+}
+
+// TestEmptyPredicate tests that the predicate registered
+// with EmptyPredicate decides if the values of its exact
+// type are omitted with omitempty and OmitEmptyElements.
+func TestEmptyPredicate(t *testing.T) {
+	typ := reflect.TypeOf(money{})
+	EmptyPredicate(typ, func(v interface{}) bool {
+		return v.(money).Cents == 0
+	})
+	defer EmptyPredicate(typ, nil)
+
+	type x struct {
+		A money   `json:"a,omitempty"`
+		B money   `json:"b,omitempty"`
+		C money   `json:"c"`
+		D *money  `json:"d,omitempty"`
+		E []money `json:"e"`
+	}
+	xx := x{
+		A: money{Currency: "EUR"},
+		B: money{Cents: 100, Currency: "EUR"},
+		D: &money{Currency: "EUR"},
+		E: []money{{Currency: "USD"}, {Cents: 1}},
+	}
+	b, err := Marshal(xx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The predicate applies to the exact type only,
+	// and the pointer field is omitted if nil.
+	want := `{"b":{"cents":100,"currency":"EUR"},"c":{"cents":0,"currency":""},"d":{"cents":0,"currency":"EUR"},"e":[{"cents":0,"currency":"USD"},{"cents":1,"currency":""}]}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	b, err = MarshalOpts(xx.E, OmitEmptyElements())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `[{"cents":1,"currency":""}]`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Predicate of a pointer-shaped type.
+	ptyp := reflect.TypeOf(&money{})
+	EmptyPredicate(ptyp, func(v interface{}) bool {
+		m := v.(*money)
+		return m == nil || m.Cents == 0
+	})
+	defer EmptyPredicate(ptyp, nil)
+
+	b, err = Marshal(xx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"d"`) {
+		t.Errorf("expected field d to be omitted: %s", b)
+	}
+	// Removing the registrations restores
+	// the default behavior.
+	EmptyPredicate(typ, nil)
+	EmptyPredicate(ptyp, nil)
+	marshalCompare(t, xx, "")
+}
+
+// TestCleanNumberFieldTag tests that the strings of the
+// fields with the cleanumber tag option are encoded as
+// numbers without their separators and spaces, and that
+// the strings that aren't numbers are rejected.
+func TestCleanNumberFieldTag(t *testing.T) {
+	type x struct {
+		A string  `json:"a,cleanumber"`
+		B *string `json:"b,cleanumber"`
+		C *string `json:"c,cleanumber"`
+		D string  `json:"d"`
+	}
+	for _, v := range []struct {
+		s, want string
+	}{
+		{"1_000_000", `1000000`},
+		{" -12 345.678_9 ", `-12345.6789`},
+		{"1e1_0", `1e10`},
+		{"0", `0`},
+		{"\t3.14\n", `3.14`},
+	} {
+		s := v.s
+		b, err := Marshal(x{A: v.s, B: &s, D: v.s})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := json.Marshal(v.s)
+		want := `{"a":` + v.want + `,"b":` + v.want + `,"c":null,"d":` + string(d) + `}`
+		if got := string(b); got != want {
+			t.Errorf("got %#q, want %#q", got, want)
+		}
+	}
+	for _, s := range []string{"", "_", "1_000,5", "0x1F", "01_0", "1 2 a"} {
+		_, err := Marshal(x{A: s})
+		if err == nil {
+			t.Errorf("%q: expected non-nil error", s)
+		}
+	}
+}
+
+// TestAPIVersion tests that the struct fields are
+// omitted according to the since and until options
+// of their tag, and the version set with APIVersion.
+func TestAPIVersion(t *testing.T) {
+	type x struct {
+		A int `json:"a"`
+		B int `json:"b,since=2"`
+		C int `json:"c,until=2"`
+		D int `json:"d,omitempty,since=2,until=3"`
+	}
+	xx := x{A: 1, B: 2, C: 3, D: 4}
+
+	for _, tt := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, `{"a":1,"b":2,"c":3,"d":4}`},
+		{[]Option{APIVersion(1)}, `{"a":1,"c":3}`},
+		{[]Option{APIVersion(2)}, `{"a":1,"b":2,"c":3,"d":4}`},
+		{[]Option{APIVersion(3)}, `{"a":1,"b":2,"d":4}`},
+		{[]Option{APIVersion(4)}, `{"a":1,"b":2}`},
+	} {
+		b, err := MarshalOpts(xx, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != tt.want {
+			t.Errorf("got %#q, want %#q", got, tt.want)
+		}
+	}
+	if _, err := MarshalOpts(xx, APIVersion(0)); err == nil {
+		t.Error("expected non-nil error for invalid version")
+	}
+	// An invalid version is reported even
+	// if the field is omitted.
+	type y struct {
+		A int `json:"a,since=x"`
+	}
+	type z struct {
+		A int `json:"a,until=0"`
+	}
+	for _, v := range []interface{}{y{}, z{}} {
+		for _, opts := range [][]Option{nil, {APIVersion(1)}, {APIVersion(3)}} {
+			if _, err := MarshalOpts(v, opts...); err == nil {
+				t.Error("expected non-nil error for invalid tag")
+			}
+		}
+	}
+}
+
+// TestWithRoles tests that the fields with a roles tag
+// are encoded only for the callers that have one of the
+// roles, and that the roles tag of an embedded struct
+// restricts its promoted fields too.
+func TestWithRoles(t *testing.T) {
+	type y struct {
+		Secret string `json:"secret" roles:"admin"`
+		Public string `json:"public"`
+	}
+	type e struct {
+		Bonus int    `json:"bonus"`
+		Perk  string `json:"perk" roles:"hr,manager"`
+		Audit string `json:"audit" roles:"manager"`
+	}
+	type x struct {
+		Name   string `json:"name"`
+		Salary int    `json:"salary" roles:"admin, hr"`
+		Notes  string `json:"notes,omitempty" roles:"manager"`
+		Empty  string `json:"empty" roles:""`
+		Y      y      `json:"y"`
+		e      `roles:"admin,hr"`
+	}
+	xx := x{Name: "Bob", Salary: 4200, Notes: "good", Y: y{"s", "p"}, e: e{10, "car", "ok"}}
+
+	for _, tt := range []struct {
+		roles []string
+		want  string
+	}{
+		{nil, `{"name":"Bob","empty":"","y":{"public":"p"}}`},
+		{[]string{}, `{"name":"Bob","empty":"","y":{"public":"p"}}`},
+		{[]string{"guest"}, `{"name":"Bob","empty":"","y":{"public":"p"}}`},
+		{[]string{"hr"}, `{"name":"Bob","salary":4200,"empty":"","y":{"public":"p"},"bonus":10,"perk":"car"}`},
+		{[]string{"manager"}, `{"name":"Bob","notes":"good","empty":"","y":{"public":"p"}}`},
+		{[]string{"admin"}, `{"name":"Bob","salary":4200,"empty":"","y":{"secret":"s","public":"p"},"bonus":10}`},
+		{[]string{"guest", "manager", "hr"}, `{"name":"Bob","salary":4200,"notes":"good","empty":"","y":{"public":"p"},"bonus":10,"perk":"car"}`},
+	} {
+		opts := []Option{UnsortedMap()}
+		if tt.roles != nil {
+			opts = append(opts, WithRoles(tt.roles...))
+		}
+		b, err := MarshalOpts(xx, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != tt.want {
+			t.Errorf("%q: got %#q, want %#q", tt.roles, got, tt.want)
+		}
+	}
+}
+
+// TestFieldFilter tests that the function set with the
+// FieldFilter option is called with the path and value of
+// the fields at any depth, and that the fields for which
+// it returns false are omitted.
+func TestFieldFilter(t *testing.T) {
+	type (
+		addr struct {
+			City string `json:"city"`
+			Zip  string `json:"zip"`
+		}
+		user struct {
+			Name  string          `json:"name"`
+			Bio   string          `json:"bio,omitempty"`
+			Addr  *addr           `json:"address"`
+			Prev  []addr          `json:"previous"`
+			Attrs map[string]addr `json:"attrs"`
+		}
+	)
+	u := user{
+		Name:  "Lisa",
+		Addr:  &addr{City: "Nice", Zip: "06000"},
+		Prev:  []addr{{City: "Lyon", Zip: "69000"}},
+		Attrs: map[string]addr{"k": {City: "Paris", Zip: "75000"}},
+	}
+	var paths []string
+
+	b, err := MarshalOpts(u, FieldFilter(func(path string, v reflect.Value) bool {
+		paths = append(paths, path)
+		if v.Kind() == reflect.String {
+			return v.Len() <= 4 && path != "name"
+		}
+		return true
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"address":{"city":"Nice"},"previous":[{"city":"Lyon"}],"attrs":{"k":{}}}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	wantPaths := []string{
+		"name",
+		"address", "address.city", "address.zip",
+		"previous", "previous.city", "previous.zip",
+		"attrs", "attrs.city", "attrs.zip",
+	}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("got %q, want %q", paths, wantPaths)
+	}
+}
+
+// TestUnixTimeUnits tests that the times are encoded as
+// Unix timestamps in the unit of the last option among
+// UnixTime, UnixMilliTime, UnixMicroTime and UnixNanoTime,
+// except for the fields with a layout.
+func TestUnixTimeUnits(t *testing.T) {
+	type x struct {
+		A time.Time  `json:"a"`
+		B *time.Time `json:"b"`
+		C *time.Time `json:"c"`
+		D time.Time  `json:"d,layout=2006"`
+	}
+	tm := time.Date(2021, time.March, 4, 5, 6, 7, 891234567, time.UTC)
+	xx := x{A: tm, B: &tm, D: tm}
+
+	for _, v := range []struct {
+		opt  Option
+		want string
+	}{
+		{UnixTime(), `1614834367`},
+		{UnixMilliTime(), `1614834367891`},
+		{UnixMicroTime(), `1614834367891234`},
+		{UnixNanoTime(), `1614834367891234567`},
+	} {
+		b, err := MarshalOpts(xx, v.opt, TimeLayout(time.Kitchen))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf(`{"a":%s,"b":%s,"c":null,"d":"2021"}`, v.want, v.want)
+		if got := string(b); got != want {
+			t.Errorf("got %#q, want %#q", got, want)
+		}
+	}
+	// The last option wins.
+	b, err := MarshalOpts(tm, UnixNanoTime(), UnixMilliTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `1614834367891`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Years outside of the range of the
+	// formatted times are allowed.
+	old := time.Date(-50, time.January, 1, 0, 0, 0, 0, time.UTC)
+	b, err = MarshalOpts(old, UnixMilliTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), strconv.FormatInt(old.UnixMilli(), 10); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	if _, err := MarshalOpts(old, UnixNanoTime()); err == nil {
+		t.Error("expected non-nil error")
+	}
+	// Keys of maps use the text form.
+	b, err = MarshalOpts(map[*time.Time]int{&tm: 1}, UnixMilliTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"2021-03-04T05:06:07.891234567Z":1}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
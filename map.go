@@ -2,7 +2,11 @@ package jettison
 
 import (
 	"bytes"
+	"reflect"
+	"sort"
 	"sync"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -15,10 +19,20 @@ var (
 type kv struct {
 	key    []byte
 	keyval []byte
+	val    interface{} // set only to sort by value
 }
 
 type mapElems struct{ s []kv }
 
+// cachedMapElems returns map elements from the
+// pool, or new ones with a capacity of n.
+func cachedMapElems(n int) *mapElems {
+	if v := mapElemsPool.Get(); v != nil {
+		return v.(*mapElems)
+	}
+	return &mapElems{s: make([]kv, 0, n)}
+}
+
 // releaseMapElems zeroes the content of the
 // map elements slice and resets the length to
 // zero before putting it back to the pool.
@@ -34,6 +48,208 @@ func (m mapElems) Len() int           { return len(m.s) }
 func (m mapElems) Swap(i, j int)      { m.s[i], m.s[j] = m.s[j], m.s[i] }
 func (m mapElems) Less(i, j int) bool { return bytes.Compare(m.s[i].key, m.s[j].key) < 0 }
 
+// byKey returns the sort.Interface that orders
+// the elements by key, as configured in opts.
+// The key type kt of the map and the prefix pfx
+// of its keys are used to sort integer keys by
+// their numeric value.
+func (m *mapElems) byKey(opts encOpts, kt reflect.Type, pfx []byte) sort.Interface {
+	if opts.flags.has(canonicalJSON) {
+		return canonicalMapElems{*m}
+	}
+	if less := opts.mapKeyLess(); less != nil {
+		return customMapElems{*m, less}
+	}
+	if opts.flags.has(numericMapKeys) && hasIntegerKeys(kt) {
+		off := 0
+		if pfx != nil {
+			off = len(appendEscapedBytes(nil, pfx, opts))
+		}
+		return intMapElems{*m, off}
+	}
+	if opts.flags.has(foldMapKeys) {
+		return foldedMapElems{*m}
+	}
+	return m
+}
+
+// hasIntegerKeys returns whether the keys of the
+// maps whose key type is kt are encoded as integers.
+// The key type of sync.Map values is nil.
+func hasIntegerKeys(kt reflect.Type) bool {
+	if kt == nil || !isInteger(kt) {
+		return false
+	}
+	return isRegisteredType(kt) || !kt.Implements(textMarshalerType)
+}
+
+// intMapElems orders the map elements by the
+// numeric value of their integer keys, which
+// are preceded by a prefix of length off.
+type intMapElems struct {
+	mapElems
+	off int
+}
+
+func (m intMapElems) Less(i, j int) bool {
+	return compareIntKeys(m.s[i].key[m.off:], m.s[j].key[m.off:]) < 0
+}
+
+// compareIntKeys compares the decimal representations
+// of two integers, without leading zeros.
+func compareIntKeys(a, b []byte) int {
+	an := len(a) != 0 && a[0] == '-'
+	bn := len(b) != 0 && b[0] == '-'
+	if an != bn {
+		if an {
+			return -1
+		}
+		return 1
+	}
+	c := len(a) - len(b)
+	if c == 0 {
+		c = bytes.Compare(a, b)
+	}
+	if an {
+		// The greater the absolute value
+		// of a negative integer, the lower.
+		c = -c
+	}
+	return c
+}
+
+// customMapElems orders the map elements by key
+// with the function of the MapKeySort option.
+type customMapElems struct {
+	mapElems
+	less func(a, b string) bool
+}
+
+func (m customMapElems) Less(i, j int) bool {
+	return m.less(b2s(m.s[i].key), b2s(m.s[j].key))
+}
+
+// foldedMapElems orders the map elements by key
+// case-insensitively, and then by original key.
+type foldedMapElems struct{ mapElems }
+
+func (m foldedMapElems) Less(i, j int) bool {
+	a, b := m.s[i].key, m.s[j].key
+	if c := compareFold(a, b); c != 0 {
+		return c < 0
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// compareFold compares a and b rune by rune,
+// after mapping the runes to lower case.
+func compareFold(a, b []byte) int {
+	for len(a) != 0 && len(b) != 0 {
+		ra, na := utf8.DecodeRune(a)
+		rb, nb := utf8.DecodeRune(b)
+		if ra, rb = unicode.ToLower(ra), unicode.ToLower(rb); ra != rb {
+			if ra < rb {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[na:], b[nb:]
+	}
+	return len(a) - len(b)
+}
+
+// sortByValue sorts the elements by value, using
+// the given function, while keeping the original
+// order of equal elements.
+func (m mapElems) sortByValue(less func(a, b interface{}) bool) {
+	sort.SliceStable(m.s, func(i, j int) bool {
+		return less(m.s[i].val, m.s[j].val)
+	})
+}
+
+// mergeRuns merges the consecutive runs of elements,
+// each one sorted according to by, whose end indexes
+// are given by ends. The merge is stable.
+func (m *mapElems) mergeRuns(ends []int, by sort.Interface) {
+	tmp := make([]kv, len(m.s))
+
+	for len(ends) > 1 {
+		lo, merged := 0, ends[:0]
+		for i := 0; i < len(ends); i += 2 {
+			if i+1 == len(ends) {
+				merged = append(merged, ends[i])
+				break
+			}
+			mid, hi := ends[i], ends[i+1]
+			m.mergeRun(tmp, lo, mid, hi, by)
+			merged = append(merged, hi)
+			lo = hi
+		}
+		ends = merged
+	}
+}
+
+// mergeRun merges the sorted runs of elements
+// [lo, mid) and [mid, hi), using tmp as scratch
+// space, which must be as long as the elements.
+func (m *mapElems) mergeRun(tmp []kv, lo, mid, hi int, by sort.Interface) {
+	i, j, k := lo, mid, lo
+	for i < mid && j < hi {
+		if by.Less(j, i) {
+			tmp[k] = m.s[j]
+			j++
+		} else {
+			tmp[k] = m.s[i]
+			i++
+		}
+		k++
+	}
+	k += copy(tmp[k:], m.s[i:mid])
+	copy(tmp[k:], m.s[j:hi])
+	copy(m.s[lo:hi], tmp[lo:hi])
+}
+
+// mapEntry holds the pointers to the
+// key and the value of a map entry.
+type mapEntry struct {
+	key unsafe.Pointer
+	val unsafe.Pointer
+}
+
+// mapShard holds a part of the entries of a map,
+// encoded and sorted by one of the goroutines of
+// encodeParallelMap.
+type mapShard struct {
+	ents []mapEntry
+	buf  *buffer
+	mel  *mapElems
+	err  error
+}
+
+// encode encodes the entries of the shard of a map of
+// type t, with the instructions ki and vi, and sorts
+// them by key.
+func (sh *mapShard) encode(opts encOpts, t reflect.Type, ki, vi instruction, pfx []byte) {
+	sh.buf = cachedBuffer()
+	sh.mel = cachedMapElems(len(sh.ents))
+
+	e := newMapElemEncoder(opts, t.Elem(), ki, vi, pfx)
+	for _, ent := range sh.ents {
+		if sh.err = e.encode(ent.key, ent.val, sh.buf, sh.mel); sh.err != nil {
+			return
+		}
+	}
+	sort.Sort(sh.mel.byKey(opts, t.Key(), pfx))
+}
+
+// release puts the elements and the buffer of
+// the shard back to their pool. The elements
+// point to the buffer, and are released first.
+func (sh *mapShard) release() {
+	releaseMapElems(sh.mel)
+	bufferPool.Put(sh.buf)
+}
+
 // hiter is the runtime representation
 // of a hashmap iteration structure.
 type hiter struct {
@@ -0,0 +1,128 @@
+package jettison
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"unicode"
+	"unsafe"
+)
+
+// keyNamer transforms the names of the struct
+// fields without an explicit name in their tag.
+// The fields are built and cached for each namer,
+// which is identified by its address.
+type keyNamer struct {
+	fn func(string) string
+}
+
+// namers interns the keyNamer of each function,
+// so that the instructions and fields built for
+// a function are reused by all the options that
+// are created with it.
+var namers sync.Map // map[unsafe.Pointer]*keyNamer
+
+// internNamer returns the keyNamer of fn. The
+// functions are identified by the address of their
+// value, which is the same for all the references
+// to a declared function, or to a closure created
+// once.
+func internNamer(fn func(string) string) *keyNamer {
+	id := *(*unsafe.Pointer)(unsafe.Pointer(&fn))
+	if kn, ok := namers.Load(id); ok {
+		return kn.(*keyNamer)
+	}
+	kn, _ := namers.LoadOrStore(id, &keyNamer{fn: fn})
+	return kn.(*keyNamer)
+}
+
+// fieldNaming defines the keys of the fields of
+// the structs: the key of the tags that name them,
+// and the namer of those without a name in their
+// tag. The instructions of the types that contain
+// structs are built for a naming.
+type fieldNaming struct {
+	tagKey string
+	namer  *keyNamer
+}
+
+var defaultNaming = fieldNaming{tagKey: defaultTagKey}
+
+// namedKey represents the name of a field
+// transformed by a keyNamer, and its keys.
+type namedKey struct {
+	name       string
+	keyNonEsc  []byte
+	keyEscHTML []byte
+	punyKey    *namedKey // nil if name is ASCII-only
+}
+
+func newNamedKey(name string) *namedKey {
+	var buf bytes.Buffer
+
+	// Unlike the names of the tags, the result
+	// of the function may contain any character
+	// that needs to be escaped.
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(name)
+
+	nonEsc := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	nonEsc = append(nonEsc, ':')
+
+	var esc bytes.Buffer
+	json.HTMLEscape(&esc, nonEsc)
+
+	return &namedKey{
+		name:       name,
+		keyNonEsc:  nonEsc,
+		keyEscHTML: esc.Bytes(),
+		punyKey:    newPunyKey(name),
+	}
+}
+
+// snakeCase converts a Go identifier to snake_case,
+// keeping the acronyms together, for example
+// UserID becomes user_id and HTTPServer, http_server.
+func snakeCase(s string) string {
+	var (
+		b  strings.Builder
+		rs = []rune(s)
+	)
+	b.Grow(len(s) + 4)
+
+	for i, r := range rs {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				prev := rs[i-1]
+				nextLower := i+1 < len(rs) && unicode.IsLower(rs[i+1])
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+					b.WriteByte('_')
+				}
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// camelCase converts a Go identifier to camelCase,
+// by lowering its leading uppercase letters, for
+// example ID becomes id and HTTPServer, httpServer.
+func camelCase(s string) string {
+	rs := []rune(s)
+
+	n := 0
+	for n < len(rs) && unicode.IsUpper(rs[n]) {
+		n++
+	}
+	if n > 1 && n < len(rs) {
+		n-- // first letter of the next word
+	}
+	for i := 0; i < n; i++ {
+		rs[i] = unicode.ToLower(rs[i])
+	}
+	return string(rs)
+}
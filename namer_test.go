@@ -0,0 +1,24 @@
+package jettison
+
+import "testing"
+
+func TestNamerCases(t *testing.T) {
+	for _, v := range []struct {
+		s, snake, camel string
+	}{
+		{"Name", "name", "name"},
+		{"ID", "id", "id"},
+		{"UserID", "user_id", "userID"},
+		{"HTTPServer", "http_server", "httpServer"},
+		{"Base64Data", "base64_data", "base64Data"},
+		{"lower", "lower", "lower"},
+		{"Ünïcode", "ünïcode", "ünïcode"},
+	} {
+		if got := snakeCase(v.s); got != v.snake {
+			t.Errorf("snakeCase(%q): got %q, want %q", v.s, got, v.snake)
+		}
+		if got := camelCase(v.s); got != v.camel {
+			t.Errorf("camelCase(%q): got %q, want %q", v.s, got, v.camel)
+		}
+	}
+}
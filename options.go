@@ -2,8 +2,14 @@ package jettison
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"time"
+	"unicode/utf8"
+	"unsafe"
 )
 
 // defaultTimeLayout is the default layout used
@@ -12,6 +18,14 @@ import (
 // Date's toJSON method implementation.
 const defaultTimeLayout = time.RFC3339Nano
 
+// RFC3339 layouts that use the numeric zone offset of
+// UTC times instead of the Z designator, used with the
+// ZuluAsOffset option.
+const (
+	rfc3339Offset     = "2006-01-02T15:04:05-07:00"
+	rfc3339NanoOffset = "2006-01-02T15:04:05.999999999-07:00"
+)
+
 // defaultDurationFmt is the default format used
 // to encode time.Duration values.
 const defaultDurationFmt = DurationNanoseconds
@@ -23,6 +37,7 @@ type Option func(*encOpts)
 type bitmask uint64
 
 func (b *bitmask) set(f bitmask)     { *b |= f }
+func (b *bitmask) unset(f bitmask)   { *b &^= f }
 func (b bitmask) has(f bitmask) bool { return b&f != 0 }
 
 const (
@@ -37,8 +52,58 @@ const (
 	noUTF8Coercion
 	noCompact
 	noNumberValidation
+	errorAsString
+	nilErrorEmptyObject
+	validateOutput
+	trustTemplateTypes
+	limitIfaceDepth
+	rejectEmptyMapKeys
+	prefixMapKeys
+	narrowIntegralFloats
+	uuidArrayAsString
+	keepUnknownBitFlags
+	indentOutput
+	sortStructFields
+	zuluAsOffset
+	fixedFloatPrecision
+	explicitDefaults
+	zeroNilPointers
+	resolveFuncValues
+	hexByteSlice
+	alignValues
+	trailingNewline
+	omitEmptyElements
+	punycodeKeys
+	limitDepth
+	numberAsString
+	detectCycles
+	unixMilliTime
+	unixMicroTime
+	unixNanoTime
+	hasDeadline
+	timeInLocation
+	truncateStrings
+	escapeNonASCII
+	escapeSlash
+	complexAsObject
+	foldMapKeys
+	canonicalJSON
+	apiVersioned
+	decimalSeparator
+	omitEmptyStructs
+	binaryMarshalerBase64
+	sqlValuer
+	streamStringReaders
+	mapPreview
+	numericMapKeys
+	boolAsInt
+	parallelMaps
 )
 
+// unixTimeFlags are the flags of the options that
+// encode time.Time values as Unix timestamps.
+const unixTimeFlags = unixTime | unixMilliTime | unixMicroTime | unixNanoTime
+
 type encOpts struct {
 	ctx         context.Context
 	timeLayout  string
@@ -46,6 +111,68 @@ type encOpts struct {
 	flags       bitmask
 	allowList   stringSet
 	denyList    stringSet
+	path        *fieldPath
+	depth       int
+	ifaceDepth  int
+	x           *extOpts
+}
+
+// extOpts holds the settings of the options that are
+// seldom used. They are kept apart from encOpts, that
+// is passed by value to every instruction, so that it
+// remains cheap to copy.
+type extOpts struct {
+	transform func([]byte) ([]byte, error)
+	mapKeys   stringSet
+	links     func(interface{}) map[string]string
+	keyPrefix []byte
+
+	indentPrefix string
+	indent       string
+	schemaKey    []byte
+	etagKey      []byte
+	etagHash     func([]byte) string
+	mapLess      func(a, b interface{}) bool
+	keyLess      func(a, b string) bool
+	floatFmt     byte
+	floatPrec    int
+	base64Enc    *base64.Encoding
+	sizeReport   func(key string, bytes int)
+	namer        *keyNamer
+	tagKey       string
+	mapMask      *MapMask
+	redacted     *MapMask
+	roles        stringSet
+	fieldFilter  func(path string, v reflect.Value) bool
+	filterPath   string
+
+	maxIfaceDepth int
+	maxDepth      int
+	apiVersion    int
+	previewMax    int
+	parallelMin   int
+	nullLit       []byte
+	radixPoint    rune
+
+	timeout  time.Duration
+	deadline time.Time
+	timeLoc  *time.Location
+
+	truncMax    int
+	truncSuffix []byte
+
+	// visiting holds the values being encoded
+	// with the DetectCycles option.
+	visiting map[visitKey]struct{}
+}
+
+// ext returns the extended options of eo,
+// allocating them on first use.
+func (eo *encOpts) ext() *extOpts {
+	if eo.x == nil {
+		eo.x = &extOpts{}
+	}
+	return eo.x
 }
 
 func defaultEncOpts() encOpts {
@@ -56,12 +183,53 @@ func defaultEncOpts() encOpts {
 	}
 }
 
+func applyEncOpts(opts []Option) (encOpts, error) {
+	eo := defaultEncOpts()
+
+	(&eo).apply(opts...)
+	if err := eo.validate(); err != nil {
+		return eo, &InvalidOptionError{err}
+	}
+	return eo, nil
+}
+
 func (eo *encOpts) apply(opts ...Option) {
 	for _, opt := range opts {
 		if opt != nil {
 			opt(eo)
 		}
 	}
+	if eo.flags.has(zuluAsOffset) {
+		// The zone elements of a layout that start
+		// with -07 never use the Z designator.
+		eo.timeLayout = strings.ReplaceAll(eo.timeLayout, "Z07", "-07")
+	}
+	if eo.ctx != nil {
+		if mm, ok := eo.ctx.Value(MapMaskKey).(*MapMask); ok && mm != nil {
+			eo.ext().mapMask = mm
+		}
+		if mm, ok := eo.ctx.Value(redactKey{}).(*MapMask); ok {
+			eo.ext().redacted = mm
+		}
+	}
+	eo.startDeadline()
+}
+
+// startDeadline sets the deadline of the Timeout
+// option from the current time, at the start of
+// the encoding of a top-level value.
+func (eo *encOpts) startDeadline() {
+	if !eo.flags.has(hasDeadline) {
+		return
+	}
+	// The deadline of the context, if any,
+	// applies when it is the earliest.
+	eo.x.deadline = time.Now().Add(eo.x.timeout)
+	if eo.ctx != nil {
+		if d, ok := eo.ctx.Deadline(); ok && d.Before(eo.x.deadline) {
+			eo.x.deadline = d
+		}
+	}
 }
 
 func (eo encOpts) validate() error {
@@ -72,15 +240,92 @@ func (eo encOpts) validate() error {
 		return fmt.Errorf("empty time layout")
 	case !eo.durationFmt.valid():
 		return fmt.Errorf("unknown duration format")
+	case eo.flags.has(limitIfaceDepth) && eo.x.maxIfaceDepth < 1:
+		return fmt.Errorf("invalid max interface depth")
+	case eo.flags.has(limitDepth) && eo.x.maxDepth < 1:
+		return fmt.Errorf("invalid max depth")
+	case eo.flags.has(fixedFloatPrecision) && strings.IndexByte("eEfgG", eo.x.floatFmt) < 0:
+		return fmt.Errorf("invalid float format %q", eo.x.floatFmt)
+	case eo.flags.has(fixedFloatPrecision) && (eo.x.floatPrec < -1 || eo.x.floatPrec < 0 && eo.x.floatFmt == 'f'):
+		return fmt.Errorf("invalid float precision")
+	case eo.flags.has(truncateStrings) && eo.x.truncMax < 0:
+		return fmt.Errorf("invalid max string length")
+	case eo.flags.has(timeInLocation) && eo.x.timeLoc == nil:
+		return fmt.Errorf("nil time location")
+	case eo.x != nil && eo.x.nullLit != nil && !json.Valid(eo.x.nullLit):
+		return fmt.Errorf("invalid null literal %q", eo.x.nullLit)
+	case eo.flags.has(mapPreview) && eo.x.previewMax < 0:
+		return fmt.Errorf("invalid map preview size")
+	case eo.flags.has(parallelMaps) && eo.x.parallelMin < 1:
+		return fmt.Errorf("invalid parallel threshold")
+	case eo.flags.has(apiVersioned) && eo.x.apiVersion < 1:
+		return fmt.Errorf("invalid API version")
+	case eo.flags.has(decimalSeparator) && (!utf8.ValidRune(eo.x.radixPoint) || eo.x.radixPoint == '"' || eo.x.radixPoint == '\\'):
+		return fmt.Errorf("invalid decimal separator %q", eo.x.radixPoint)
+	case eo.flags.has(decimalSeparator) && eo.flags.has(canonicalJSON):
+		return fmt.Errorf("canonical output and decimal separator are mutually exclusive")
+	case eo.flags.has(decimalSeparator) && eo.flags.has(indentOutput):
+		return fmt.Errorf("indented output and decimal separator are mutually exclusive")
+	case eo.flags.has(decimalSeparator) && eo.flags.has(validateOutput):
+		return fmt.Errorf("output validation and decimal separator are mutually exclusive")
+	case eo.flags.has(canonicalJSON) && eo.flags.has(indentOutput):
+		return fmt.Errorf("canonical and indented outputs are mutually exclusive")
+	case eo.flags.has(rawByteSlice) && eo.flags.has(hexByteSlice):
+		return fmt.Errorf("raw and hex byte slices are mutually exclusive")
 	default:
 		return nil
 	}
 }
 
+// depthExceeded returns whether the current depth
+// is beyond the limit set with the MaxDepth option.
+func (eo encOpts) depthExceeded() bool {
+	return eo.flags.has(limitDepth) && eo.depth > eo.x.maxDepth
+}
+
+// deadlineExceeded returns a DeadlineError if the
+// deadline set with the Timeout option has passed.
+func (eo encOpts) deadlineExceeded() error {
+	if eo.flags.has(hasDeadline) && !time.Now().Before(eo.x.deadline) {
+		return &DeadlineError{Timeout: eo.x.timeout}
+	}
+	return nil
+}
+
+// visitKey identifies a pointer, slice or map
+// value, as tracked by DetectCycles. The type
+// distinguishes a pointer to a struct from a
+// pointer to its first field.
+type visitKey struct {
+	typ reflect.Type
+	ptr unsafe.Pointer
+	len int
+}
+
+// visit records that the value identified by k
+// is being encoded, or returns a CycleError if it
+// already is, in which case k is part of a cycle.
+func (x *extOpts) visit(k visitKey) error {
+	if _, ok := x.visiting[k]; ok {
+		return &CycleError{Type: k.typ}
+	}
+	if x.visiting == nil {
+		x.visiting = make(map[visitKey]struct{})
+	}
+	x.visiting[k] = struct{}{}
+
+	return nil
+}
+
+// leave records that the value identified
+// by k is no longer being encoded.
+func (x *extOpts) leave(k visitKey) { delete(x.visiting, k) }
+
 // isDeniedField returns whether a struct field
 // identified by its name must be skipped during
-// the encoding of a struct.
-func (eo encOpts) isDeniedField(name string) bool {
+// the encoding of a struct, whose fields are
+// selected by the paths sel, if not nil.
+func (eo encOpts) isDeniedField(name string, sel *fieldPath) bool {
 	// The deny-list has precedence and must
 	// be checked first if it has entries.
 	if eo.denyList != nil {
@@ -88,16 +333,298 @@ func (eo encOpts) isDeniedField(name string) bool {
 			return true
 		}
 	}
-	if eo.allowList != nil {
-		if _, ok := eo.allowList[name]; !ok {
-			return true
+	if eo.allowList != nil || sel != nil {
+		if _, ok := eo.allowList[name]; ok {
+			return false
 		}
+		_, ok := sel.lookup(name)
+		return !ok
 	}
 	return false
 }
 
+// allowedMapKeys returns the set of map keys
+// that are to be encoded, or nil if all keys
+// are allowed.
+func (eo encOpts) allowedMapKeys() stringSet {
+	if eo.x == nil {
+		return nil
+	}
+	return eo.x.mapKeys
+}
+
+// mapValueLess returns the function used to sort
+// the entries of maps by value, if any.
+func (eo encOpts) mapValueLess() func(a, b interface{}) bool {
+	if eo.x == nil {
+		return nil
+	}
+	return eo.x.mapLess
+}
+
+// mapKeyLess returns the function set with
+// the MapKeySort option, if any.
+func (eo encOpts) mapKeyLess() func(a, b string) bool {
+	if eo.x == nil {
+		return nil
+	}
+	return eo.x.keyLess
+}
+
+// base64Encoding returns the encoding used
+// to encode byte slices in base64 form.
+func (eo encOpts) base64Encoding() *base64.Encoding {
+	if eo.x == nil || eo.x.base64Enc == nil {
+		return base64.StdEncoding
+	}
+	return eo.x.base64Enc
+}
+
+// sortedMap returns whether the entries of
+// maps must be sorted.
+func (eo encOpts) sortedMap() bool {
+	return !eo.flags.has(unsortedMap) || eo.flags.has(mapPreview) || eo.mapValueLess() != nil
+}
+
+// mapPreviewMax returns the maximum number of
+// elements of the maps set with the MapPreview
+// option, and whether it was set.
+func (eo encOpts) mapPreviewMax() (int, bool) {
+	if !eo.flags.has(mapPreview) {
+		return 0, false
+	}
+	return eo.x.previewMax, true
+}
+
+// parallelMap returns whether the elements of a
+// sorted map of length n are encoded by several
+// goroutines, as configured with the option
+// ParallelThreshold. The maps are never encoded
+// in parallel with a deadline, which the setup of
+// the goroutines would consume, or when cycles are
+// detected or fields filtered, because the visited
+// values and the path of the fields are shared.
+func (eo encOpts) parallelMap(n int) bool {
+	if !eo.flags.has(parallelMaps) || n <= eo.x.parallelMin {
+		return false
+	}
+	if eo.flags.has(hasDeadline) || eo.flags.has(detectCycles) || eo.x.fieldFilter != nil {
+		return false
+	}
+	_, ok := eo.ctx.Deadline()
+	return !ok
+}
+
+// fieldKeyPrefix returns the prefix to add to the
+// keys of the fields of a struct, which is nil if the
+// struct isn't the top-level value.
+func (eo encOpts) fieldKeyPrefix() []byte {
+	if eo.depth != 0 || eo.x == nil {
+		return nil
+	}
+	return eo.x.keyPrefix
+}
+
+// fieldSizeReport returns the function to call
+// with the size of the fields of a struct, which
+// is nil if the struct isn't the top-level value.
+func (eo encOpts) fieldSizeReport() func(string, int) {
+	if eo.depth != 0 || eo.x == nil {
+		return nil
+	}
+	return eo.x.sizeReport
+}
+
+// apiVersion returns the version set with the
+// APIVersion option, and whether it was set.
+func (eo encOpts) apiVersion() (int, bool) {
+	if !eo.flags.has(apiVersioned) {
+		return 0, false
+	}
+	return eo.x.apiVersion, true
+}
+
+// callerRoles returns the set of roles
+// configured with the WithRoles option.
+func (eo encOpts) callerRoles() stringSet {
+	if eo.x == nil {
+		return nil
+	}
+	return eo.x.roles
+}
+
+// fieldFilter returns the function set with
+// the FieldFilter option, if any.
+func (eo encOpts) fieldFilter() func(string, reflect.Value) bool {
+	if eo.x == nil {
+		return nil
+	}
+	return eo.x.fieldFilter
+}
+
+// tagKey returns the key of the struct tags
+// that define the fields' names and options.
+func (eo encOpts) tagKey() string {
+	if eo.x == nil || eo.x.tagKey == "" {
+		return defaultTagKey
+	}
+	return eo.x.tagKey
+}
+
+// mapMask returns the mask of the map
+// entries provided by the context, if any.
+func (eo encOpts) mapMask() *MapMask {
+	if eo.x == nil {
+		return nil
+	}
+	return eo.x.mapMask
+}
+
+// redactedFields returns the mask of the struct
+// fields set with RedactFields, which is nil if
+// the struct isn't the top-level value.
+func (eo encOpts) redactedFields() *MapMask {
+	if eo.depth != 0 || eo.x == nil {
+		return nil
+	}
+	return eo.x.redacted
+}
+
+// keyNamer returns the namer of the
+// struct fields' names, if any.
+func (eo encOpts) keyNamer() *keyNamer {
+	if eo.x == nil {
+		return nil
+	}
+	return eo.x.namer
+}
+
+// fieldNaming returns the naming of the
+// struct fields defined by the options.
+func (eo encOpts) fieldNaming() fieldNaming {
+	if eo.x == nil {
+		return defaultNaming
+	}
+	return fieldNaming{eo.tagKey(), eo.x.namer}
+}
+
+// mapKeyPrefix is similar to fieldKeyPrefix,
+// but for the keys of a map.
+func (eo encOpts) mapKeyPrefix() []byte {
+	if !eo.flags.has(prefixMapKeys) {
+		return nil
+	}
+	return eo.fieldKeyPrefix()
+}
+
 type stringSet map[string]struct{}
 
+// hasKey returns whether the unquoted JSON
+// representation of a map key is in the set.
+// A nil set is considered to contain all keys.
+func (s stringSet) hasKey(key []byte) bool {
+	if s == nil {
+		return true
+	}
+	_, ok := s[string(key)]
+	return ok
+}
+
+// hasAny returns whether one of the keys is in
+// the set. A nil set is considered to be empty.
+func (s stringSet) hasAny(keys []string) bool {
+	for _, k := range keys {
+		if _, ok := s[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldPath represents a tree of the dotted paths
+// of the fields selected with AllowList.
+type fieldPath struct {
+	leaf     bool
+	children map[string]*fieldPath
+}
+
+// lookup returns whether the field, or map entry,
+// identified by name is selected, and the paths
+// selected within its value, if any.
+func (fp *fieldPath) lookup(name string) (*fieldPath, bool) {
+	if fp == nil {
+		return nil, false
+	}
+	c, ok := fp.children[name]
+	if !ok {
+		return nil, false
+	}
+	if c.leaf {
+		return nil, true
+	}
+	return c, true
+}
+
+// insert adds the path represented by the
+// sequence of names to the tree.
+func (fp *fieldPath) insert(names []string) {
+	for _, n := range names {
+		if fp.leaf {
+			return // selects the whole subtree
+		}
+		c, ok := fp.children[n]
+		if !ok {
+			c = &fieldPath{children: make(map[string]*fieldPath)}
+			fp.children[n] = c
+		}
+		fp = c
+	}
+	fp.leaf = true
+	fp.children = nil
+}
+
+// fieldListToPaths returns the set of names of a list
+// of fields, or, if one of them is a dotted path, the
+// tree of paths of all the fields.
+func fieldListToPaths(list []string) (stringSet, *fieldPath) {
+	hasPath := false
+	for _, f := range list {
+		if strings.Contains(f, ".") {
+			hasPath = true
+			break
+		}
+	}
+	if !hasPath {
+		return fieldListToSet(list), nil
+	}
+	paths := &fieldPath{children: make(map[string]*fieldPath)}
+	for _, f := range list {
+		paths.insert(strings.Split(f, "."))
+	}
+	return nil, paths
+}
+
+// fieldSelectionToPath returns the tree of paths
+// represented by the field selection v, which is a
+// leaf unless v is a non-nil map.
+func fieldSelectionToPath(v interface{}) *fieldPath {
+	var fs map[string]interface{}
+	switch sel := v.(type) {
+	case FieldSelection:
+		fs = sel
+	case map[string]interface{}:
+		fs = sel
+	}
+	if fs == nil {
+		return &fieldPath{leaf: true}
+	}
+	fp := &fieldPath{children: make(map[string]*fieldPath, len(fs))}
+	for k, c := range fs {
+		fp.children[k] = fieldSelectionToPath(c)
+	}
+	return fp
+}
+
 func fieldListToSet(list []string) stringSet {
 	m := make(stringSet)
 	for _, f := range list {
@@ -111,7 +638,36 @@ func fieldListToSet(list []string) stringSet {
 // option, when used, has precedence over any
 // time layout confiured.
 func UnixTime() Option {
-	return func(o *encOpts) { o.flags.set(unixTime) }
+	return unixTimeOption(unixTime)
+}
+
+// UnixMilliTime is similar to UnixTime, but encodes
+// the timestamps in milliseconds, as expected by
+// JavaScript. It replaces the other Unix options.
+func UnixMilliTime() Option {
+	return unixTimeOption(unixMilliTime)
+}
+
+// UnixMicroTime is similar to UnixTime, but encodes
+// the timestamps in microseconds. It replaces the
+// other Unix options.
+func UnixMicroTime() Option {
+	return unixTimeOption(unixMicroTime)
+}
+
+// UnixNanoTime is similar to UnixTime, but encodes
+// the timestamps in nanoseconds. The time values
+// outside of the range of an int64 are reported as
+// an error. It replaces the other Unix options.
+func UnixNanoTime() Option {
+	return unixTimeOption(unixNanoTime)
+}
+
+func unixTimeOption(f bitmask) Option {
+	return func(o *encOpts) {
+		o.flags.unset(unixTimeFlags)
+		o.flags.set(f)
+	}
 }
 
 // UnsortedMap configures an encoder to skip
@@ -120,6 +676,34 @@ func UnsortedMap() Option {
 	return func(o *encOpts) { o.flags.set(unsortedMap) }
 }
 
+// CaseInsensitiveMapSort configures an encoder to sort
+// the keys of maps by their lower case form, so that the
+// keys that differ only in case are grouped. Those keys
+// are then sorted by their original bytes, which are
+// encoded unchanged. It has no effect with UnsortedMap.
+func CaseInsensitiveMapSort() Option {
+	return func(o *encOpts) { o.flags.set(foldMapKeys) }
+}
+
+// truncCountVerb is replaced by the number of bytes
+// omitted in the suffix of the TruncateStrings option.
+var truncCountVerb = []byte("%d")
+
+// TruncateStrings configures an encoder to truncate
+// the strings, and the byte slices or arrays encoded
+// as raw strings, that are longer than max runes.
+// Only their first max runes are encoded, followed by
+// suffix, in which the first %d verb is replaced with
+// the number of bytes omitted, such as "…(+%d bytes)".
+// The keys of the objects are never truncated.
+func TruncateStrings(max int, suffix string) Option {
+	return func(o *encOpts) {
+		o.flags.set(truncateStrings)
+		o.ext().truncMax = max
+		o.ext().truncSuffix = []byte(suffix)
+	}
+}
+
 // RawByteSlice configures an encoder to
 // encode byte slices as raw JSON strings,
 // rather than bas64-encoded strings.
@@ -127,12 +711,49 @@ func RawByteSlice() Option {
 	return func(o *encOpts) { o.flags.set(rawByteSlice) }
 }
 
+// HexByteSlice configures an encoder to
+// encode byte slices as strings of lowercase
+// hexadecimal characters, rather than
+// base64-encoded strings. It cannot be
+// used with RawByteSlice.
+func HexByteSlice() Option {
+	return func(o *encOpts) { o.flags.set(hexByteSlice) }
+}
+
 // ByteArrayAsString configures an encoder
 // to encode byte arrays as raw JSON strings.
 func ByteArrayAsString() Option {
 	return func(o *encOpts) { o.flags.set(byteArrayAsString) }
 }
 
+// UUIDArraysAsString configures an encoder to encode
+// the values of named byte array types of length 16,
+// such as UUID [16]byte, as JSON strings in the
+// canonical format of UUIDs. This option has
+// precedence over ByteArrayAsString for such types.
+func UUIDArraysAsString() Option {
+	return func(o *encOpts) { o.flags.set(uuidArrayAsString) }
+}
+
+// NullLiteral sets the JSON value written in place
+// of null for the nil values, such as the nil slices,
+// maps, pointers and interfaces, for the consumers that
+// expect a sentinel, such as "" or 0. It must be a valid
+// JSON value, but the output can't be decoded to nil
+// values by the encoding/json package. The nulls written
+// by the marshalers, and the strings "null", are left
+// unchanged, as are the NaN and infinite values of the
+// fields whose tag has the floatnull option. A nil
+// literal restores the default.
+func NullLiteral(lit []byte) Option {
+	if lit != nil {
+		lit = append(make([]byte, 0, len(lit)), lit...)
+	}
+	return func(o *encOpts) {
+		o.ext().nullLit = lit
+	}
+}
+
 // NilMapEmpty configures an encoder to
 // encode nil Go maps as empty JSON objects,
 // rather than null.
@@ -153,6 +774,28 @@ func NoStringEscaping() Option {
 	return func(o *encOpts) { o.flags.set(noStringEscaping) }
 }
 
+// EscapeAllNonASCII configures an encoder to escape
+// the characters of JSON strings that are outside of
+// the printable ASCII range, as \uXXXX sequences,
+// with surrogate pairs for the characters beyond the
+// Basic Multilingual Plane. The option is ignored if
+// NoStringEscaping is used. It has precedence over the
+// NoUTF8Coercion option: the invalid UTF-8 bytes, which
+// aren't ASCII characters either, are replaced with the
+// \ufffd sequence.
+func EscapeAllNonASCII() Option {
+	return func(o *encOpts) { o.flags.set(escapeNonASCII) }
+}
+
+// EscapeForwardSlash configures an encoder to escape
+// the solidus characters of JSON strings as \/, which
+// prevents the </script> sequence when the output is
+// embedded in HTML. The option is ignored if
+// NoStringEscaping is used.
+func EscapeForwardSlash() Option {
+	return func(o *encOpts) { o.flags.set(escapeSlash) }
+}
+
 // NoHTMLEscaping configures an encoder to
 // disable the escaping of problematic HTML
 // characters in JSON strings.
@@ -173,6 +816,14 @@ func NoNumberValidation() Option {
 	return func(o *encOpts) { o.flags.set(noNumberValidation) }
 }
 
+// JSONNumberAsString configures an encoder to encode
+// the json.Number values as JSON strings, rather than
+// as number literals. The values are still validated,
+// unless the NoNumberValidation option is used.
+func JSONNumberAsString() Option {
+	return func(o *encOpts) { o.flags.set(numberAsString) }
+}
+
 // NoCompact configures an encoder to disable
 // the compaction of the JSON output produced
 // by a call to MarshalJSON, or the content of
@@ -191,6 +842,26 @@ func TimeLayout(layout string) Option {
 	}
 }
 
+// TimeLocation sets the location in which time.Time
+// values are represented before being formatted with
+// a layout that includes a zone or an offset. It has
+// no effect on the Unix timestamps.
+func TimeLocation(loc *time.Location) Option {
+	return func(o *encOpts) {
+		o.flags.set(timeInLocation)
+		o.ext().timeLoc = loc
+	}
+}
+
+// ZuluAsOffset configures an encoder to write the
+// zone of UTC times as the numeric offset +00:00,
+// rather than with the Z designator, when the time
+// layout uses a zone element such as Z07:00, which
+// is the case of the default RFC3339 layout.
+func ZuluAsOffset() Option {
+	return func(o *encOpts) { o.flags.set(zuluAsOffset) }
+}
+
 // DurationFormat sets the format used to encode
 // time.Duration values.
 func DurationFormat(format DurationFmt) Option {
@@ -203,22 +874,131 @@ func DurationFormat(format DurationFmt) Option {
 // encoding. The context will be passed in to
 // the AppendJSONContext method of types that
 // implement the AppendMarshalerCtx interface.
+// It may also provide a MapMask, with the
+// MapMaskKey key.
 func WithContext(ctx context.Context) Option {
 	return func(o *encOpts) {
 		o.ctx = ctx
 	}
 }
 
+type mapMaskKey struct{}
+
+// MapMaskKey is the context key of the MapMask
+// used during encoding, if the context set with
+// the WithContext option has a value for it.
+var MapMaskKey = mapMaskKey{}
+
+// MapMask represents a set of map keys whose
+// values are replaced with a string during
+// encoding, to redact the entries of maps
+// per request, without changing the options.
+type MapMask struct {
+	keys        stringSet
+	replacement []byte
+}
+
+// NewMapMask returns a mask that replaces the values
+// of the map entries whose key is one of keys with the
+// string replacement. The keys are compared with the
+// text of the unquoted JSON representation of the
+// maps' keys, before its characters are escaped.
+func NewMapMask(replacement string, keys ...string) *MapMask {
+	return &MapMask{
+		keys:        fieldListToSet(keys),
+		replacement: []byte(replacement),
+	}
+}
+
+// hasKey returns whether the unquoted JSON
+// representation of a map key is masked.
+func (mm *MapMask) hasKey(key []byte) bool {
+	if mm == nil {
+		return false
+	}
+	_, ok := mm.keys[string(unescapeKey(key))]
+	return ok
+}
+
+// hasField returns whether the
+// struct field named name is masked.
+func (mm *MapMask) hasField(name string) bool {
+	if mm == nil {
+		return false
+	}
+	_, ok := mm.keys[name]
+	return ok
+}
+
+// appendReplacement appends the replacement
+// of the masked values to dst, as a string.
+func (mm *MapMask) appendReplacement(dst []byte, opts encOpts) []byte {
+	dst = append(dst, '"')
+	dst = appendEscapedBytes(dst, mm.replacement, opts)
+	return append(dst, '"')
+}
+
+type redactKey struct{}
+
+// RedactedValue is the string that replaces the
+// values of the fields redacted by RedactFields.
+const RedactedValue = "**REDACTED**"
+
+// RedactFields returns a copy of ctx that carries the
+// names of the struct fields whose values are replaced
+// with RedactedValue during encoding, when it is set
+// with the WithContext option. The names are compared
+// with the keys of the fields of the top-level struct
+// only, and aren't paths. The type of the struct doesn't
+// need to implement any interface.
+func RedactFields(ctx context.Context, fields []string) context.Context {
+	return context.WithValue(ctx, redactKey{}, NewMapMask(RedactedValue, fields...))
+}
+
 // AllowList sets the list of fields which are to be
 // considered when encoding a struct.
 // The fields are identified by the name that is
 // used in the final JSON payload.
 // See DenyFields documentation for more information
 // regarding joint use with this option.
+// A name that contains dots, such as "user.address.city",
+// is a path that selects a field, or map entry, nested
+// in the top-level value, and omits its siblings at each
+// level. When the list contains a path, the names without
+// dots are paths of a single element, and the whole value
+// of the selected fields is encoded. A path that doesn't
+// resolve produces no field.
 func AllowList(fields []string) Option {
-	m := fieldListToSet(fields)
+	m, paths := fieldListToPaths(fields)
 	return func(o *encOpts) {
 		o.allowList = m
+		o.path = paths
+	}
+}
+
+// FieldSelection represents a tree of the fields to
+// select with the WithFieldTree option. The keys are
+// the names of the fields, or map keys, and the values
+// are either a FieldSelection, or a map[string]interface{},
+// to select some of the fields nested in the value of
+// the field, or any other value, such as nil, to select
+// its whole value.
+type FieldSelection map[string]interface{}
+
+// WithFieldTree is similar to AllowList with dotted
+// paths, but the fields to encode are given as a tree,
+// like the selection sets of GraphQL. The selection
+// applies to the elements of the arrays and slices,
+// and it replaces the one of AllowList. A nil tree
+// selects all the fields.
+func WithFieldTree(tree FieldSelection) Option {
+	var paths *fieldPath
+	if tree != nil {
+		paths = fieldSelectionToPath(tree)
+	}
+	return func(o *encOpts) {
+		o.allowList = nil
+		o.path = paths
 	}
 }
 
@@ -232,3 +1012,729 @@ func DenyList(fields []string) Option {
 		o.denyList = m
 	}
 }
+
+// WithRoles sets the roles of the caller, which select
+// the struct fields that have a roles tag, such as
+// `json:"salary" roles:"admin,hr"`. Such a field is
+// encoded only if one of its roles is in the list.
+// The fields without roles tag are always encoded,
+// and those with one are omitted without this option.
+// The roles of an embedded struct apply to each of its
+// promoted fields, which must then match both lists.
+func WithRoles(roles ...string) Option {
+	m := fieldListToSet(roles)
+	return func(o *encOpts) {
+		o.ext().roles = m
+	}
+}
+
+// FieldFilter sets a function called for each field
+// of the structs, with the path of the field and its
+// value, which must not be modified, that reports
+// whether the field is encoded. The path is the keys
+// of the field and of its enclosing fields, separated
+// by dots, such as "user.address.city"; the elements
+// of arrays, slices and maps don't add to the path.
+// The function is called after the omitempty and
+// omitnil options of the field's tag are applied.
+// The value is obtained with the reflect package,
+// which has a cost for each field of each struct.
+func FieldFilter(fn func(path string, v reflect.Value) bool) Option {
+	return func(o *encOpts) {
+		o.ext().fieldFilter = fn
+	}
+}
+
+// OutputTransform sets a function that is applied
+// to the complete JSON output before it is returned
+// by MarshalOpts, or appended to the destination
+// buffer by AppendOpts. It can be used to compress
+// or sign the payload in the same call.
+// The whole output is buffered before the function
+// is called, and as such, this option is not suited
+// for streaming use cases. The newline of the Newline
+// option is written after the output is transformed.
+func OutputTransform(fn func([]byte) ([]byte, error)) Option {
+	return func(o *encOpts) {
+		o.ext().transform = fn
+	}
+}
+
+// WithMapKeys sets the list of keys which are to be
+// considered when encoding a map, or a sync.Map.
+// The keys are identified by the text of their
+// representation in the final JSON payload, without
+// quotes, before its characters are escaped. Keys
+// of the list that are absent from a map are ignored.
+func WithMapKeys(keys []string) Option {
+	m := fieldListToSet(keys)
+	return func(o *encOpts) {
+		o.ext().mapKeys = m
+	}
+}
+
+// ErrorAsString configures an encoder to encode
+// the values of types that implement the builtin
+// error interface as JSON strings, using the result
+// of their Error method. Nil errors are encoded as
+// null, unless NilErrorAsEmptyObject is used. The
+// marshaler interfaces, such as json.Marshaler, have
+// precedence over this option.
+func ErrorAsString() Option {
+	return func(o *encOpts) { o.flags.set(errorAsString) }
+}
+
+// BinaryMarshalerAsBase64 configures an encoder to
+// encode the values of types that implement the
+// encoding.BinaryMarshaler interface as JSON strings,
+// using the base64 encoding of the result of their
+// MarshalBinary method, as the byte slices. Nil
+// pointers are encoded as null. The marshaler
+// interfaces, such as encoding.TextMarshaler, have
+// precedence over this option.
+func BinaryMarshalerAsBase64() Option {
+	return func(o *encOpts) { o.flags.set(binaryMarshalerBase64) }
+}
+
+// SQLNull configures an encoder to encode the values
+// of types that implement the driver.Valuer interface,
+// such as sql.NullString, with the value returned by
+// their Value method, or null if it is nil, rather
+// than as structs. The marshaler interfaces, such as
+// json.Marshaler, have precedence over this option.
+func SQLNull() Option {
+	return func(o *encOpts) { o.flags.set(sqlValuer) }
+}
+
+// StreamStringReaders configures an encoder to encode
+// the values of types that implement the StringReader
+// interface as JSON strings, whose text is read from
+// the reader returned by their JSONStringReader method
+// and escaped by chunks. Only the copy of the source
+// text as a Go string is avoided, the escaped text is
+// appended in full to the destination buffer. A nil
+// reader is encoded as null, and a reader is never
+// closed. The marshaler interfaces, such as
+// json.Marshaler, have precedence over this option.
+func StreamStringReaders() Option {
+	return func(o *encOpts) { o.flags.set(streamStringReaders) }
+}
+
+// NilErrorAsEmptyObject configures an encoder to
+// encode nil values of interface types that embed
+// the builtin error interface as empty JSON objects,
+// rather than null.
+func NilErrorAsEmptyObject() Option {
+	return func(o *encOpts) { o.flags.set(nilErrorEmptyObject) }
+}
+
+// ValidateOutput configures an encoder to verify
+// that the complete output is valid JSON before
+// it is returned, which can help to catch faulty
+// custom marshalers or raw messages used along
+// with the NoCompact option. This requires an
+// additional scan of the output, and because the
+// whole output must be buffered, it doesn't suit
+// streaming use cases.
+func ValidateOutput() Option {
+	return func(o *encOpts) { o.flags.set(validateOutput) }
+}
+
+// TrustTemplateTypes configures an encoder to
+// disable the escaping of problematic HTML
+// characters in the values of the string types
+// of the html/template package, such as HTML or
+// JS, whose content is considered safe.
+func TrustTemplateTypes() Option {
+	return func(o *encOpts) { o.flags.set(trustTemplateTypes) }
+}
+
+// HypermediaLinks sets a function that is called
+// with the top-level value, if it is a struct or a
+// pointer to a struct, and whose result is added
+// to the output as an object of relation names and
+// URLs, with the key _links. Nothing is added if the
+// function returns an empty map, or if the struct
+// already has a field named _links.
+func HypermediaLinks(fn func(v interface{}) map[string]string) Option {
+	return func(o *encOpts) {
+		o.ext().links = fn
+	}
+}
+
+// MaxInterfaceDepth sets the maximum number of nested
+// interface values that are encoded. Beyond this limit,
+// the dynamic values of interfaces are replaced by the
+// string "<truncated>", rather than being encoded. The
+// top-level value passed to MarshalOpts is not counted.
+// This is useful to bound the encoding of untrusted
+// generic data, such as map[string]interface{} trees.
+func MaxInterfaceDepth(n int) Option {
+	return func(o *encOpts) {
+		o.flags.set(limitIfaceDepth)
+		o.ext().maxIfaceDepth = n
+	}
+}
+
+// DetectCycles configures an encoder to return a
+// CycleError when a pointer, slice or map value is
+// encountered again while it is being encoded, as
+// part of a cycle. The values that are reachable
+// from several paths, but aren't part of a cycle,
+// are encoded as usual. Unlike MaxDepth, it has a
+// cost for every pointer, slice and map encoded.
+func DetectCycles() Option {
+	return func(o *encOpts) {
+		o.flags.set(detectCycles)
+		o.ext()
+	}
+}
+
+// APIVersion sets the version of the API for which the
+// structs are encoded. The fields whose tag has the since
+// option, such as `json:"name,since=2"`, are omitted for
+// the earlier versions, and those with the until option
+// for the later versions. The versions start at 1, and
+// the structs that have a field whose tag has an invalid
+// version cannot be encoded, even without this option.
+// Without this option, all the fields are encoded.
+func APIVersion(n int) Option {
+	return func(o *encOpts) {
+		o.flags.set(apiVersioned)
+		o.ext().apiVersion = n
+	}
+}
+
+// MaxDepth sets the maximum number of nested objects
+// and arrays that are encoded. Beyond this limit, the
+// encoding stops and ErrMaxDepthExceeded is returned,
+// which bounds the recursion caused by a pointer cycle
+// rather than overflowing the stack. The top-level
+// object or array is at depth 1.
+func MaxDepth(n int) Option {
+	return func(o *encOpts) {
+		o.flags.set(limitDepth)
+		o.ext().maxDepth = n
+	}
+}
+
+// Timeout sets the maximum duration of the encoding
+// of a top-level value, such as each value written to
+// a Stream. The time is checked at the beginning of
+// each array and map,
+// and a DeadlineError is returned once it elapsed.
+// The deadline of the context set with WithContext
+// is also honoured if it is earlier.
+func Timeout(d time.Duration) Option {
+	return func(o *encOpts) {
+		o.flags.set(hasDeadline)
+		o.ext().timeout = d
+	}
+}
+
+// RejectEmptyMapKeys configures an encoder to return
+// an error when the key of a map, or a sync.Map, has
+// an empty representation, which may be the result of
+// a faulty encoding.TextMarshaler implementation.
+func RejectEmptyMapKeys() Option {
+	return func(o *encOpts) { o.flags.set(rejectEmptyMapKeys) }
+}
+
+// KeyPrefix sets a prefix to add to the keys of the
+// fields of the top-level struct. Keys of nested
+// values are left untouched. See PrefixMapKeys to
+// also add the prefix to the keys of a top-level map.
+func KeyPrefix(prefix string) Option {
+	return func(o *encOpts) {
+		o.ext().keyPrefix = []byte(prefix)
+	}
+}
+
+// PrefixMapKeys configures an encoder to add the
+// prefix set with KeyPrefix to the keys of the
+// top-level map, or sync.Map.
+func PrefixMapKeys() Option {
+	return func(o *encOpts) { o.flags.set(prefixMapKeys) }
+}
+
+// NarrowIntegralFloats configures an encoder to
+// encode the floating-point numbers that have no
+// fractional part, and are within the range of an
+// int64, as integers, and never as a negative zero.
+// This is useful to re-encode numbers decoded as
+// float64 values by the encoding/json package.
+func NarrowIntegralFloats() Option {
+	return func(o *encOpts) { o.flags.set(narrowIntegralFloats) }
+}
+
+// Profile represents a preset of the options
+// that control the escaping of JSON strings.
+type Profile int
+
+// Profile constants.
+const (
+	// ProfileStrict enables the escaping of JSON
+	// strings, the escaping of HTML characters and
+	// the coercion to valid UTF-8, which produces
+	// the same output as the encoding/json package.
+	ProfileStrict Profile = iota
+
+	// ProfileWeb enables the same escaping as
+	// ProfileStrict, and the escaping of the solidus
+	// character, which is suited for outputs embedded
+	// in HTML documents, such as in a script element.
+	// The U+2028 and U+2029 characters are escaped, but
+	// not the other non-ASCII characters.
+	ProfileWeb
+
+	// ProfileRaw enables the escaping of JSON strings
+	// only, which is the minimal escaping required to
+	// produce a valid output. HTML characters are not
+	// escaped and invalid UTF-8 bytes are left as is.
+	// It is intended for trusted internal use.
+	ProfileRaw
+)
+
+// EscapingProfile configures an encoder to use the
+// escaping options defined by the profile p, which
+// overrides the options NoStringEscaping, NoHTMLEscaping
+// and NoUTF8Coercion given before it. ProfileWeb also
+// overrides the options EscapeForwardSlash and
+// EscapeAllNonASCII. An unknown profile is ignored.
+func EscapingProfile(p Profile) Option {
+	return func(o *encOpts) {
+		switch p {
+		case ProfileStrict:
+			o.flags.unset(noStringEscaping | noHTMLEscaping | noUTF8Coercion)
+		case ProfileWeb:
+			o.flags.unset(noStringEscaping | noHTMLEscaping | noUTF8Coercion | escapeNonASCII)
+			o.flags.set(escapeSlash)
+		case ProfileRaw:
+			o.flags.unset(noStringEscaping)
+			o.flags.set(noHTMLEscaping | noUTF8Coercion)
+		}
+	}
+}
+
+// KeepUnknownBitFlags configures an encoder to include
+// the bits that don't belong to a named flag in the
+// arrays of the types registered with BitFlagStrings,
+// as the numeric value of each bit.
+func KeepUnknownBitFlags() Option {
+	return func(o *encOpts) { o.flags.set(keepUnknownBitFlags) }
+}
+
+// Indent configures an encoder to format the output
+// like the json.MarshalIndent function, with each JSON
+// element on a new line that starts with prefix, followed
+// by one or more copies of indent according to the nesting.
+// The output is reformatted once fully encoded, and as
+// such, this option is not suited for streaming use cases.
+func Indent(prefix, indent string) Option {
+	return func(o *encOpts) {
+		o.flags.set(indentOutput)
+		o.ext().indentPrefix = prefix
+		o.ext().indent = indent
+	}
+}
+
+// GoldenFormat configures an encoder to produce a
+// stable output that is easy to read and compare,
+// such as the content of golden files for tests.
+// It is a shortcut for the following settings:
+//   - Indent("", "  ")
+//   - the keys of maps are sorted, which overrides
+//     a previous UnsortedMap option
+//   - the fields of structs are sorted by name,
+//     rather than in the order of declaration
+//   - NoHTMLEscaping()
+func GoldenFormat() Option {
+	return func(o *encOpts) {
+		Indent("", "  ")(o)
+		SortKeys()(o)
+		o.flags.set(noHTMLEscaping)
+	}
+}
+
+// Canonical configures an encoder to produce the canonical
+// form of the JSON Canonicalization Scheme (RFC 8785), as
+// required to sign or hash the output, which guarantees:
+//   - the keys of the objects are sorted by their UTF-16
+//     code units, like SortKeys, at any depth
+//   - there is no whitespace between the tokens
+//   - the strings escape only the double quote, backslash
+//     and control characters, with the short sequences of
+//     \b, \t, \n, \f and \r where possible
+//   - the numbers are serialized like the toString method
+//     of JavaScript numbers, which loses the precision of
+//     the integers beyond 2^53, as IEEE 754 doubles
+//
+// The strings, numbers and objects are rewritten after
+// encoding, including those of the output of marshalers,
+// whose members are sorted too. It cannot be used with
+// Indent.
+func Canonical() Option {
+	return func(o *encOpts) {
+		SortKeys()(o)
+		o.flags.set(canonicalJSON | noHTMLEscaping)
+	}
+}
+
+// SortKeys configures an encoder to write the keys of
+// all the objects in lexicographical order, at any depth.
+// The fields of structs are sorted by their final key,
+// once transformed by options such as KeyNamer and
+// PunycodeKeys, rather than in the order of declaration,
+// and the keys of maps are sorted, which overrides a
+// previous UnsortedMap option. The output of the types
+// that implement one of the marshaler interfaces is
+// left unchanged.
+func SortKeys() Option {
+	return func(o *encOpts) {
+		o.flags.unset(unsortedMap)
+		o.flags.set(sortStructFields)
+	}
+}
+
+// SortStructFields configures an encoder to write the
+// fields of structs sorted by their final key, like the
+// SortKeys option, including the promoted fields of
+// embedded structs, rather than in the order of
+// declaration. Unlike SortKeys, the order of the keys
+// of maps is left unchanged. The sorted fields are
+// computed once per type, with the other information
+// of its fields.
+func SortStructFields() Option {
+	return func(o *encOpts) { o.flags.set(sortStructFields) }
+}
+
+// IncludeSchema configures an encoder to wrap the
+// top-level value, if it implements the SchemaProvider
+// interface, in a JSON object that contains the schema
+// returned by the JSONSchema method with the given key,
+// and the value itself with the key data.
+func IncludeSchema(key string) Option {
+	return func(o *encOpts) {
+		o.ext().schemaKey = []byte(key)
+	}
+}
+
+// ComputeETag configures an encoder to add a member
+// with the given key to the top-level value, if it is
+// encoded as a JSON object, whose value is the string
+// returned by hash for a canonical encoding of the value.
+// The canonical encoding is that of the Canonical option
+// with the default options, whatever the options of the
+// caller, except ComplexAsObject and ResolveFuncValues,
+// so that the etag only depends on the value. Note that
+// the value is encoded twice, the callbacks of options
+// such as FieldSizeReport being called once. If the
+// object already has a member with the key, the error
+// ErrETagKeyConflict is returned.
+func ComputeETag(key string, hash func([]byte) string) Option {
+	return func(o *encOpts) {
+		o.ext().etagKey = []byte(key)
+		o.ext().etagHash = hash
+	}
+}
+
+// MapPreview configures an encoder to encode at most
+// max elements of each map, the first in sort order,
+// followed by an element whose key is "…" and value
+// indicates the number of elements omitted, such as
+// "<42 more>". The maps are sorted even with the
+// UnsortedMap option.
+func MapPreview(max int) Option {
+	return func(o *encOpts) {
+		o.flags.set(mapPreview)
+		o.ext().previewMax = max
+	}
+}
+
+// NumericMapKeys configures an encoder to sort the
+// keys of the maps with integer keys by their numeric
+// value, such as 2 before 10, rather than in the
+// lexicographical order of their representations,
+// which is that of the encoding/json package. The
+// MapKeySort and Canonical options have precedence.
+func NumericMapKeys() Option {
+	return func(o *encOpts) { o.flags.set(numericMapKeys) }
+}
+
+// ParallelThreshold configures an encoder to encode
+// the elements of the sorted maps that have more than
+// n elements with several goroutines, each one sorting
+// its share, before merging them in order. The output
+// is identical to that of the serial encoding, but the
+// marshalers of the keys and values, and the function
+// of the MapKeySort option, may be called concurrently.
+// This has no effect with a deadline, set by the Timeout
+// option or the context of WithContext, or with the
+// DetectCycles and FieldFilter options. The maps are
+// not encoded in parallel by default.
+func ParallelThreshold(n int) Option {
+	return func(o *encOpts) {
+		o.flags.set(parallelMaps)
+		o.ext().parallelMin = n
+	}
+}
+
+// MapKeySort sets the function that reports whether the
+// key a of a map must be written before the key b, when
+// the maps are sorted, rather than the lexicographical
+// order. The keys are in their escaped JSON form, without
+// quotes, and must not be retained after the function
+// returns. It has no effect with the UnsortedMap option,
+// and the Canonical option has precedence over it.
+func MapKeySort(less func(a, b string) bool) Option {
+	return func(o *encOpts) {
+		o.ext().keyLess = less
+	}
+}
+
+// MapSortByValue sets a function that reports whether
+// the value a of a map, or sync.Map, entry must sort
+// before the value b of another entry. When set, the
+// entries are sorted by value rather than by key, and
+// those with equal values are sorted by key. This has
+// precedence over UnsortedMap. Each value is copied to
+// an interface, which has a cost for large maps.
+func MapSortByValue(less func(a, b interface{}) bool) Option {
+	return func(o *encOpts) {
+		o.ext().mapLess = less
+	}
+}
+
+// FloatPrecision configures an encoder to encode
+// floating-point numbers without exponent, and
+// with exactly prec digits after the decimal point,
+// rounding the numbers if necessary.
+func FloatPrecision(prec int) Option {
+	return FloatFormat('f', prec)
+}
+
+// FloatFormat configures an encoder to encode the
+// floating-point numbers with the strconv.AppendFloat
+// function, using the format fmt, one of 'e', 'E', 'f',
+// 'g' or 'G', and the precision prec, rather than in
+// the shortest representation. The precision -1, which
+// uses the smallest number of digits necessary, is not
+// accepted for the 'f' format. It replaces the settings
+// of the FloatPrecision option.
+func FloatFormat(fmt byte, prec int) Option {
+	return func(o *encOpts) {
+		o.flags.set(fixedFloatPrecision)
+		o.ext().floatFmt = fmt
+		o.ext().floatPrec = prec
+	}
+}
+
+// DecimalSeparator configures an encoder to write the
+// rune r in place of the decimal point of the floating
+// point numbers, such as 3,14 rather than 3.14.
+//
+// WARNING: the output is NOT valid JSON, and can't be
+// decoded by a conforming parser, since a comma is also
+// the separator of the elements of arrays and objects.
+// This option is only meant for the consumers that expect
+// numbers formatted for a locale, such as the exports
+// converted to CSV for spreadsheets. The double quote and
+// backslash characters are not accepted.
+// It cannot be used with the options that parse the
+// output, which are Canonical, Indent and ValidateOutput,
+// and the encoding of a struct field with the indent
+// option in its tag fails with an InvalidOptionError.
+func DecimalSeparator(r rune) Option {
+	return func(o *encOpts) {
+		o.flags.set(decimalSeparator)
+		o.ext().radixPoint = r
+	}
+}
+
+// OmitEmptyStructs configures an encoder to omit the
+// struct fields with the omitempty option in their tag
+// whose value is the zero value of their struct type,
+// unlike the encoding/json package. The fields that are
+// pointers to structs are omitted only if they are nil.
+// With the OmitEmptyElements option, it also applies to
+// the struct elements of slices and arrays.
+// The zero values are detected like the IsZero method
+// of the reflect.Value type does, without reflection.
+// It has no effect on the types registered with the
+// EmptyPredicate function, whose predicate applies.
+func OmitEmptyStructs() Option {
+	return func(o *encOpts) { o.flags.set(omitEmptyStructs) }
+}
+
+// ExplicitDefaults configures an encoder to encode
+// every field of a struct, ignoring the omitempty and
+// omitnil options of the fields' tags. Nil slices and
+// maps are encoded as empty JSON arrays and objects,
+// and nil pointers as the zero-value of their element
+// type, except for the pointers to structs encoded as
+// JSON objects, which are encoded as null. Nil pointers
+// found within such zero-value are encoded as null.
+func ExplicitDefaults() Option {
+	return func(o *encOpts) {
+		o.flags.set(explicitDefaults)
+		o.flags.set(zeroNilPointers)
+		o.flags.set(nilSliceEmpty)
+		o.flags.set(nilMapEmpty)
+	}
+}
+
+// ResolveFuncValues configures an encoder to call
+// the functions of type func() interface{} and
+// func() (interface{}, error) found in the value,
+// and encode their result in place. A non-nil error
+// returned by a function is wrapped in a MarshalerError.
+// Nil functions are encoded as null.
+func ResolveFuncValues() Option {
+	return func(o *encOpts) { o.flags.set(resolveFuncValues) }
+}
+
+// BoolAsInt configures an encoder to encode the
+// booleans as the JSON numbers 1 and 0, rather
+// than true and false, at any depth. With the
+// string option of a field's tag, the numbers
+// are quoted.
+func BoolAsInt() Option {
+	return func(o *encOpts) { o.flags.set(boolAsInt) }
+}
+
+// ComplexAsObject configures an encoder to encode
+// complex numbers as objects with the real and imag
+// members, such as {"real":1,"imag":2}, rather than
+// returning an UnsupportedTypeError. Both parts are
+// encoded like floats, and the same options apply.
+func ComplexAsObject() Option {
+	return func(o *encOpts) { o.flags.set(complexAsObject) }
+}
+
+// Base64Encoding sets the encoding used to encode
+// byte slices in base64 form, such as
+// base64.URLEncoding or base64.RawStdEncoding.
+// The default is base64.StdEncoding, which is
+// also restored by a nil encoding. This has no
+// effect on the byte slices encoded with the
+// RawByteSlice or HexByteSlice options, or the
+// raw and hex tag options.
+func Base64Encoding(enc *base64.Encoding) Option {
+	return func(o *encOpts) {
+		o.ext().base64Enc = enc
+	}
+}
+
+// Base64URLNoPad is a shortcut for the Base64Encoding
+// option with base64.RawURLEncoding, the unpadded
+// encoding with the URL and file name safe alphabet,
+// used by JSON Web Tokens.
+func Base64URLNoPad() Option {
+	return Base64Encoding(base64.RawURLEncoding)
+}
+
+// FieldSizeReport sets a function called after each
+// field of a top-level struct is encoded, with the
+// name of the field and the number of bytes written
+// for its key and value. The sizes are measured
+// before the output is indented.
+func FieldSizeReport(fn func(key string, bytes int)) Option {
+	return func(o *encOpts) {
+		o.ext().sizeReport = fn
+	}
+}
+
+// KeyNamer sets a function that transforms the name
+// of the struct fields that don't have an explicit
+// name in their tag, such as the SnakeCase and
+// CamelCase options do. The names are transformed
+// before the rules of promotion of embedded structs
+// apply, and a field with an explicit name in its tag
+// dominates the others with the same name. The fields
+// are matched by their transformed name with AllowList
+// and DenyList. The instructions are built and cached
+// for each function, such as strings.ToLower, which
+// is identified by its value: a closure should be
+// created once and reused rather than per call.
+func KeyNamer(fn func(string) string) Option {
+	var kn *keyNamer
+	if fn != nil {
+		kn = internNamer(fn)
+	}
+	return func(o *encOpts) {
+		o.ext().namer = kn
+	}
+}
+
+// SnakeCase configures an encoder to use the snake_case
+// form of the name of the struct fields that don't have
+// an explicit name in their tag. The acronyms are kept
+// together, for example UserID becomes user_id.
+func SnakeCase() Option {
+	return snakeCaseOpt
+}
+
+// CamelCase configures an encoder to use the camelCase
+// form of the name of the struct fields that don't have
+// an explicit name in their tag. The leading acronyms
+// are lowered, for example HTTPServer becomes httpServer.
+func CamelCase() Option {
+	return camelCaseOpt
+}
+
+var (
+	snakeCaseOpt = KeyNamer(snakeCase)
+	camelCaseOpt = KeyNamer(camelCase)
+)
+
+// AlignValues configures an encoder to pad the keys
+// of the members of each object with spaces, so that
+// the colons and the values that follow are aligned
+// in a column. It has effect only with the Indent
+// option, and requires an extra pass on the indented
+// output. The output remains valid JSON, the spaces
+// being insignificant.
+func AlignValues() Option {
+	return func(o *encOpts) { o.flags.set(alignValues) }
+}
+
+// TagKey sets the key of the struct tags that define
+// the name and options of the fields, such as "db",
+// instead of "json". The fields without a tag with
+// the key use their name. The instructions for the
+// struct types are generated for each key on first
+// use. An empty key restores the default.
+func TagKey(key string) Option {
+	return func(o *encOpts) {
+		o.ext().tagKey = key
+	}
+}
+
+// Newline configures an encoder to write a newline
+// character after the JSON representation of the
+// value, like the Encode method of json.Encoder
+// does, which is useful to produce NDJSON.
+func Newline() Option {
+	return func(o *encOpts) { o.flags.set(trailingNewline) }
+}
+
+// OmitEmptyElements configures an encoder to omit
+// the elements of slices and arrays that are empty,
+// as defined for the omitempty option of the fields'
+// tags, such as nil pointers and empty slices. Structs
+// are considered empty only with the OmitEmptyStructs
+// option, if they are the zero value of their type.
+// Unlike the encoding/json package, this changes the
+// length of the arrays.
+func OmitEmptyElements() Option {
+	return func(o *encOpts) { o.flags.set(omitEmptyElements) }
+}
+
+// PunycodeKeys configures an encoder to replace the
+// keys of structs and maps that contain non-ASCII
+// characters by their IDNA form, which encodes each
+// dot-separated label with Punycode and the "xn--"
+// prefix. The values are not affected.
+func PunycodeKeys() Option {
+	return func(o *encOpts) { o.flags.set(punycodeKeys) }
+}
@@ -0,0 +1,176 @@
+package jettison
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// Bootstring parameters for Punycode, as defined
+// in section 5 of RFC 3492.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// acePrefix is the ASCII Compatible Encoding prefix
+// of the labels encoded with Punycode by IDNA.
+const acePrefix = "xn--"
+
+// appendIDNA appends s to dst with each of its dot
+// separated labels that contain non-ASCII characters
+// replaced by their ACE form, like the ToASCII
+// operation of IDNA, but without normalization.
+func appendIDNA(dst []byte, s []byte) []byte {
+	for i := 0; ; i++ {
+		label := s
+		j := bytes.IndexByte(s, '.')
+		if j >= 0 {
+			label = s[:j]
+		}
+		if i != 0 {
+			dst = append(dst, '.')
+		}
+		if isASCII(label) {
+			dst = append(dst, label...)
+		} else {
+			dst = append(dst, acePrefix...)
+			dst = appendPunycode(dst, label)
+		}
+		if j < 0 {
+			return dst
+		}
+		s = s[j+1:]
+	}
+}
+
+// appendPunycode appends the Punycode encoding
+// of s to dst, following section 6.3 of RFC 3492.
+func appendPunycode(dst []byte, s []byte) []byte {
+	rs := bytes.Runes(s)
+
+	// Copy the basic code points first, followed
+	// by a delimiter if there are any.
+	b := 0
+	for _, r := range rs {
+		if r < utf8.RuneSelf {
+			dst = append(dst, byte(r))
+			b++
+		}
+	}
+	if b > 0 {
+		dst = append(dst, '-')
+	}
+	var (
+		n     = rune(punyInitialN)
+		bias  = punyInitialBias
+		delta = 0
+	)
+	for h := b; h < len(rs); {
+		// Find the smallest code point that
+		// is greater than or equal to n.
+		m := rune(utf8.MaxRune)
+		for _, r := range rs {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+
+		for _, r := range rs {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				dst = append(dst, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			dst = append(dst, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return dst
+}
+
+// punyAdapt is the bias adaptation function
+// defined in section 6.1 of RFC 3492.
+func punyAdapt(delta, n int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / n
+
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// punyDigit returns the lowercase basic code
+// point that represents the digit d.
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punycodeKey rewrites the quoted map key located at
+// the end of dst, from offset off, to its IDNA form
+// if it contains non-ASCII characters.
+func punycodeKey(dst []byte, off int) []byte {
+	key := dst[off+1 : len(dst)-1]
+	if isASCII(key) {
+		return dst
+	}
+	// The key is copied because the
+	// rewrite overlaps with it.
+	key = append([]byte(nil), key...)
+
+	dst = appendIDNA(dst[:off+1], key)
+	return append(dst, '"')
+}
+
+// newPunyKey returns the keys of the IDNA form of
+// name, or nil if name contains only ASCII characters.
+func newPunyKey(name string) *namedKey {
+	if isASCII([]byte(name)) {
+		return nil
+	}
+	return newNamedKey(string(appendIDNA(nil, []byte(name))))
+}
@@ -0,0 +1,35 @@
+package jettison
+
+import "testing"
+
+func TestPunycode(t *testing.T) {
+	// Samples from section 7.1 of RFC 3492.
+	for _, v := range []struct {
+		s, want string
+	}{
+		{"ü", "tda"},
+		{"bücher", "bcher-kva"},
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		{"ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+		{"Pročprostěnemluvíčesky", "Proprostnemluvesky-uyb24dma41a"},
+	} {
+		if got := string(appendPunycode(nil, []byte(v.s))); got != v.want {
+			t.Errorf("appendPunycode(%q): got %q, want %q", v.s, got, v.want)
+		}
+	}
+}
+
+func TestIDNA(t *testing.T) {
+	for _, v := range []struct {
+		s, want string
+	}{
+		{"名前", "xn--ldr85b"},
+		{"example.com", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"a..ü", "a..xn--tda"},
+	} {
+		if got := string(appendIDNA(nil, []byte(v.s))); got != v.want {
+			t.Errorf("appendIDNA(%q): got %q, want %q", v.s, got, v.want)
+		}
+	}
+}
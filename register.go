@@ -0,0 +1,259 @@
+package jettison
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	numberTextMarshalers sync.Map // map[reflect.Type]struct{}
+	bitFlagTypes         sync.Map // map[reflect.Type]*bitFlags
+	enumTypes            sync.Map // map[reflect.Type]*enumNames
+	typeEncoders         sync.Map // map[reflect.Type]TypeEncoderFunc
+	emptyPredicates      sync.Map // map[reflect.Type]func(interface{}) bool
+)
+
+// TypeEncoderFunc is a function that appends the JSON
+// representation of v to dst, like the AppendJSON method
+// of the AppendMarshaler interface, and returns the
+// extended buffer. The output must be valid JSON.
+type TypeEncoderFunc func(v interface{}, dst []byte) ([]byte, error)
+
+// RegisterTypeEncoder registers a function that encodes the
+// values of the type t, which is useful for the types of
+// other packages whose JSON representation can't be changed
+// by adding methods. The function applies to the exact type
+// t only, including the values of interfaces whose dynamic
+// type is t, and has precedence over the built-in encoding
+// of t, its implementations of the AppendMarshaler,
+// json.Marshaler and encoding.TextMarshaler interfaces, and
+// the other registrations, and also applies to the values
+// pointed by the pointers to t, unless the pointer type is
+// registered too. If t is a pointer type, its nil values
+// are encoded as null without calling fn. The keys of maps
+// are not affected. Registering a nil function removes the
+// registration of t.
+// This function is meant to be called during the program
+// initialization, and isn't safe for use concurrently with
+// the encoding of values of the type.
+func RegisterTypeEncoder(t reflect.Type, fn TypeEncoderFunc) {
+	if t == nil {
+		return
+	}
+	if fn == nil {
+		typeEncoders.Delete(t)
+	} else {
+		typeEncoders.Store(t, fn)
+	}
+	resetInstrCaches()
+}
+
+// EmptyPredicate registers a function that reports
+// whether a value of the type t is empty, which replaces
+// the rules of the encoding/json package for the fields
+// of type t with the omitempty option in their tag, and
+// for the elements of type t with the OmitEmptyElements
+// option. For example, a struct type can be considered
+// empty based on the value of one of its fields. The
+// predicate applies to the exact type t only. Registering
+// a nil function removes the registration of t.
+// This function is meant to be called during the program
+// initialization, and isn't safe for use concurrently with
+// the encoding of values of the type.
+func EmptyPredicate(t reflect.Type, fn func(interface{}) bool) {
+	if t == nil {
+		return
+	}
+	if fn == nil {
+		emptyPredicates.Delete(t)
+	} else {
+		emptyPredicates.Store(t, fn)
+	}
+	resetInstrCaches()
+}
+
+// registeredEmptyPredicate returns the function of
+// the type t registered with EmptyPredicate, if any.
+func registeredEmptyPredicate(t reflect.Type) func(interface{}) bool {
+	if fn, ok := emptyPredicates.Load(t); ok {
+		return fn.(func(interface{}) bool)
+	}
+	return nil
+}
+
+// registeredTypeEncoder returns the function of the
+// type t registered with RegisterTypeEncoder, if any.
+func registeredTypeEncoder(t reflect.Type) TypeEncoderFunc {
+	if fn, ok := typeEncoders.Load(t); ok {
+		return fn.(TypeEncoderFunc)
+	}
+	return nil
+}
+
+// bitFlags represents the names of the flags of
+// an integer type, sorted by value.
+type bitFlags []bitFlag
+
+type bitFlag struct {
+	value uint64
+	name  []byte
+}
+
+// TextMarshalerAsNumber registers a type that implements
+// the encoding.TextMarshaler interface, whose values are
+// to be encoded as JSON numbers rather than strings. The
+// text returned by the MarshalText method must be a valid
+// number literal, which is verified unless the option
+// NoNumberValidation is used. Registering a pointer type
+// is equivalent to registering its element type.
+// This function is meant to be called during the program
+// initialization, and isn't safe for use concurrently with
+// the encoding of values of the type.
+func TextMarshalerAsNumber(t reflect.Type) {
+	if t == nil {
+		return
+	}
+	numberTextMarshalers.Store(baseType(t), struct{}{})
+	resetInstrCaches()
+}
+
+// BitFlagStrings registers an integer type t whose
+// values are a combination of flags, to be encoded as
+// a JSON array of the names of the flags set. The map
+// names associates the value of each flag, usually a
+// single bit, to its name. The bits that don't belong
+// to a named flag are omitted, unless the option
+// KeepUnknownBitFlags is used. Registering a type
+// that is not an integer has no effect.
+// This function is meant to be called during the program
+// initialization, and isn't safe for use concurrently with
+// the encoding of values of the type.
+func BitFlagStrings(t reflect.Type, names map[uint64]string) {
+	if t == nil || !isInteger(t) {
+		return
+	}
+	bf := make(bitFlags, 0, len(names))
+	for v, n := range names {
+		if v != 0 {
+			bf = append(bf, bitFlag{v, []byte(n)})
+		}
+	}
+	sort.Slice(bf, func(i, j int) bool {
+		return bf[i].value < bf[j].value
+	})
+	bitFlagTypes.Store(t, &bf)
+	resetInstrCaches()
+}
+
+// EnumFallback represents the encoding of the values
+// of a type registered with EnumStrings that have
+// no name.
+type EnumFallback int
+
+// Enum fallbacks.
+const (
+	// EnumNumber encodes the values as JSON numbers.
+	EnumNumber EnumFallback = iota
+	// EnumError reports the values with an
+	// UnsupportedValueError.
+	EnumError
+	// EnumUnknown encodes the values as JSON
+	// strings of the form "UNKNOWN(<n>)".
+	EnumUnknown
+)
+
+func (f EnumFallback) valid() bool {
+	return f >= EnumNumber && f <= EnumUnknown
+}
+
+// enumNames represents the names of the values
+// of an integer type.
+type enumNames struct {
+	names    map[int64][]byte
+	fallback EnumFallback
+}
+
+// EnumStrings registers an integer type t whose values
+// are to be encoded as the JSON strings of their name.
+// The map names associates each value to its name, and
+// fallback defines the encoding of the values that have
+// no name. Registering a type that is not an integer, or
+// with an unknown fallback, has no effect.
+// This function is meant to be called during the program
+// initialization, and isn't safe for use concurrently with
+// the encoding of values of the type.
+func EnumStrings(t reflect.Type, names map[int64]string, fallback EnumFallback) {
+	if t == nil || !isInteger(t) || !fallback.valid() {
+		return
+	}
+	en := &enumNames{
+		names:    make(map[int64][]byte, len(names)),
+		fallback: fallback,
+	}
+	for v, n := range names {
+		en.names[v] = []byte(n)
+	}
+	enumTypes.Store(t, en)
+	resetInstrCaches()
+}
+
+// registeredEnum returns the names of the values of
+// the type t registered with EnumStrings, if any.
+func registeredEnum(t reflect.Type) *enumNames {
+	if en, ok := enumTypes.Load(t); ok {
+		return en.(*enumNames)
+	}
+	return nil
+}
+
+// isRegisteredType returns whether the integer type
+// t was registered with BitFlagStrings or EnumStrings.
+func isRegisteredType(t reflect.Type) bool {
+	return registeredBitFlags(t) != nil || registeredEnum(t) != nil
+}
+
+// registeredBitFlags returns the flags of the
+// type t registered with BitFlagStrings, if any.
+func registeredBitFlags(t reflect.Type) *bitFlags {
+	if bf, ok := bitFlagTypes.Load(t); ok {
+		return bf.(*bitFlags)
+	}
+	return nil
+}
+
+// isNumberTextMarshaler returns whether the type t, or
+// its element type if it is a pointer, was registered
+// with TextMarshalerAsNumber.
+func isNumberTextMarshaler(t reflect.Type) bool {
+	_, ok := numberTextMarshalers.Load(baseType(t))
+	return ok
+}
+
+func baseType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+// resetInstrCaches discards the instructions and
+// empty funcs generated so far, which may no longer
+// be accurate after the registration of a type.
+func resetInstrCaches() {
+	atomic.StorePointer(&instrCachePtr, nil)
+
+	structInstrCache.Range(func(k, _ interface{}) bool {
+		structInstrCache.Delete(k)
+		return true
+	})
+	namedInstrCache.Range(func(k, _ interface{}) bool {
+		namedInstrCache.Delete(k)
+		return true
+	})
+	emptyFnCache.Range(func(k, _ interface{}) bool {
+		emptyFnCache.Delete(k)
+		return true
+	})
+}
@@ -0,0 +1,108 @@
+package jettison
+
+import (
+	"fmt"
+	"io"
+)
+
+// RowSource is implemented by the cursors that
+// yield values one at a time, such as the rows
+// of a database query.
+type RowSource interface {
+	// Next prepares the next value to be read
+	// with Scan, and returns false when there
+	// are no more values.
+	Next() bool
+
+	// Scan returns the current value.
+	Scan() (interface{}, error)
+}
+
+// EncodeSource writes the values yielded by src to w
+// as the elements of a JSON array, without holding all
+// of them in memory. Each value is encoded with opts,
+// like AppendOpts does, except for the Newline option
+// which applies to the array. The options that operate
+// on the complete output of a value, such as Indent or
+// ComputeETag, would apply to each element and not to
+// the array, and are rejected with an InvalidOptionError.
+// Canonical is the exception, since the elements of a
+// canonical array are canonical. The output is buffered,
+// and nothing more is written to w once an error
+// occurred, either returned by src or while encoding
+// a value.
+func EncodeSource(src RowSource, w io.Writer, opts ...Option) error {
+	eo, err := applyEncOpts(opts)
+	if err != nil {
+		return err
+	}
+	if err := checkSourceOpts(eo); err != nil {
+		return err
+	}
+	newline := eo.flags.has(trailingNewline)
+	eo.flags.unset(trailingNewline)
+
+	buf := cachedBuffer()
+	defer bufferPool.Put(buf)
+
+	buf.B = append(buf.B, '[')
+	for n := 0; src.Next(); n++ {
+		v, err := src.Scan()
+		if err != nil {
+			return err
+		}
+		if n != 0 {
+			buf.B = append(buf.B, ',')
+		}
+		off := len(buf.B)
+		if v == nil {
+			buf.B = appendNull(buf.B, eo)
+		} else if buf.B, err = appendJSON(buf.B, v, eo); err != nil {
+			return err
+		}
+		if buf.B, err = postProcess(buf.B, off, v, eo); err != nil {
+			return err
+		}
+		if len(buf.B) >= defaultBufCap {
+			if _, err := w.Write(buf.B); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+	}
+	buf.B = append(buf.B, ']')
+	if newline {
+		buf.B = append(buf.B, '\n')
+	}
+	_, err = w.Write(buf.B)
+
+	return err
+}
+
+// checkSourceOpts returns an error if opts contains
+// an option that EncodeSource can't honor, because
+// postProcess would apply it to each element.
+func checkSourceOpts(opts encOpts) error {
+	var name string
+	switch {
+	case opts.flags.has(indentOutput):
+		name = "Indent"
+	case opts.flags.has(validateOutput):
+		name = "ValidateOutput"
+	case opts.x == nil:
+		return nil
+	case opts.x.transform != nil:
+		name = "OutputTransform"
+	case opts.x.schemaKey != nil:
+		name = "IncludeSchema"
+	case opts.x.etagHash != nil:
+		name = "ComputeETag"
+	case opts.x.links != nil:
+		name = "HypermediaLinks"
+	default:
+		return nil
+	}
+	return &InvalidOptionError{
+		fmt.Errorf("%s option not supported by EncodeSource", name),
+	}
+}
@@ -0,0 +1,104 @@
+//go:build go1.18
+
+package jettison
+
+import (
+	"errors"
+	"io"
+)
+
+var errStreamClosed = errors.New("jettison: write to closed stream")
+
+// Stream writes the JSON representations of values
+// of the type T to an io.Writer, each one followed
+// by a newline character, as JSON Lines.
+// The output is buffered, and the Flush method must
+// be called once all the values have been written.
+// A Stream is not safe for concurrent use.
+type Stream[T any] struct {
+	enc  *TypedEncoder[T]
+	w    io.Writer
+	opts encOpts
+	buf  *buffer
+	err  error
+}
+
+// NewStream returns a new stream that writes to w.
+// The options are applied once, and used for all
+// the values written.
+func (e *TypedEncoder[T]) NewStream(w io.Writer, opts ...Option) *Stream[T] {
+	s := &Stream[T]{enc: e, w: w}
+
+	s.opts, s.err = newTypedEncOpts(opts)
+
+	// The stream terminates each value with
+	// a newline regardless of the option.
+	s.opts.flags.unset(trailingNewline)
+
+	return s
+}
+
+// Write writes the JSON representation of v to
+// the stream, followed by a newline character.
+// If v cannot be encoded, the error is returned
+// and nothing is written. Once an error occurred
+// while writing to the underlying writer, it is
+// returned by all the subsequent calls.
+func (s *Stream[T]) Write(v T) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.buf == nil {
+		s.buf = cachedBuffer()
+	}
+	s.opts.startDeadline()
+
+	b, err := s.enc.encode(s.buf.B, &v, s.opts)
+	if err != nil {
+		return err
+	}
+	s.buf.B = append(b, '\n')
+
+	if len(s.buf.B) >= defaultBufCap {
+		return s.flush()
+	}
+	return nil
+}
+
+// Flush writes the buffered data to the underlying
+// writer, and returns the first error that occurred
+// while writing to it, if any.
+func (s *Stream[T]) Flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.flush()
+}
+
+// Close flushes the stream and releases its
+// resources. Any later call to Write returns
+// an error.
+func (s *Stream[T]) Close() error {
+	err := s.Flush()
+	if s.buf != nil {
+		bufferPool.Put(s.buf)
+		s.buf = nil
+	}
+	if s.err == nil {
+		s.err = errStreamClosed
+	}
+	return err
+}
+
+func (s *Stream[T]) flush() error {
+	if s.buf == nil || len(s.buf.B) == 0 {
+		return nil
+	}
+	if _, err := s.w.Write(s.buf.B); err != nil {
+		s.err = err
+		return err
+	}
+	s.buf.Reset()
+
+	return nil
+}
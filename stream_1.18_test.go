@@ -0,0 +1,133 @@
+//go:build go1.18
+
+package jettison
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStream tests that a Stream writes each value
+// followed by a newline, buffers its output, and
+// keeps the errors of the underlying writer.
+func TestStream(t *testing.T) {
+	type x struct {
+		A int    `json:"a"`
+		B string `json:"b,omitempty"`
+	}
+	enc, err := NewTypedEncoder[x]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+
+	s := enc.NewStream(&buf, Newline(), NoHTMLEscaping())
+	for i, b := range []string{"", "<b>", ""} {
+		if err := s.Write(x{A: i, B: b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected output to be buffered until flush")
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"a\":0}\n{\"a\":1,\"b\":\"<b>\"}\n{\"a\":2}\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Values larger than the buffer are
+	// written without an explicit flush.
+	buf.Reset()
+	big := strings.Repeat("x", 2*defaultBufCap)
+	if err := s.Write(x{B: big}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `{"a":0,"b":"`+big+"\"}\n"; got != want {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(x{}); err == nil {
+		t.Error("expected non-nil error after close")
+	}
+	// Writer errors are sticky.
+	werr := errors.New("write error")
+	s = enc.NewStream(failWriter{werr})
+	if err := s.Write(x{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != werr {
+		t.Errorf("got %v, want %v", err, werr)
+	}
+	if err := s.Write(x{}); err != werr {
+		t.Errorf("got %v, want %v", err, werr)
+	}
+	if err := s.Close(); err != werr {
+		t.Errorf("got %v, want %v", err, werr)
+	}
+	// Encoding errors aren't sticky, and the
+	// values written before are not lost.
+	type y struct {
+		F float64 `json:"f"`
+	}
+	yenc, err := NewTypedEncoder[y]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	ys := yenc.NewStream(&buf)
+	if err := ys.Write(y{F: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ys.Write(y{F: math.NaN()}); err == nil {
+		t.Error("expected non-nil error")
+	}
+	if err := ys.Write(y{F: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ys.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "{\"f\":1}\n{\"f\":2}\n"; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Invalid options are reported by
+	// the first call to Write.
+	s = enc.NewStream(&buf, TimeLayout(""))
+	var ierr *InvalidOptionError
+	if err := s.Write(x{}); !errors.As(err, &ierr) {
+		t.Errorf("got %T, want %T", err, ierr)
+	}
+}
+
+// TestStreamTimeout tests that the deadline of the
+// Timeout option starts with each value written to
+// a Stream, rather than when the stream is created.
+func TestStreamTimeout(t *testing.T) {
+	enc, err := NewTypedEncoder[[]int]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+
+	s := enc.NewStream(&buf, Timeout(50*time.Millisecond))
+	for i := 0; i < 2; i++ {
+		time.Sleep(60 * time.Millisecond)
+		if err := s.Write([]int{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "[0]\n[1]\n"; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
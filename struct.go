@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"unicode"
@@ -12,7 +13,18 @@ import (
 
 const validChars = "!#$%&()*+-./:<=>?@[]^_{|}~ "
 
-var fieldsCache sync.Map // map[reflect.Type][]field
+// defaultTagKey is the key of the struct
+// tags that define the fields' names and
+// options, unless the TagKey option is used.
+const defaultTagKey = "json"
+
+var fieldsCache sync.Map // map[fieldsKey][]field
+
+type fieldsKey struct {
+	typ    reflect.Type
+	tagKey string
+	namer  *keyNamer
+}
 
 type seq struct {
 	offset uintptr
@@ -24,14 +36,24 @@ type field struct {
 	name              string
 	keyNonEsc         []byte
 	keyEscHTML        []byte
+	punyKey           *namedKey
 	index             []int
 	tag               bool
 	quoted            bool
 	omitEmpty         bool
 	omitNil           bool
 	omitNullMarshaler bool
+	byteFmt           byteSliceFmt
+	floatFmt          floatSpecialFmt
+	timeLayout        *string
+	indent            bool
+	cleanNumber       bool
+	since             int
+	until             int
+	roles             []string
 	instr             instruction
 	empty             emptyFunc
+	zero              emptyFunc
 
 	// embedSeq represents the sequence of offsets
 	// and indirections to follow to reach the field
@@ -39,6 +61,142 @@ type field struct {
 	embedSeq []seq
 }
 
+// byteSliceFmt represents the format used to
+// encode a byte slice field, defined by its tag.
+type byteSliceFmt uint8
+
+const (
+	byteSliceDefault byteSliceFmt = iota
+	byteSliceRaw
+	byteSliceHex
+	byteSliceBase64
+)
+
+// byteSliceFmtFromTag returns the byte slice format
+// specified by the options of a struct field's tag.
+func byteSliceFmtFromTag(opts tagOptions) byteSliceFmt {
+	switch {
+	case opts.Contains("raw"):
+		return byteSliceRaw
+	case opts.Contains("hex"):
+		return byteSliceHex
+	case opts.Contains("base64"):
+		return byteSliceBase64
+	default:
+		return byteSliceDefault
+	}
+}
+
+// floatSpecialFmt represents the format used to
+// encode the NaN and infinite values of a float
+// field, defined by its tag.
+type floatSpecialFmt uint8
+
+const (
+	floatSpecialDefault floatSpecialFmt = iota
+	floatSpecialNull
+	floatSpecialString
+)
+
+// floatSpecialFmtFromTag returns the float special
+// values format specified by the options of a struct
+// field's tag.
+func floatSpecialFmtFromTag(opts tagOptions) floatSpecialFmt {
+	switch {
+	case opts.Contains("floatnull"):
+		return floatSpecialNull
+	case opts.Contains("floatstr"):
+		return floatSpecialString
+	default:
+		return floatSpecialDefault
+	}
+}
+
+// timeLayoutFromTag returns the time layout specified
+// by the options of a struct field's tag, or nil. The
+// layout ends at the next comma of the tag, if any, and
+// as such, cannot contain one.
+func timeLayoutFromTag(opts tagOptions) *string {
+	if l, ok := opts.Lookup("layout"); ok {
+		return &l
+	}
+	return nil
+}
+
+// versionFromTag returns the API version of the option
+// name of a struct field's tag, 0 if the option is absent,
+// or -1 if the version isn't a positive integer.
+func versionFromTag(opts tagOptions, name string) int {
+	v, ok := opts.Lookup(name)
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return -1
+	}
+	return n
+}
+
+// rolesFromTag returns the list of roles of the
+// roles tag of a struct field, or nil if the tag
+// is absent or empty.
+func rolesFromTag(tag string) []string {
+	var roles []string
+	for _, r := range strings.Split(tag, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+// intersectRoles returns the roles that are in both
+// lists, where a nil list stands for all the roles.
+// The result is non-nil, but empty, if the lists have
+// no role in common.
+func intersectRoles(a, b []string) []string {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	roles := []string{}
+	for _, r := range b {
+		for _, s := range a {
+			if r == s {
+				roles = append(roles, r)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// goFieldPath returns the names of the Go fields that
+// lead to the field of the struct type t with the given
+// index sequence, and the type of the field.
+func goFieldPath(t reflect.Type, index []int) ([]string, reflect.Type) {
+	names := make([]string, len(index))
+	for i, x := range index {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		sf := t.Field(x)
+		names[i] = sf.Name
+		t = sf.Type
+	}
+	return names, t
+}
+
+// inVersion returns whether the field is part of
+// the given version of an API, according to the
+// since and until options of its tag.
+func (f *field) inVersion(v int) bool {
+	return v >= f.since && (f.until == 0 || v <= f.until)
+}
+
 type typeCount map[reflect.Type]int
 
 // byIndex sorts a list of fields by index sequence.
@@ -61,19 +219,25 @@ func (x byIndex) Less(i, j int) bool {
 
 // cachedFields is similar to structFields, but uses a
 // cache to avoid repeated work.
-func cachedFields(t reflect.Type) []field {
-	if f, ok := fieldsCache.Load(t); ok {
+func cachedFields(t reflect.Type, tagKey string, namer *keyNamer) []field {
+	key := fieldsKey{t, tagKey, namer}
+	if f, ok := fieldsCache.Load(key); ok {
 		return f.([]field)
 	}
-	f, _ := fieldsCache.LoadOrStore(t, structFields(t))
+	f, _ := fieldsCache.LoadOrStore(key, structFields(t, tagKey, namer))
 	return f.([]field)
 }
 
 // structFields returns a list of fields that should be
-// encoded for the given struct type. The algorithm is
-// breadth-first search over the set of structs to include,
-// the top one and then any reachable anonymous structs.
-func structFields(t reflect.Type) []field {
+// encoded for the given struct type, whose names and
+// options are read from the tags with the given key.
+// The names of the fields without an explicit name in
+// their tag are transformed by namer, if not nil, before
+// the dominant fields are chosen.
+// The algorithm is breadth-first search over the set
+// of structs to include, the top one and then any
+// reachable anonymous structs.
+func structFields(t reflect.Type, tagKey string, namer *keyNamer) []field {
 	var (
 		flds []field
 		ccnt typeCount
@@ -92,7 +256,7 @@ func structFields(t reflect.Type) []field {
 			}
 			seen[f.typ] = true
 			// Scan the type for fields to encode.
-			flds, next = scanFields(f, flds, next, ccnt, ncnt)
+			flds, next = scanFields(f, flds, next, ccnt, ncnt, tagKey, namer)
 		}
 	}
 	sortFields(flds)
@@ -227,7 +391,7 @@ func dominantField(fields []field) (field, bool) {
 	return fields[0], true
 }
 
-func scanFields(f field, fields, next []field, cnt, ncnt typeCount) ([]field, []field) {
+func scanFields(f field, fields, next []field, cnt, ncnt typeCount, tagKey string, namer *keyNamer) ([]field, []field) {
 	var escBuf bytes.Buffer
 
 	for i := 0; i < f.typ.NumField(); i++ {
@@ -236,7 +400,7 @@ func scanFields(f field, fields, next []field, cnt, ncnt typeCount) ([]field, []
 		if !shouldEncodeField(sf) {
 			continue
 		}
-		tag := sf.Tag.Get("json")
+		tag := sf.Tag.Get(tagKey)
 		if tag == "-" {
 			continue
 		}
@@ -264,23 +428,43 @@ func scanFields(f field, fields, next []field, cnt, ncnt typeCount) ([]field, []
 			if name == "" {
 				name = sf.Name
 			}
-			// Build HTML escaped field key.
-			escBuf.Reset()
-			_, _ = escBuf.WriteString(`"`)
-			json.HTMLEscape(&escBuf, []byte(name))
-			_, _ = escBuf.WriteString(`":`)
+			var keyNonEsc, keyEscHTML []byte
+			if !tagged && namer != nil {
+				// The transformed name may contain any
+				// character that needs to be escaped.
+				nk := newNamedKey(namer.fn(name))
+				name = nk.name
+				keyNonEsc, keyEscHTML = nk.keyNonEsc, nk.keyEscHTML
+			} else {
+				// Build HTML escaped field key.
+				escBuf.Reset()
+				_, _ = escBuf.WriteString(`"`)
+				json.HTMLEscape(&escBuf, []byte(name))
+				_, _ = escBuf.WriteString(`":`)
 
+				keyNonEsc = []byte(`"` + name + `":`)
+				keyEscHTML = append([]byte(nil), escBuf.Bytes()...) // copy
+			}
 			nf := field{
-				typ:        typ,
-				name:       name,
-				tag:        tagged,
-				index:      index,
-				omitEmpty:  opts.Contains("omitempty"),
-				omitNil:    opts.Contains("omitnil"),
-				quoted:     opts.Contains("string") && isBasicType(typ),
-				keyNonEsc:  []byte(`"` + name + `":`),
-				keyEscHTML: append([]byte(nil), escBuf.Bytes()...),  // copy
-				embedSeq:   append(f.embedSeq[:0:0], f.embedSeq...), // clone
+				typ:         typ,
+				name:        name,
+				tag:         tagged,
+				index:       index,
+				omitEmpty:   opts.Contains("omitempty"),
+				omitNil:     opts.Contains("omitnil"),
+				quoted:      opts.Contains("string") && isBasicType(typ),
+				byteFmt:     byteSliceFmtFromTag(opts),
+				floatFmt:    floatSpecialFmtFromTag(opts),
+				timeLayout:  timeLayoutFromTag(opts),
+				indent:      opts.Contains("indent"),
+				cleanNumber: opts.Contains("cleanumber"),
+				since:       versionFromTag(opts, "since"),
+				until:       versionFromTag(opts, "until"),
+				roles:       intersectRoles(f.roles, rolesFromTag(sf.Tag.Get("roles"))),
+				keyNonEsc:   keyNonEsc,
+				keyEscHTML:  keyEscHTML,
+				punyKey:     newPunyKey(name),
+				embedSeq:    append(f.embedSeq[:0:0], f.embedSeq...), // clone
 			}
 			// Add final offset to sequences.
 			nf.embedSeq = append(nf.embedSeq, seq{sf.Offset, false})
@@ -304,6 +488,7 @@ func scanFields(f field, fields, next []field, cnt, ncnt typeCount) ([]field, []
 				typ:      typ,
 				name:     typ.Name(),
 				index:    index,
+				roles:    intersectRoles(f.roles, rolesFromTag(sf.Tag.Get("roles"))),
 				embedSeq: append(f.embedSeq, seq{sf.Offset, isPtr}),
 			})
 		}
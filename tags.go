@@ -28,3 +28,14 @@ func (opts tagOptions) Contains(name string) bool {
 	}
 	return false
 }
+
+// Lookup returns the value of an option of the
+// form name=value, and whether it was found.
+func (opts tagOptions) Lookup(name string) (string, bool) {
+	for _, o := range opts {
+		if strings.HasPrefix(o, name) && len(o) > len(name) && o[len(name)] == '=' {
+			return o[len(name)+1:], true
+		}
+	}
+	return "", false
+}
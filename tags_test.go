@@ -31,3 +31,25 @@ func TestParseTag(t *testing.T) {
 		}
 	}
 }
+
+func TestTagOptionsLookup(t *testing.T) {
+	testdata := []struct {
+		tag   string
+		name  string
+		value string
+		found bool
+	}{
+		{"a,layout=2006", "layout", "2006", true},
+		{"a,omitempty,layout=", "layout", "", true},
+		{"a,layout", "layout", "", false},
+		{"a,layouts=2006", "layout", "", false},
+		{"layout=2006", "layout", "", false},
+	}
+	for _, v := range testdata {
+		_, opts := parseTag(v.tag)
+		value, found := opts.Lookup(v.name)
+		if value != v.value || found != v.found {
+			t.Errorf("%q: got (%q, %t), want (%q, %t)", v.tag, value, found, v.value, v.found)
+		}
+	}
+}
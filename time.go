@@ -1,6 +1,9 @@
 package jettison
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 const epoch = 62135683200 // 1970-01-01T00:00:00
 
@@ -16,6 +19,7 @@ const (
 	DurationMilliseconds
 	DurationMicroseconds
 	DurationNanoseconds // default
+	DurationISO8601
 )
 
 // String implements the fmt.Stringer
@@ -28,12 +32,12 @@ func (f DurationFmt) String() string {
 }
 
 func (f DurationFmt) valid() bool {
-	return f >= DurationString && f <= DurationNanoseconds
+	return f >= DurationString && f <= DurationISO8601
 }
 
 var (
 	zeroDuration   = []byte("0s")
-	durationFmtStr = []string{"str", "min", "s", "ms", "μs", "nanosecond"}
+	durationFmtStr = []string{"str", "min", "s", "ms", "μs", "nanosecond", "iso8601"}
 	dayOffset      = [13]uint16{0, 306, 337, 0, 31, 61, 92, 122, 153, 184, 214, 245, 275}
 )
 
@@ -107,6 +111,53 @@ func appendDuration(dst []byte, d time.Duration) []byte {
 	return append(dst, buf[l:]...)
 }
 
+// appendISO8601Duration appends the ISO 8601 representation
+// of d to the tail of dst and returns the extended buffer.
+// Like appendDuration, the largest unit is the hour, since
+// days can be different lengths.
+func appendISO8601Duration(dst []byte, d time.Duration) []byte {
+	var buf [32]byte
+
+	l := len(buf)
+	u := uint64(d)
+	n := d < 0
+	if n {
+		u = -u
+	}
+	// Format as seconds, omitted when zero
+	// unless the whole duration is.
+	if s := u % uint64(time.Minute); s != 0 || u == 0 {
+		l--
+		buf[l] = 'S'
+		l, s = fmtFrac(buf[:l], s, 9)
+		l = fmtInt(buf[:l], s)
+	}
+	u /= uint64(time.Minute)
+
+	// Format as minutes.
+	if m := u % 60; m != 0 {
+		l--
+		buf[l] = 'M'
+		l = fmtInt(buf[:l], m)
+	}
+	u /= 60
+
+	// Format as hours.
+	if u != 0 {
+		l--
+		buf[l] = 'H'
+		l = fmtInt(buf[:l], u)
+	}
+	l -= 2
+	copy(buf[l:], "PT")
+
+	if n {
+		l--
+		buf[l] = '-'
+	}
+	return append(dst, buf[l:]...)
+}
+
 // fmtInt formats v into the tail of buf.
 // It returns the index where the output begins.
 // Taken from https://golang.org/src/time/time.go.
@@ -168,10 +219,20 @@ func rdnToYmd(rdn uint32) (uint16, uint16, uint16) {
 	return uint16(y), uint16(m), uint16(d) - dayOffset[m]
 }
 
+// hasZoneElem returns whether the time layout
+// includes the name or the offset of a zone.
+func hasZoneElem(layout string) bool {
+	return strings.Contains(layout, "MST") ||
+		strings.Contains(layout, "Z07") ||
+		strings.Contains(layout, "-07")
+}
+
 // appendRFC3339Time appends the RFC3339 textual representation
 // of t to the tail of dst and returns the extended buffer.
+// If zulu is false, the zero offset of UTC times is written
+// as +00:00 rather than with the Z designator.
 // Adapted from https://github.com/chansen/c-timestamp.
-func appendRFC3339Time(t time.Time, dst []byte, nano bool) []byte {
+func appendRFC3339Time(t time.Time, dst []byte, nano, zulu bool) []byte {
 	var buf [37]byte
 
 	// Base layout chars with opening quote.
@@ -223,7 +284,7 @@ func appendRFC3339Time(t time.Time, dst []byte, nano bool) []byte {
 		n += 10 - rpad
 	}
 	// Zone.
-	if offset == 0 {
+	if offset == 0 && zulu {
 		buf[n] = 'Z'
 		n++
 	} else {
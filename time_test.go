@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -19,8 +20,9 @@ func TestDurationFmtString(t *testing.T) {
 		{DurationMilliseconds, "ms"},
 		{DurationMicroseconds, "μs"},
 		{DurationNanoseconds, "nanosecond"},
+		{DurationISO8601, "iso8601"},
 		{DurationFmt(-1), "unknown"},
-		{DurationFmt(6), "unknown"},
+		{DurationFmt(7), "unknown"},
 	}
 	for _, tt := range testdata {
 		if s := tt.fmt.String(); s != tt.str {
@@ -45,6 +47,58 @@ func TestIssue2(t *testing.T) {
 	}
 }
 
+func TestAppendISO8601Duration(t *testing.T) {
+	var testdata = []struct {
+		str string
+		dur time.Duration
+	}{
+		{"PT0S", 0},
+		{"PT0.000000001S", 1 * time.Nanosecond},
+		{"PT0.0022S", 2200 * time.Microsecond},
+		{"PT3.3S", 3300 * time.Millisecond},
+		{"PT4M", 4 * time.Minute},
+		{"PT4M5.001S", 4*time.Minute + 5001*time.Millisecond},
+		{"PT1H3M40S", 1*time.Hour + 3*time.Minute + 40*time.Second},
+		{"PT36H", 36 * time.Hour},
+		{"PT5H7.001S", 5*time.Hour + 7001*time.Millisecond},
+		{"PT2562047H47M16.854775807S", 1<<63 - 1},
+		{"-PT2562047H47M16.854775808S", -1 << 63},
+	}
+	for _, tt := range testdata {
+		buf := appendISO8601Duration(make([]byte, 0, 32), tt.dur)
+
+		if s := string(buf); s != tt.str {
+			t.Errorf("got %q, want %q", s, tt.str)
+		}
+		if d, err := parseISO8601Duration(string(buf)); err != nil {
+			t.Error(err)
+		} else if d != tt.dur {
+			t.Errorf("round-trip: got %s, want %s", d, tt.dur)
+		}
+		if tt.dur > 0 {
+			buf = appendISO8601Duration(make([]byte, 0, 32), -tt.dur)
+			if s := string(buf); s != "-"+tt.str {
+				t.Errorf("got %q, want %q", s, "-"+tt.str)
+			}
+		}
+	}
+}
+
+// parseISO8601Duration parses the time designators of
+// an ISO 8601 duration, as used in the DurationISO8601
+// format, which time.ParseDuration understands once the
+// prefix is removed.
+func parseISO8601Duration(s string) (time.Duration, error) {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	if !strings.HasPrefix(s, "PT") {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.ParseDuration(sign + strings.ToLower(s[2:]))
+}
+
 func TestAppendDuration(t *testing.T) {
 	// Taken from https://golang.org/src/time/time_test.go
 	var testdata = []struct {
@@ -108,7 +162,7 @@ func TestAppendRFC3339Time(t *testing.T) {
 				layout = time.RFC3339Nano
 			}
 			bat = len(buf)
-			buf = appendRFC3339Time(tm, buf, nano)
+			buf = appendRFC3339Time(tm, buf, nano, true)
 
 			// The time encodes with double-quotes.
 			want := strconv.Quote(tm.Format(layout))
@@ -138,7 +192,7 @@ func BenchmarkRFC3339Time(b *testing.B) {
 			b.ReportAllocs()
 			for i := 0; i < b.N; i++ {
 				buf := make([]byte, 32)
-				appendRFC3339Time(tm, buf, tt.layout == time.RFC3339Nano)
+				appendRFC3339Time(tm, buf, tt.layout == time.RFC3339Nano, true)
 			}
 		})
 		b.Run(fmt.Sprintf("%s%s", "standard", tt.name), func(b *testing.B) {
@@ -0,0 +1,238 @@
+//go:build go1.18
+
+package jettison
+
+import (
+	"io"
+	"reflect"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// TypedEncoder encodes the values of the type T.
+// Unlike the Marshal and Append functions, it
+// doesn't convert the values to an interface,
+// and uses an instruction generated once for T.
+// A TypedEncoder is safe for concurrent use: it
+// isn't modified once created, and the options
+// are applied for each call.
+type TypedEncoder[T any] struct {
+	ins instruction
+
+	// merge is set only if T is
+	// a map type, for EncodeMerged.
+	merge mergeInstr
+
+	// named holds the encoders of T built for
+	// the namings of the struct fields set with
+	// the TagKey and KeyNamer options.
+	named sync.Map // map[fieldNaming]*TypedEncoder[T]
+}
+
+// NewTypedEncoder returns a new encoder for the type
+// T, or an UnsupportedTypeError if the values of T
+// can never be encoded.
+func NewTypedEncoder[T any]() (*TypedEncoder[T], error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+
+	switch t.Kind() {
+	case reflect.Chan, reflect.UnsafePointer:
+		return nil, &UnsupportedTypeError{t}
+	case reflect.Func:
+		if ok, _ := isFuncValue(t); !ok {
+			return nil, &UnsupportedTypeError{t}
+		}
+	}
+	return newTypedEncoder[T](t, defaultNaming), nil
+}
+
+func newTypedEncoder[T any](t reflect.Type, naming fieldNaming) *TypedEncoder[T] {
+	// The values are passed by copy, and are
+	// addressable only if T is a pointer, as
+	// for the top-level value of Marshal.
+	e := &TypedEncoder[T]{
+		ins: newInstruction(t, t.Kind() == reflect.Ptr, false, naming),
+	}
+	if t.Kind() == reflect.Map {
+		e.merge = newMergeInstr(t, naming)
+	}
+	return e
+}
+
+// withNaming returns the encoder of T built for
+// the naming of the struct fields of opts.
+func (e *TypedEncoder[T]) withNaming(opts encOpts) *TypedEncoder[T] {
+	if opts.x == nil {
+		return e
+	}
+	naming := opts.fieldNaming()
+	if naming == defaultNaming {
+		return e
+	}
+	if ne, ok := e.named.Load(naming); ok {
+		return ne.(*TypedEncoder[T])
+	}
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	ne, _ := e.named.LoadOrStore(naming, newTypedEncoder[T](t, naming))
+
+	return ne.(*TypedEncoder[T])
+}
+
+// Marshal returns the JSON encoding of v.
+// See the MarshalOpts function.
+func (e *TypedEncoder[T]) Marshal(v T, opts ...Option) ([]byte, error) {
+	eo, err := newTypedEncOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	buf := cachedBuffer()
+
+	buf.B, err = e.encode(buf.B, &v, eo)
+	if err == nil {
+		// Make a copy of the buffer's content
+		// before its returned to the pool.
+		b := make([]byte, len(buf.B))
+		copy(b, buf.B)
+		bufferPool.Put(buf)
+
+		return b, nil
+	}
+	bufferPool.Put(buf)
+
+	return nil, err
+}
+
+// Append is similar to Marshal, but appends the
+// JSON representation of v to dst.
+// See the AppendOpts function.
+func (e *TypedEncoder[T]) Append(dst []byte, v T, opts ...Option) ([]byte, error) {
+	eo, err := newTypedEncOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	return e.encode(dst, &v, eo)
+}
+
+// EncodeMerged writes to w the JSON object of the
+// elements of all the maps, as if they were merged
+// in order: the elements of a map replace those with
+// the same key of the previous maps. The keys are
+// sorted, regardless of the UnsortedMap option.
+// T must be a map type with supported keys, or an
+// UnsupportedTypeError is returned.
+func (e *TypedEncoder[T]) EncodeMerged(maps []T, w io.Writer, opts ...Option) error {
+	if e.merge == nil {
+		return &UnsupportedTypeError{reflect.TypeOf((*T)(nil)).Elem()}
+	}
+	eo, err := newTypedEncOpts(opts)
+	if err != nil {
+		return err
+	}
+	buf := cachedBuffer()
+	defer bufferPool.Put(buf)
+
+	buf.B = append(buf.B, '{')
+	if len(maps) != 0 {
+		buf.B, err = e.withNaming(eo).merge(noescape(unsafe.Pointer(&maps[0])), len(maps), buf.B, eo)
+		runtime.KeepAlive(maps)
+		if err != nil {
+			return err
+		}
+	}
+	buf.B = append(buf.B, '}')
+
+	if buf.B, err = postProcess(buf.B, 0, nil, eo); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.B)
+
+	return err
+}
+
+// FieldInfo describes a field of a struct
+// encoded as a member of a JSON object.
+type FieldInfo struct {
+	// Name is the key of the member.
+	Name string
+
+	// Path is the sequence of the names of the
+	// Go fields that leads to the field, which
+	// has several elements for promoted fields.
+	Path []string
+
+	// Kind is the kind of the type of the field.
+	Kind reflect.Kind
+
+	// OmitEmpty, OmitNil and Quoted report
+	// whether the omitempty, omitnil and string
+	// options of the field's tag apply.
+	OmitEmpty bool
+	OmitNil   bool
+	Quoted    bool
+}
+
+// Fields returns the description of the fields
+// encoded for the struct type T, or the type it
+// points to, in order of declaration, once the
+// rules of promotion of embedded structs are
+// applied. The names of the fields aren't changed
+// by the options, such as TagKey or KeyNamer.
+// If T isn't a struct type, or a pointer to a
+// struct type, an UnsupportedTypeError is returned.
+func (e *TypedEncoder[T]) Fields() ([]FieldInfo, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, &UnsupportedTypeError{reflect.TypeOf((*T)(nil)).Elem()}
+	}
+	flds := cachedFields(t, defaultTagKey, nil)
+	infos := make([]FieldInfo, len(flds))
+
+	for i, f := range flds {
+		path, ft := goFieldPath(t, f.index)
+		infos[i] = FieldInfo{
+			Name:      f.name,
+			Path:      path,
+			Kind:      ft.Kind(),
+			OmitEmpty: f.omitEmpty,
+			OmitNil:   f.omitNil && isNilable(ft),
+			Quoted:    f.quoted,
+		}
+	}
+	return infos, nil
+}
+
+func (e *TypedEncoder[T]) encode(dst []byte, v *T, opts encOpts) ([]byte, error) {
+	off := len(dst)
+
+	var err error
+	dst, err = e.withNaming(opts).ins(noescape(unsafe.Pointer(v)), dst, opts)
+
+	// Ensure that v is reachable until
+	// the instruction has returned.
+	runtime.KeepAlive(v)
+
+	if err != nil {
+		return dst, err
+	}
+	// The value is converted to an interface only
+	// for the options that operate on the top-level
+	// value itself.
+	var iv interface{}
+	if opts.x != nil && (opts.x.links != nil || opts.x.schemaKey != nil || opts.x.etagHash != nil) {
+		iv = *v
+	}
+	return postProcess(dst, off, iv, opts)
+}
+
+func newTypedEncOpts(opts []Option) (encOpts, error) {
+	if len(opts) == 0 {
+		return defaultEncOpts(), nil
+	}
+	// The options are applied in a separate function,
+	// because the applied options escape to the heap.
+	return applyEncOpts(opts)
+}
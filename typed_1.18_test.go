@@ -0,0 +1,456 @@
+//go:build go1.18
+
+package jettison
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestTypedEncoder tests that a TypedEncoder
+// produces the same output as MarshalOpts.
+func TestTypedEncoder(t *testing.T) {
+	type x struct {
+		A int               `json:"a"`
+		B map[string]string `json:"b"`
+		C *x                `json:"c,omitempty"`
+	}
+	xx := x{A: 1, B: map[string]string{"k": "<v>"}, C: &x{A: 2}}
+
+	structEnc, err := NewTypedEncoder[x]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptrEnc, err := NewTypedEncoder[*x]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range [][]Option{
+		nil,
+		{NoHTMLEscaping()},
+		{Indent("", "\t"), NilMapEmpty()},
+	} {
+		want, err := MarshalOpts(xx, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := structEnc.Marshal(xx, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want) {
+			t.Errorf("got %#q, want %#q", b, want)
+		}
+		b, err = ptrEnc.Append([]byte("prefix:"), &xx, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "prefix:"+string(want); got != want {
+			t.Errorf("got %#q, want %#q", got, want)
+		}
+	}
+	// Nil pointers and interfaces.
+	b, err := ptrEnc.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `null`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	ifaceEnc, err := NewTypedEncoder[interface{}]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []interface{}{nil, 42, "s", []int{1}} {
+		want, _ := Marshal(v)
+		b, err := ifaceEnc.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want) {
+			t.Errorf("got %#q, want %#q", b, want)
+		}
+	}
+	// Invalid options.
+	if _, err := structEnc.Marshal(xx, TimeLayout("")); err == nil {
+		t.Error("expected non-nil error")
+	}
+	// Unsupported types.
+	if _, err := NewTypedEncoder[chan int](); err == nil {
+		t.Error("expected non-nil error")
+	}
+	if _, err := NewTypedEncoder[func()](); err == nil {
+		t.Error("expected non-nil error")
+	}
+}
+
+// TestTypedEncoderConcurrent tests that a TypedEncoder
+// can be used by several goroutines at once, each with
+// its own options, and produces the same output as
+// MarshalOpts for each of them.
+func TestTypedEncoderConcurrent(t *testing.T) {
+	type x struct {
+		A int               `json:"a"`
+		B map[string]string `json:"b"`
+		C []float64         `json:"c"`
+	}
+	enc, err := NewTypedEncoder[map[string]x]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]x{
+		"k1": {A: 1, B: map[string]string{"a": "<b>", "c": "d"}, C: []float64{1.5}},
+		"k2": {A: 2},
+	}
+	optsets := [][]Option{
+		nil,
+		{NoHTMLEscaping(), NilMapEmpty()},
+		{Indent("", "  "), UnsortedMap()},
+		{KeyPrefix("p_"), FloatFormat('e', 2)},
+		{DenyList([]string{"k2"}), WithContext(context.Background())},
+	}
+	wants := make([][]byte, len(optsets))
+	for i, opts := range optsets {
+		if wants[i], err = MarshalOpts(m, opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each goroutine uses the same encoder with
+	// its own options and writers.
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				n := (g + i) % len(optsets)
+				opts := optsets[n]
+
+				b, err := enc.Marshal(m, opts...)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var sb strings.Builder
+				s := enc.NewStream(&sb, opts...)
+				if err := s.Write(m); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := s.Close(); err != nil {
+					t.Error(err)
+					return
+				}
+				var bb bytes.Buffer
+				if err := enc.EncodeMerged([]map[string]x{m}, &bb, opts...); err != nil {
+					t.Error(err)
+					return
+				}
+				for _, got := range [][]byte{b, []byte(strings.TrimSuffix(sb.String(), "\n")), bb.Bytes()} {
+					if n == 2 {
+						// The unsorted maps may differ.
+						if len(got) != len(wants[n]) {
+							t.Errorf("got %#q, want %#q", got, wants[n])
+						}
+					} else if !bytes.Equal(got, wants[n]) {
+						t.Errorf("got %#q, want %#q", got, wants[n])
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// TestEncodeMerged tests that the entries of the maps
+// given to EncodeMerged are written as a single object,
+// the last value of a key winning, and that it fails
+// for the types that aren't maps.
+func TestEncodeMerged(t *testing.T) {
+	enc, err := NewTypedEncoder[map[string]interface{}]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	maps := []map[string]interface{}{
+		{"host": "localhost", "port": 80, "tls": false},
+		nil,
+		{"port": 8080, "debug": true},
+		{},
+		{"tls": map[string]string{"cert": "a.pem"}, "port": 443},
+	}
+	for _, v := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, `{"debug":true,"host":"localhost","port":443,"tls":{"cert":"a.pem"}}`},
+		{[]Option{UnsortedMap()}, `{"debug":true,"host":"localhost","port":443,"tls":{"cert":"a.pem"}}`},
+		{[]Option{WithMapKeys([]string{"port", "host"})}, `{"host":"localhost","port":443}`},
+		{[]Option{KeyPrefix("app_"), PrefixMapKeys()}, `{"app_debug":true,"app_host":"localhost","app_port":443,"app_tls":{"cert":"a.pem"}}`},
+		{[]Option{Newline()}, "{\"debug\":true,\"host\":\"localhost\",\"port\":443,\"tls\":{\"cert\":\"a.pem\"}}\n"},
+	} {
+		var buf bytes.Buffer
+		if err := enc.EncodeMerged(maps, &buf, v.opts...); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != v.want {
+			t.Errorf("got %#q, want %#q", got, v.want)
+		}
+	}
+	var buf bytes.Buffer
+	if err := enc.EncodeMerged(nil, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `{}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Integer keys are sorted by their
+	// representation, like for a map.
+	ienc, err := NewTypedEncoder[map[int]string]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := ienc.EncodeMerged([]map[int]string{{1: "a", 10: "b"}, {2: "c", 1: "d"}}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `{"1":"d","10":"b","2":"c"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	senc, err := NewTypedEncoder[[]string]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uerr *UnsupportedTypeError
+	if err := senc.EncodeMerged(nil, &buf); !errors.As(err, &uerr) {
+		t.Errorf("got %v, want %T", err, uerr)
+	}
+	werr := errors.New("write error")
+	if err := enc.EncodeMerged(maps, failWriter{werr}); err != werr {
+		t.Errorf("got %v, want %v", err, werr)
+	}
+}
+
+// TestTypedEncoderFields tests that Fields describes the
+// fields encoded for a struct type, with the promoted
+// fields and the options of their tag, and that it fails
+// for the types that aren't structs.
+func TestTypedEncoderFields(t *testing.T) {
+	type (
+		A struct{ S string }
+		D struct {
+			XXX string `json:"S"`
+		}
+		Embed struct {
+			P *int `json:"p,omitnil"`
+		}
+		x struct {
+			A
+			D
+			*Embed
+			N  int      `json:"n,string,omitempty"`
+			M  []string `json:"m,omitnil"`
+			I  int      `json:"i,omitnil"`
+			No int      `json:"-"`
+		}
+	)
+	enc, err := NewTypedEncoder[*x]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := enc.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FieldInfo{
+		{Name: "S", Path: []string{"D", "XXX"}, Kind: reflect.String},
+		{Name: "p", Path: []string{"Embed", "P"}, Kind: reflect.Ptr, OmitNil: true},
+		{Name: "n", Path: []string{"N"}, Kind: reflect.Int, OmitEmpty: true, Quoted: true},
+		{Name: "m", Path: []string{"M"}, Kind: reflect.Slice, OmitNil: true},
+		{Name: "i", Path: []string{"I"}, Kind: reflect.Int},
+	}
+	if !reflect.DeepEqual(infos, want) {
+		t.Errorf("got %+v, want %+v", infos, want)
+	}
+	enc2, err := NewTypedEncoder[[]x]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc2.Fields(); err == nil {
+		t.Error("expected non-nil error")
+	}
+}
+
+// TestTypedEncoderComplexAsObject tests that a TypedEncoder
+// of a complex type requires the ComplexAsObject option.
+func TestTypedEncoderComplexAsObject(t *testing.T) {
+	enc, err := NewTypedEncoder[complex64]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := enc.Marshal(1-1i, ComplexAsObject())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"real":1,"imag":-1}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	if _, err := enc.Marshal(0); err == nil {
+		t.Error("expected non-nil error")
+	}
+}
+
+// TestTypedEncoderDefaultContext tests that a TypedEncoder
+// and its streams pass a default context to the
+// AppendMarshalerCtx implementations.
+func TestTypedEncoderDefaultContext(t *testing.T) {
+	type x struct {
+		A todoctxm  `json:"a"`
+		B *todoctxm `json:"b"`
+	}
+	xx := &x{B: &todoctxm{}}
+	want := `{"a":"todo","b":"todo"}`
+
+	enc, err := NewTypedEncoder[*x]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := enc.Marshal(xx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	var buf bytes.Buffer
+	s := enc.NewStream(&buf)
+	if err := s.Write(xx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSuffix(buf.String(), "\n"); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestTypedEncoderDetectCycles tests that a TypedEncoder
+// honors the DetectCycles option.
+func TestTypedEncoderDetectCycles(t *testing.T) {
+	type x struct {
+		A string `json:"a"`
+		X *x     `json:"x,omitempty"`
+	}
+	ptr := &x{A: "A1"}
+	ptr.X = &x{A: "A2", X: ptr}
+
+	enc, err := NewTypedEncoder[*x]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Marshal(ptr, DetectCycles()); !errors.Is(err, ErrCycleDetected) {
+		t.Errorf("got %v, want %v", err, ErrCycleDetected)
+	}
+}
+
+// TestEncodeMergedMapKeySort tests that EncodeMerged
+// honors the NumericMapKeys and CaseInsensitiveMapSort
+// options.
+func TestEncodeMergedMapKeySort(t *testing.T) {
+	ienc, err := NewTypedEncoder[map[int]string]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	imaps := []map[int]string{{10: "a", 9: "b"}, {100: "c", 9: "d"}}
+	if err := ienc.EncodeMerged(imaps, &buf, NumericMapKeys()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `{"9":"d","10":"a","100":"c"}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+	// Keys that differ only in case are merged
+	// separately by EncodeMerged.
+	senc, err := NewTypedEncoder[map[string]int]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	smaps := []map[string]int{{"a": 1, "B": 2}, {"A": 3, "a": 4}}
+	if err := senc.EncodeMerged(smaps, &buf, CaseInsensitiveMapSort()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `{"A":3,"a":4,"B":2}`; got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+// TestTypedEncoderComputeETag tests that a TypedEncoder
+// honors the ComputeETag option.
+func TestTypedEncoderComputeETag(t *testing.T) {
+	hash := func(b []byte) string {
+		return fmt.Sprintf("%x", sha256.Sum256(b))
+	}
+	type x struct {
+		B int               `json:"b"`
+		A map[string]string `json:"a"`
+	}
+	enc, err := NewTypedEncoder[x]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := enc.Marshal(x{B: 2}, ComputeETag("_etag", hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"b":2,"a":null,"_etag":"` + hash([]byte(`{"a":null,"b":2}`)) + `"}`
+	if got := string(b); got != want {
+		t.Errorf("got %#q, want %#q", got, want)
+	}
+}
+
+func BenchmarkTypedEncoder(b *testing.B) {
+	sp := simplePayload{
+		St:   1,
+		Sid:  2,
+		Tt:   "TestString",
+		Gr:   4,
+		UUID: "8f9a65eb-4807-4d57-b6e0-bda5d62f1429",
+		IP:   "127.0.0.1",
+		Ua:   "Mozilla",
+		Tz:   8,
+		V:    true,
+	}
+	b.Run("append", func(b *testing.B) {
+		var buf []byte
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var err error
+			if buf, err = Append(buf[:0], sp); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(buf)))
+		}
+	})
+	b.Run("typed", func(b *testing.B) {
+		enc, err := NewTypedEncoder[simplePayload]()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var buf []byte
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if buf, err = enc.Append(buf[:0], sp); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(buf)))
+		}
+	})
+}
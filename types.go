@@ -1,8 +1,10 @@
 package jettison
 
 import (
+	"database/sql/driver"
 	"encoding"
 	"encoding/json"
+	"math/big"
 	"reflect"
 	"sync"
 	"time"
@@ -11,17 +13,30 @@ import (
 
 var (
 	timeTimeType           = reflect.TypeOf(time.Time{})
+	timeTimePtrType        = reflect.TypeOf((*time.Time)(nil))
 	timeDurationType       = reflect.TypeOf(time.Duration(0))
 	syncMapType            = reflect.TypeOf((*sync.Map)(nil)).Elem()
 	jsonNumberType         = reflect.TypeOf(json.Number(""))
 	jsonRawMessageType     = reflect.TypeOf(json.RawMessage(nil))
 	jsonMarshalerType      = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
 	textMarshalerType      = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	binaryMarshalerType    = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	sqlValuerType          = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+	stringReaderType       = reflect.TypeOf((*StringReader)(nil)).Elem()
 	appendMarshalerType    = reflect.TypeOf((*AppendMarshaler)(nil)).Elem()
 	appendMarshalerCtxType = reflect.TypeOf((*AppendMarshalerCtx)(nil)).Elem()
+	errorType              = reflect.TypeOf((*error)(nil)).Elem()
+	emptyInterfaceType     = reflect.TypeOf((*interface{})(nil)).Elem()
+	bigIntType             = reflect.TypeOf(big.Int{})
+	bigIntPtrType          = reflect.TypeOf((*big.Int)(nil))
+	bigRatType             = reflect.TypeOf(big.Rat{})
+	bigRatPtrType          = reflect.TypeOf((*big.Rat)(nil))
 )
 
-var emptyFnCache sync.Map // map[reflect.Type]emptyFunc
+var (
+	emptyFnCache sync.Map // map[reflect.Type]emptyFunc
+	zeroFnCache  sync.Map // map[reflect.Type]emptyFunc
+)
 
 // emptyFunc is a function that returns whether a
 // value pointed by an unsafe.Pointer represents the
@@ -66,9 +81,56 @@ func isInteger(t reflect.Type) bool {
 	}
 }
 
+// isTemplateType returns whether t is one of the
+// string types of the html/template package, that
+// represent content known to be safe. The package
+// is not imported to avoid the dependency.
+func isTemplateType(t reflect.Type) bool {
+	return t.Kind() == reflect.String && t.PkgPath() == "html/template"
+}
+
+// isByteSlice returns whether t is a slice of bytes
+// that is encoded as a JSON string, which is the case
+// if the element type doesn't implement a marshaler,
+// and isn't registered with BitFlagStrings or
+// EnumStrings.
+func isByteSlice(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice {
+		return false
+	}
+	return isByteElem(t.Elem())
+}
+
+// isByteElem returns whether the elements of type t
+// of a slice or an array are encoded as a string.
+func isByteElem(t reflect.Type) bool {
+	if t.Kind() != reflect.Uint8 || isRegisteredType(t) {
+		return false
+	}
+	pe := reflect.PtrTo(t)
+
+	return !pe.Implements(jsonMarshalerType) && !pe.Implements(textMarshalerType)
+}
+
+// isFuncValue returns whether t is a function type
+// that can be resolved with the ResolveFuncValues
+// option, and whether it also returns an error.
+func isFuncValue(t reflect.Type) (ok, withErr bool) {
+	if t.Kind() != reflect.Func || t.NumIn() != 0 || t.IsVariadic() {
+		return false, false
+	}
+	switch n := t.NumOut(); {
+	case n == 0 || n > 2 || t.Out(0) != emptyInterfaceType:
+		return false, false
+	case n == 2:
+		return t.Out(1) == errorType, true
+	}
+	return true, false
+}
+
 func isInlined(t reflect.Type) bool {
 	switch t.Kind() {
-	case reflect.Ptr, reflect.Map:
+	case reflect.Ptr, reflect.Map, reflect.Func:
 		return true
 	case reflect.Struct:
 		return t.NumField() == 1 && isInlined(t.Field(0).Type)
@@ -99,6 +161,17 @@ func cachedEmptyFuncOf(t reflect.Type) emptyFunc {
 // determine if a value pointed by an unsafe,Pointer
 // represents the zero-value of type t.
 func emptyFuncOf(t reflect.Type) emptyFunc {
+	if fn := registeredEmptyPredicate(t); fn != nil {
+		inlined := isInlined(t)
+		return func(p unsafe.Pointer) bool {
+			return fn(packEface(p, t, inlined))
+		}
+	}
+	if t == bigRatType {
+		return func(p unsafe.Pointer) bool {
+			return (*big.Rat)(p).Sign() == 0
+		}
+	}
 	switch t.Kind() {
 	case reflect.Bool:
 		return func(p unsafe.Pointer) bool {
@@ -164,7 +237,7 @@ func emptyFuncOf(t reflect.Type) emptyFunc {
 		return func(p unsafe.Pointer) bool {
 			return maplen(*(*unsafe.Pointer)(p)) == 0
 		}
-	case reflect.Ptr:
+	case reflect.Ptr, reflect.Func:
 		return func(p unsafe.Pointer) bool {
 			return *(*unsafe.Pointer)(p) == nil
 		}
@@ -183,3 +256,164 @@ func emptyFuncOf(t reflect.Type) emptyFunc {
 	}
 	return func(unsafe.Pointer) bool { return false }
 }
+
+// cachedZeroFuncOf is similar to zeroFuncOf, but
+// returns a cached function, to avoid duplicates.
+func cachedZeroFuncOf(t reflect.Type) emptyFunc {
+	if fn, ok := zeroFnCache.Load(t); ok {
+		return fn.(emptyFunc)
+	}
+	fn, _ := zeroFnCache.LoadOrStore(t, zeroFuncOf(t))
+	return fn.(emptyFunc)
+}
+
+// zeroFuncOf returns a function that reports whether
+// the value pointed by an unsafe.Pointer is the zero
+// value of type t, like the IsZero method of the type
+// reflect.Value does, with the negative zero being a
+// zero value of the floating-point numbers. Except for
+// the strings and the floating-point numbers, the memory
+// of the values is compared with zero, and that of the
+// consecutive fields of a struct is compared at once.
+func zeroFuncOf(t reflect.Type) emptyFunc {
+	switch t.Kind() {
+	case reflect.String:
+		return func(p unsafe.Pointer) bool {
+			return (*stringHeader)(p).Len == 0
+		}
+	case reflect.Float32:
+		return func(p unsafe.Pointer) bool {
+			return *(*float32)(p) == 0
+		}
+	case reflect.Float64:
+		return func(p unsafe.Pointer) bool {
+			return *(*float64)(p) == 0
+		}
+	case reflect.Complex64:
+		return func(p unsafe.Pointer) bool {
+			return *(*complex64)(p) == 0
+		}
+	case reflect.Complex128:
+		return func(p unsafe.Pointer) bool {
+			return *(*complex128)(p) == 0
+		}
+	case reflect.Array:
+		if hasZeroMemory(t) {
+			break
+		}
+		fn, n, es := zeroFuncOf(t.Elem()), t.Len(), t.Elem().Size()
+		return func(p unsafe.Pointer) bool {
+			for i := 0; i < n; i++ {
+				if !fn(unsafe.Pointer(uintptr(p) + uintptr(i)*es)) {
+					return false
+				}
+			}
+			return true
+		}
+	case reflect.Struct:
+		if hasZeroMemory(t) {
+			break
+		}
+		return structZeroFunc(t)
+	}
+	size := t.Size()
+
+	return func(p unsafe.Pointer) bool {
+		return isZeroMemory(p, size)
+	}
+}
+
+// zeroCheck checks that a range of the memory of a
+// struct is zero, or that a field is the zero value
+// of its type, if fn is non-nil.
+type zeroCheck struct {
+	offset uintptr
+	size   uintptr
+	fn     emptyFunc
+}
+
+// structZeroFunc returns the function of zeroFuncOf
+// for the struct type t, whose fields don't all have
+// a zero value represented by zero memory. The ranges
+// of the consecutive fields that have one are merged,
+// and checked at once.
+func structZeroFunc(t reflect.Type) emptyFunc {
+	var checks []zeroCheck
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Type.Size() == 0 {
+			continue
+		}
+		if !hasZeroMemory(sf.Type) {
+			checks = append(checks, zeroCheck{
+				offset: sf.Offset,
+				fn:     zeroFuncOf(sf.Type),
+			})
+			continue
+		}
+		// Merge the range of the field with
+		// that of the previous one, if they
+		// are contiguous.
+		if n := len(checks); n != 0 && checks[n-1].fn == nil &&
+			checks[n-1].offset+checks[n-1].size == sf.Offset {
+			checks[n-1].size += sf.Type.Size()
+			continue
+		}
+		checks = append(checks, zeroCheck{
+			offset: sf.Offset,
+			size:   sf.Type.Size(),
+		})
+	}
+	return func(p unsafe.Pointer) bool {
+		for _, c := range checks {
+			fp := unsafe.Pointer(uintptr(p) + c.offset)
+			if c.fn != nil {
+				if !c.fn(fp) {
+					return false
+				}
+			} else if !isZeroMemory(fp, c.size) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// hasZeroMemory returns whether the values of type t
+// are zero if and only if all their memory is zero.
+// This isn't the case of the strings, whose pointer
+// is irrelevant when their length is zero, of the
+// floating-point numbers, for the negative zero, and
+// of the structs with padding, which isn't compared.
+func hasZeroMemory(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Array:
+		return t.Len() == 0 || hasZeroMemory(t.Elem())
+	case reflect.Struct:
+		var end uintptr
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if sf.Offset != end || !hasZeroMemory(sf.Type) {
+				return false
+			}
+			end += sf.Type.Size()
+		}
+		return end == t.Size()
+	}
+	return true
+}
+
+// isZeroMemory returns whether the n bytes
+// of memory pointed by p are all zero.
+func isZeroMemory(p unsafe.Pointer, n uintptr) bool {
+	for _, b := range unsafe.Slice((*byte)(p), n) {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
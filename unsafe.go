@@ -12,6 +12,13 @@ type eface struct {
 	word  unsafe.Pointer
 }
 
+// iface is the runtime representation of
+// an interface with methods.
+type iface struct {
+	tab  unsafe.Pointer
+	word unsafe.Pointer
+}
+
 // sliceHeader is the runtime representation
 // of a slice.
 type sliceHeader struct {
@@ -38,6 +45,14 @@ func unpackEface(i interface{}) *eface {
 	return (*eface)(unsafe.Pointer(&i))
 }
 
+// appendMarshalerTab returns the itab of the
+// AppendMarshaler interface for the type t,
+// which must implement it.
+func appendMarshalerTab(t reflect.Type) unsafe.Pointer {
+	m := reflect.New(t).Elem().Interface().(AppendMarshaler)
+	return (*iface)(unsafe.Pointer(&m)).tab
+}
+
 func packEface(p unsafe.Pointer, t reflect.Type, ptr bool) interface{} {
 	var i interface{}
 	e := (*eface)(unsafe.Pointer(&i))
@@ -65,3 +80,10 @@ func sp2b(p unsafe.Pointer) []byte {
 		Cap:  shdr.Len,
 	}))
 }
+
+// b2s converts a byte slice to a string
+// without copy. The bytes must not be
+// modified while the string is in use.
+func b2s(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}